@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 
 	"eqrx.net/rungroup"
 	"eqrx.net/wallhack/internal/packet"
@@ -55,6 +56,81 @@ func Bridge(ctx context.Context, left, right ReadWriteCloser) error {
 	return fmt.Errorf("bridge: %w", group.Wait())
 }
 
+// queueLen is the number of packets buffered for each queue of a multi-queue device.
+const queueLen = 64
+
+// Queues bridges left with the queues of a multi-queue device. Packets from left are distributed over the queues by
+// flow, so packets of a flow stay in order. Packets from all queues are written to left. With a single queue this is
+// the same as [Bridge].
+func Queues(ctx context.Context, left ReadWriteCloser, queues []ReadWriteCloser) error {
+	if len(queues) == 1 {
+		return Bridge(ctx, left, queues[0])
+	}
+
+	group := rungroup.New(ctx)
+	shared := &lockedWriter{dst: left}
+	channels := make([]chan *packet.Packet, len(queues))
+
+	group.Go(func(ctx context.Context) error { return closer(ctx, left) })
+
+	for i, queue := range queues {
+		queue, channel := queue, make(chan *packet.Packet, queueLen)
+		channels[i] = channel
+
+		group.Go(func(ctx context.Context) error { return closer(ctx, queue) })
+		group.Go(func(_ context.Context) error { return simplex(shared, queue) })
+		group.Go(func(ctx context.Context) error { return drain(ctx, queue, channel) })
+	}
+
+	group.Go(func(ctx context.Context) error { return distribute(ctx, channels, left) })
+
+	return fmt.Errorf("bridge: %w", group.Wait())
+}
+
+// lockedWriter allows several goroutines to write to dst.
+type lockedWriter struct {
+	mtx sync.Mutex
+	dst Writer
+}
+
+func (l *lockedWriter) WritePacket(p *packet.Packet) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.dst.WritePacket(p)
+}
+
+// distribute reads packets from src and hands them to the channel their flow hash picks.
+func distribute(ctx context.Context, channels []chan *packet.Packet, src Reader) error {
+	for {
+		packet, err := src.ReadPacket()
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+
+		// Readers reuse their buffers, so the packet has to be copied before it is handed to another goroutine.
+		select {
+		case channels[packet.FlowHash()%uint32(len(channels))] <- packet.Clone():
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// drain writes the packets of channel to dst.
+func drain(ctx context.Context, dst Writer, channel <-chan *packet.Packet) error {
+	for {
+		select {
+		case packet := <-channel:
+			if err := dst.WritePacket(packet); err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
 func closer(ctx context.Context, c io.Closer) error {
 	<-ctx.Done()
 
@@ -18,11 +18,13 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"sync"
 	"testing"
 
 	"eqrx.net/rungroup"
 	"eqrx.net/wallhack/internal/bridge"
 	"eqrx.net/wallhack/internal/packet"
+	"golang.org/x/net/ipv6"
 )
 
 type (
@@ -178,3 +180,87 @@ func TestWriteErr(t *testing.T) {
 		t.Fatalf("%d %d %d %d", errsACount, errsBCount, errsCCount, errsDCount)
 	}
 }
+
+// pipe is a packet stream whose reads block until a packet is fed or it is closed.
+type pipe struct {
+	in   chan *packet.Packet
+	out  chan *packet.Packet
+	done chan struct{}
+	once sync.Once
+}
+
+func newPipe() *pipe {
+	return &pipe{make(chan *packet.Packet), make(chan *packet.Packet, 16), make(chan struct{}), sync.Once{}}
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() { close(p.done) })
+
+	return nil
+}
+
+func (p *pipe) ReadPacket() (*packet.Packet, error) {
+	select {
+	case pkt := <-p.in:
+		return pkt, nil
+	case <-p.done:
+		return nil, io.EOF
+	}
+}
+
+func (p *pipe) WritePacket(pkt *packet.Packet) error {
+	p.out <- pkt
+
+	return nil
+}
+
+func flowPacket(src byte) *packet.Packet {
+	data := make([]byte, ipv6.HeaderLen+1)
+	data[0], data[5], data[8] = 0x60, 1, src
+
+	header, err := ipv6.ParseHeader(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return &packet.Packet{Header: header, Marshalled: data}
+}
+
+func TestQueues(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	left, queues := newPipe(), []*pipe{newPipe(), newPipe()}
+	done := make(chan error)
+
+	go func() { done <- bridge.Queues(ctx, left, []bridge.ReadWriteCloser{queues[0], queues[1]}) }()
+
+	for src := byte(0); src < 8; src++ {
+		pkt := flowPacket(src)
+		want := queues[pkt.FlowHash()%2]
+
+		for i := 0; i < 2; i++ {
+			left.in <- pkt
+
+			if have := <-want.out; have.Header.Src[0] != src {
+				t.Fatalf("packet of flow %d ended up in flow %d", src, have.Header.Src[0])
+			}
+		}
+	}
+
+	for _, queue := range queues {
+		queue.in <- flowPacket(42)
+
+		if have := <-left.out; have.Header.Src[0] != 42 {
+			t.Fatal("packet from queue did not reach left")
+		}
+	}
+
+	cancel()
+
+	if err := <-done; err == nil {
+		t.Fatal("expected bridge to end with an error")
+	}
+}
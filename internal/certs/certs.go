@@ -0,0 +1,543 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package certs holds the TLS material of wallhack and reloads it while running. Material is read either from
+// systemd credentials or from files and reloaded on SIGHUP or when the underlying files change.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// CertCredName is the name of the credential holding the certificate chain.
+	CertCredName = "cert"
+	// KeyCredName is the name of the credential holding the private key.
+	KeyCredName = "key"
+	// CACredName is the name of the credential holding the CA certificates peers are verified against.
+	CACredName = "ca"
+	// CRLCredName is the name of the credential holding revocation lists for the CA.
+	CRLCredName = "crl"
+	// IntermediatesCredName is the name of the credential holding intermediate CA certificates.
+	IntermediatesCredName = "intermediates"
+	// defaultWatchInterval is the interval in which files are checked for changes if not configured otherwise.
+	defaultWatchInterval = 30 * time.Second
+	// pemCRLType is the PEM block type of certificate revocation lists.
+	pemCRLType = "X509 CRL"
+)
+
+var (
+	// ErrNoCA indicates that peers should be verified but no CA is loaded.
+	ErrNoCA = errors.New("no CA configured")
+	// ErrNoPeerCert indicates that the peer did not present a certificate.
+	ErrNoPeerCert = errors.New("peer presented no certificate")
+	// ErrRevoked indicates that the peer certificate or one of its issuers is revoked.
+	ErrRevoked = errors.New("certificate revoked")
+	// ErrChain indicates that the peer certificate chain is longer than allowed or the peer certificate lacks a
+	// required key usage.
+	ErrChain = errors.New("certificate chain not acceptable")
+	// ErrKeyUsage indicates that a configured key usage is unknown.
+	ErrKeyUsage        = errors.New("unknown key usage")
+	errCRLIssuer       = errors.New("crl not signed by a loaded CA")
+	errCA              = errors.New("no certificates in CA file")
+	errIntermediate    = errors.New("intermediate not issued by a loaded CA")
+	errNoIntermediates = errors.New("no certificates in intermediates file")
+)
+
+// extKeyUsages maps names of extended key usages to their value.
+var extKeyUsages = map[string]x509.ExtKeyUsage{ //nolint:gochecknoglobals
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"ocspSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// keyUsages maps names of key usages to their value.
+var keyUsages = map[string]x509.KeyUsage{ //nolint:gochecknoglobals
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+}
+
+// Config specifies where TLS material is read from. Empty paths cause the material to be read from the systemd
+// credential of the same name.
+type Config struct {
+	// Cert is the path to the PEM encoded certificate chain.
+	Cert string `yaml:"cert"`
+	// Key is the path to the PEM encoded private key.
+	Key string `yaml:"key"`
+	// CA is the path to the PEM encoded CA certificates that peers are verified against.
+	CA string `yaml:"ca"`
+	// CRL is the path to the PEM or DER encoded certificate revocation lists. Lists may be signed by a CA or by one of
+	// the intermediates.
+	CRL string `yaml:"crl"`
+	// Intermediates is the path to PEM encoded intermediate CA certificates issued by the CA. They complete the chains
+	// of peers that do not send their intermediates themselves. Optional.
+	Intermediates string `yaml:"intermediates"`
+	// MaxIntermediates is the number of intermediate CAs allowed between peer certificate and CA. Unset means no limit
+	// besides the path length constraints of the CAs themselves.
+	MaxIntermediates *int `yaml:"maxIntermediates"`
+	// KeyUsages are the key usages and extended key usages peer certificates need, for example digitalSignature or
+	// clientAuth. The extended key usage defaults to clientAuth if none is given.
+	KeyUsages []string `yaml:"keyUsages"`
+	// WatchInterval is the interval in which the files are checked for changes.
+	WatchInterval time.Duration `yaml:"watchInterval"`
+}
+
+// stamp identifies the version of a file.
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// bundle is a consistent set of loaded TLS material.
+type bundle struct {
+	cert          *tls.Certificate
+	roots         *x509.CertPool
+	intermediates []*x509.Certificate
+	revoked       map[string]struct{}
+	stamps        map[string]stamp
+}
+
+// Store holds the currently loaded TLS material and allows replacing it while running.
+// Its methods may be used as callbacks in [tls.Config].
+type Store struct {
+	cfg          Config
+	credPath     func(name string) string
+	extKeyUsages []x509.ExtKeyUsage
+	keyUsage     x509.KeyUsage
+	current      atomic.Pointer[bundle]
+}
+
+// New creates a new [Store] and loads the initial material. credPath maps credential names to their file path.
+func New(cfg Config, credPath func(name string) string) (*Store, error) {
+	if cfg.WatchInterval <= 0 {
+		cfg.WatchInterval = defaultWatchInterval
+	}
+
+	store := &Store{cfg: cfg, credPath: credPath}
+
+	for _, name := range cfg.KeyUsages {
+		if usage, ok := extKeyUsages[name]; ok {
+			store.extKeyUsages = append(store.extKeyUsages, usage)
+		} else if usage, ok := keyUsages[name]; ok {
+			store.keyUsage |= usage
+		} else {
+			return nil, fmt.Errorf("new cert store: %w: %s", ErrKeyUsage, name)
+		}
+	}
+
+	// Without extended key usages the verifier would require serverAuth.
+	if len(store.extKeyUsages) == 0 {
+		store.extKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	if err := store.Reload(); err != nil {
+		return nil, fmt.Errorf("new cert store: %w", err)
+	}
+
+	return store, nil
+}
+
+// HasCA returns true if CA certificates are loaded.
+func (s *Store) HasCA() bool { return s.current.Load().roots != nil }
+
+// Certificate returns the currently loaded certificate.
+func (s *Store) Certificate() *tls.Certificate { return s.current.Load().cert }
+
+// GetCertificate returns the current certificate. It is meant to be used as [tls.Config.GetCertificate].
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current.Load().cert, nil
+}
+
+// GetClientCertificate returns the current certificate. It is meant to be used as
+// [tls.Config.GetClientCertificate].
+func (s *Store) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.current.Load().cert, nil
+}
+
+// VerifyPeerCertificate verifies the raw peer certificates against the currently loaded CA and CRLs.
+// It is meant to be used as [tls.Config.VerifyPeerCertificate] in combination with [tls.RequireAnyClientCert].
+func (s *Store) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("verify peer: %w", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if _, err := s.Verify(certs); err != nil {
+		return fmt.Errorf("verify peer: %w", err)
+	}
+
+	return nil
+}
+
+// Verify verifies the given peer certificates (leaf first) against the currently loaded CA and CRLs and returns all
+// chains that are not revoked.
+func (s *Store) Verify(certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+	bundle := s.current.Load()
+
+	if bundle.roots == nil {
+		return nil, ErrNoCA
+	}
+
+	if len(certs) == 0 {
+		return nil, ErrNoPeerCert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range append(append([]*x509.Certificate{}, certs[1:]...), bundle.intermediates...) {
+		intermediates.AddCert(cert)
+	}
+
+	if certs[0].KeyUsage&s.keyUsage != s.keyUsage {
+		return nil, fmt.Errorf("verify: %w: key usage missing", ErrChain)
+	}
+
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         bundle.roots,
+		Intermediates: intermediates,
+		KeyUsages:     s.extKeyUsages,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verify: %w", err)
+	}
+
+	valid := make([][]*x509.Certificate, 0, len(chains))
+	tooLong := false
+
+	for _, chain := range chains {
+		switch {
+		case s.cfg.MaxIntermediates != nil && len(chain)-2 > *s.cfg.MaxIntermediates:
+			tooLong = true
+		case !bundle.isRevoked(chain):
+			valid = append(valid, chain)
+		}
+	}
+
+	switch {
+	case len(valid) > 0:
+		return valid, nil
+	case tooLong:
+		return nil, fmt.Errorf("verify: %w: more than %d intermediates", ErrChain, *s.cfg.MaxIntermediates)
+	default:
+		return nil, fmt.Errorf("verify: %w: serial %s", ErrRevoked, certs[0].SerialNumber)
+	}
+}
+
+// Reload reads all material again and replaces the current material on success.
+func (s *Store) Reload() error {
+	loaded := &bundle{stamps: map[string]stamp{}}
+
+	certData, err := loaded.read(s.path(CertCredName, s.cfg.Cert))
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+
+	keyData, err := loaded.read(s.path(KeyCredName, s.cfg.Key))
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return fmt.Errorf("reload: parse keys: %w", err)
+	}
+
+	loaded.cert = &cert
+
+	caCerts, err := loaded.loadCA(s.path(CACredName, s.cfg.CA))
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+
+	if err := loaded.loadIntermediates(s.path(IntermediatesCredName, s.cfg.Intermediates)); err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+
+	if err := loaded.loadCRL(s.path(CRLCredName, s.cfg.CRL), append(caCerts, loaded.intermediates...)); err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+
+	s.current.Store(loaded)
+
+	return nil
+}
+
+// Run reloads the material when SIGHUP is received or one of the loaded files changes.
+// Failed reloads are logged and the previous material stays in use. Blocks until ctx is done.
+func (s *Store) Run(ctx context.Context, log logr.Logger) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, unix.SIGHUP)
+
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(s.cfg.WatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			s.reload(log, "sighup")
+		case <-ticker.C:
+			if s.changed() {
+				s.reload(log, "file change")
+			}
+		}
+	}
+}
+
+func (s *Store) reload(log logr.Logger, reason string) {
+	if err := s.Reload(); err != nil {
+		log.Error(err, "reloading tls material failed, keeping old material", "reason", reason)
+
+		return
+	}
+
+	log.Info("reloaded tls material", "reason", reason)
+}
+
+// changed returns true if one of the files loaded for the current material changed.
+func (s *Store) changed() bool {
+	for path, old := range s.current.Load().stamps {
+		info, err := os.Stat(path)
+
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && old == (stamp{}):
+		case err != nil:
+			return true
+		case info.ModTime() != old.modTime || info.Size() != old.size:
+			return true
+		}
+	}
+
+	return false
+}
+
+// path returns the configured path or, if unset, the path of the credential called name.
+func (s *Store) path(name, configured string) string {
+	if configured != "" {
+		return configured
+	}
+
+	return s.credPath(name)
+}
+
+// read reads the file at path and remembers its version.
+func (b *bundle) read(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	b.stamps[path] = stamp{info.ModTime(), info.Size()}
+
+	return data, nil
+}
+
+// readOptional works like read but returns nil data if the file does not exist.
+// The absence is remembered so that the file appearing later counts as change.
+func (b *bundle) readOptional(path string) ([]byte, error) {
+	data, err := b.read(path)
+
+	switch {
+	case err == nil:
+		return data, nil
+	case errors.Is(err, fs.ErrNotExist):
+		b.stamps[path] = stamp{}
+
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// parseCertificates parses all PEM encoded certificates in data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificates: %w", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// loadCA loads the CA certificates at path into the bundle. A missing file leaves the bundle without CA.
+func (b *bundle) loadCA(path string) ([]*x509.Certificate, error) {
+	data, err := b.readOptional(path)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("load ca: %w", err)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("load ca: %w: %s", errCA, path)
+	}
+
+	b.roots = x509.NewCertPool()
+	for _, cert := range certs {
+		b.roots.AddCert(cert)
+	}
+
+	return certs, nil
+}
+
+// loadIntermediates loads the intermediate CA certificates at path into the bundle. Each of them must chain up to
+// the loaded CA. A missing file leaves the bundle without intermediates.
+func (b *bundle) loadIntermediates(path string) error {
+	data, err := b.readOptional(path)
+	if err != nil || data == nil {
+		return err
+	}
+
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return fmt.Errorf("load intermediates: %w", err)
+	}
+
+	if len(certs) == 0 {
+		return fmt.Errorf("load intermediates: %w: %s", errNoIntermediates, path)
+	}
+
+	if b.roots == nil {
+		return fmt.Errorf("load intermediates: %w", ErrNoCA)
+	}
+
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+
+	for _, cert := range certs {
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         b.roots,
+			Intermediates: pool,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil || !cert.IsCA {
+			return fmt.Errorf("load intermediates: %w: %s", errIntermediate, cert.Subject)
+		}
+	}
+
+	b.intermediates = certs
+
+	return nil
+}
+
+// loadCRL loads the revocation lists at path into the bundle. Every list must be signed by one of cas, which
+// contains the CA and intermediate certificates.
+// A missing file leaves the bundle without revocations.
+func (b *bundle) loadCRL(path string, cas []*x509.Certificate) error {
+	b.revoked = map[string]struct{}{}
+
+	data, err := b.readOptional(path)
+	if err != nil || data == nil {
+		return err
+	}
+
+	var ders [][]byte
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == pemCRLType {
+			ders = append(ders, block.Bytes)
+		}
+	}
+
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("load crl: %w", err)
+		}
+
+		if !signedByAny(crl, cas) {
+			return fmt.Errorf("load crl: %w: %s", errCRLIssuer, crl.Issuer)
+		}
+
+		for _, revoked := range crl.RevokedCertificates {
+			b.revoked[revocationKey(crl.RawIssuer, revoked.SerialNumber.String())] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// isRevoked returns true if any certificate in chain is revoked.
+func (b *bundle) isRevoked(chain []*x509.Certificate) bool {
+	for _, cert := range chain {
+		if _, ok := b.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func signedByAny(crl *x509.RevocationList, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func revocationKey(rawIssuer []byte, serial string) string { return string(rawIssuer) + "/" + serial }
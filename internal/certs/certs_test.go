@@ -0,0 +1,258 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package certs_test
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/testpki"
+)
+
+func writeKeyPair(t *testing.T, dir string, pair *testpki.Issued) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(pair.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testpki.WritePEM(t, path.Join(dir, certs.CertCredName), "CERTIFICATE", pair.Cert.Raw)
+	testpki.WritePEM(t, path.Join(dir, certs.KeyCredName), "EC PRIVATE KEY", keyDER)
+}
+
+func writeCRL(t *testing.T, dir string, ca *testpki.Issued, revoke ...*testpki.Issued) {
+	t.Helper()
+
+	revoked := make([]pkix.RevokedCertificate, 0, len(revoke))
+	for _, cert := range revoke {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.Cert.SerialNumber, RevocationTime: time.Now()})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(1),
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, ca.Cert, ca.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testpki.WritePEM(t, path.Join(dir, certs.CRLCredName), "X509 CRL", der)
+}
+
+func credDir(t *testing.T) (string, func(string) string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	return dir, func(name string) string { return path.Join(dir, name) }
+}
+
+func TestNoCA(t *testing.T) {
+	t.Parallel()
+
+	dir, credPath := credDir(t)
+	ca := testpki.Issue(t, "ca", nil)
+	writeKeyPair(t, dir, testpki.Issue(t, "server", ca))
+
+	store, err := certs.New(certs.Config{}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.HasCA() {
+		t.Fatal("store has CA")
+	}
+
+	if _, err := store.Verify([]*x509.Certificate{testpki.Issue(t, "client", ca).Cert}); !errors.Is(err, certs.ErrNoCA) {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	dir, credPath := credDir(t)
+	ca := testpki.Issue(t, "ca", nil)
+	writeKeyPair(t, dir, testpki.Issue(t, "server", ca))
+	testpki.WritePEM(t, path.Join(dir, certs.CACredName), "CERTIFICATE", ca.Cert.Raw)
+
+	store, err := certs.New(certs.Config{}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := store.Certificate()
+
+	writeKeyPair(t, dir, testpki.Issue(t, "server", ca))
+
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Certificate() == first {
+		t.Fatal("certificate not replaced")
+	}
+
+	if err := os.WriteFile(path.Join(dir, certs.KeyCredName), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	current := store.Certificate()
+
+	if err := store.Reload(); err == nil {
+		t.Fatal("broken key accepted")
+	}
+
+	if store.Certificate() != current {
+		t.Fatal("failed reload replaced certificate")
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	t.Parallel()
+
+	dir, credPath := credDir(t)
+	ca := testpki.Issue(t, "ca", nil)
+	client := testpki.Issue(t, "client", ca)
+
+	writeKeyPair(t, dir, testpki.Issue(t, "server", ca))
+	testpki.WritePEM(t, path.Join(dir, certs.CACredName), "CERTIFICATE", ca.Cert.Raw)
+
+	store, err := certs.New(certs.Config{}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify([]*x509.Certificate{client.Cert}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeCRL(t, dir, ca, client)
+
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify([]*x509.Certificate{client.Cert}); !errors.Is(err, certs.ErrRevoked) {
+		t.Fatal(err)
+	}
+}
+
+func TestForeignCRL(t *testing.T) {
+	t.Parallel()
+
+	dir, credPath := credDir(t)
+	ca := testpki.Issue(t, "ca", nil)
+
+	writeKeyPair(t, dir, testpki.Issue(t, "server", ca))
+	testpki.WritePEM(t, path.Join(dir, certs.CACredName), "CERTIFICATE", ca.Cert.Raw)
+	writeCRL(t, dir, testpki.Issue(t, "other ca", nil))
+
+	if _, err := certs.New(certs.Config{}, credPath); err == nil {
+		t.Fatal("foreign crl accepted")
+	}
+}
+
+func TestIntermediates(t *testing.T) {
+	t.Parallel()
+
+	dir, credPath := credDir(t)
+	ca := testpki.Issue(t, "ca", nil)
+	sub := testpki.Intermediate(t, "intermediate", ca)
+	client := testpki.Issue(t, "client", sub)
+
+	writeKeyPair(t, dir, testpki.Issue(t, "server", ca))
+	testpki.WritePEM(t, path.Join(dir, certs.CACredName), "CERTIFICATE", ca.Cert.Raw)
+
+	store, err := certs.New(certs.Config{}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify([]*x509.Certificate{client.Cert, sub.Cert}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify([]*x509.Certificate{client.Cert}); err == nil {
+		t.Fatal("incomplete chain accepted")
+	}
+
+	testpki.WritePEM(t, path.Join(dir, certs.IntermediatesCredName), "CERTIFICATE", sub.Cert.Raw)
+	writeCRL(t, dir, sub, client)
+
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify([]*x509.Certificate{client.Cert}); !errors.Is(err, certs.ErrRevoked) {
+		t.Fatal(err)
+	}
+}
+
+func TestChainLimits(t *testing.T) {
+	t.Parallel()
+
+	dir, credPath := credDir(t)
+	ca := testpki.Issue(t, "ca", nil)
+	sub := testpki.Intermediate(t, "intermediate", ca)
+	chain := []*x509.Certificate{testpki.Issue(t, "client", sub).Cert, sub.Cert}
+
+	writeKeyPair(t, dir, testpki.Issue(t, "server", ca))
+	testpki.WritePEM(t, path.Join(dir, certs.CACredName), "CERTIFICATE", ca.Cert.Raw)
+
+	none := 0
+
+	store, err := certs.New(certs.Config{MaxIntermediates: &none}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify(chain); !errors.Is(err, certs.ErrChain) {
+		t.Fatal(err)
+	}
+
+	store, err = certs.New(certs.Config{KeyUsages: []string{"clientAuth", "keyAgreement"}}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify(chain); !errors.Is(err, certs.ErrChain) {
+		t.Fatal(err)
+	}
+
+	// Only listing key usages keeps requiring clientAuth instead of the serverAuth default of the verifier.
+	store, err = certs.New(certs.Config{KeyUsages: []string{"digitalSignature"}}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Verify(chain); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := certs.New(certs.Config{KeyUsages: []string{"chicken"}}, credPath); !errors.Is(err, certs.ErrKeyUsage) {
+		t.Fatal(err)
+	}
+}
@@ -24,48 +24,46 @@ import (
 	"os"
 	"time"
 
+	"eqrx.net/rungroup"
 	"eqrx.net/service"
 	"eqrx.net/wallhack/internal/bridge"
-	"eqrx.net/wallhack/internal/packet"
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/proto"
 	"eqrx.net/wallhack/internal/tun"
+	"eqrx.net/wallhack/internal/tunhelper"
 	"github.com/go-logr/logr"
 )
 
 const (
 	// backOffDelay is the delay between connection attempts.
 	backOffDelay = 10 * time.Second
+	// setupTimeout is the time the server has to complete the session setup.
+	setupTimeout = 10 * time.Second
 	// tunIfaceName is the name of the tun interface to use for wallhack.
 	tunIfaceName = "wallhack"
 	// ServerEnvName is the name of the environment file containing the wallhack server address to connect to.
 	ServerEnvName = "WALLHACK_SERVER"
 )
 
-// TLSConf generates the TLS configuration for read credentials. It can
-// be used to connect to a wallhack server.
-func tlsConf(service *service.Service) (*tls.Config, error) {
-	certData, err := service.LoadCred("cert")
-	if err != nil {
-		return nil, fmt.Errorf("tls conf: %w", err)
-	}
-
-	keyData, err := service.LoadCred("key")
-	if err != nil {
-		return nil, fmt.Errorf("tls conf: %w", err)
-	}
-
-	cert, err := tls.X509KeyPair(certData, keyData)
-	if err != nil {
-		return nil, fmt.Errorf("tls config: parse keys: %w", err)
-	}
+var (
+	// errFatal marks errors that make retrying pointless.
+	errFatal = errors.New("fatal")
+	// errTunLost marks streams that ended because the tun was deleted or set down.
+	errTunLost = errors.New("tun lost")
+	// errHelperMismatch indicates that the tun helper passed a device that does not match the configuration.
+	errHelperMismatch = errors.New("tun from helper does not match config")
+)
 
-	config := &tls.Config{
-		Certificates:             []tls.Certificate{cert},
+// tlsConf generates the TLS configuration for the given store. It can
+// be used to connect to a wallhack server.
+func tlsConf(store *certs.Store) *tls.Config {
+	return &tls.Config{
+		GetClientCertificate:     store.GetClientCertificate,
 		PreferServerCipherSuites: true,
 		MinVersion:               tls.VersionTLS13,
-		NextProtos:               []string{"wallhack"},
+		NextProtos:               proto.NextProtos(),
 	}
-
-	return config, nil
 }
 
 // Run this instance in client mode.
@@ -76,23 +74,46 @@ func Run(ctx context.Context, log logr.Logger, service *service.Service) error {
 		return fmt.Errorf("client: %w", err)
 	}
 
-	tlsConfig, err := tlsConf(service)
+	cfg, err := loadConfig(service)
 	if err != nil {
 		return fmt.Errorf("client: %w", err)
 	}
 
-	dialer := &tls.Dialer{Config: tlsConfig}
+	store, err := certs.New(cfg.TLS, service.CredPath)
+	if err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+
+	dialer := &tls.Dialer{Config: tlsConf(store)}
 
 	_ = service.MarkReady()
 	defer func() { _ = service.MarkStopping() }()
 
-	return dial(ctx, log, service, dialer, serverAddr)
+	group := rungroup.New(ctx)
+	group.Go(func(ctx context.Context) error { return store.Run(ctx, log) })
+	group.Go(func(ctx context.Context) error {
+		err := dial(ctx, log, service, dialer, serverAddr, cfg)
+		if errors.Is(err, ctx.Err()) {
+			return nil
+		}
+
+		return err
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+
+	return nil
 }
 
 // dial attempts to dial with dialer to the server behind serverName until canceled.
 // On success a local tun is opened and all packets arriving on it will be streamed over conn
-// and vice versa. Returns any unexpected errors.
-func dial(ctx context.Context, log logr.Logger, service *service.Service, dialer *tls.Dialer, serverName string) error {
+// and vice versa. The tun is configured as specified by cfg while it is streamed. Returns any unexpected errors.
+func dial(
+	ctx context.Context, log logr.Logger, service *service.Service, dialer *tls.Dialer, serverName string,
+	cfg *config,
+) error {
 	for {
 		log.Info("dialing")
 
@@ -101,37 +122,216 @@ func dial(ctx context.Context, log logr.Logger, service *service.Service, dialer
 
 		switch {
 		case err == nil:
+			err = stream(ctx, log, service, conn.(*tls.Conn), cfg)
+			if err == nil {
+				continue
+			}
+
+			if errors.Is(err, errFatal) {
+				return fmt.Errorf("dial: %w", err)
+			}
+
+			if errors.Is(err, errTunLost) {
+				if err := waitTun(ctx, log, service, cfg); err != nil {
+					return fmt.Errorf("dial: %w", err)
+				}
+
+				continue
+			}
 		case errors.Is(err, ctx.Err()):
 			return fmt.Errorf("dial: %w", err)
-		case err != nil:
-			log.Error(err, "could not open tunnel, backing off")
+		}
+
+		log.Error(err, "could not open tunnel, backing off")
+
+		_ = service.MarkStatus("backing off")
+
+		delay := time.NewTimer(backOffDelay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("dial: backoff: %w", ctx.Err())
+		case <-delay.C:
+		}
+	}
+}
+
+// stream performs the session setup on conn and streams packets between conn and the local tun until
+// one of them fails. Errors during the session setup are returned, errors that prevent wallhack from
+// working at all are marked with [errFatal] and losing the tun is marked with [errTunLost].
+func stream(ctx context.Context, log logr.Logger, service *service.Service, conn *tls.Conn, cfg *config) error {
+	layer := proto.LayerIP
+	if cfg.TAP {
+		layer = proto.LayerEthernet
+	}
+
+	// Offloads are only negotiated for IP packets.
+	offload := cfg.Offload && !cfg.TAP
+
+	hello, err := setup(conn, layer, offload)
+	if err != nil {
+		_ = conn.Close()
+
+		return fmt.Errorf("stream: %w", err)
+	}
+
+	mode := tun.ModeTun
+	if cfg.TAP {
+		mode = tun.ModeTap
+	}
+
+	dev, err := openTun(cfg, tun.Options{Mode: mode, Offload: offload})
+	if err != nil {
+		_ = conn.Close()
+
+		return fmt.Errorf("stream: %w: %v", errFatal, err)
+	}
+
+	// The tun keeps its offloads across connections, so they are switched off if the server does not support them.
+	if offload {
+		if err := dev.SetOffload(hello.Offload); err != nil {
+			_ = conn.Close()
+			_ = dev.Close()
 
-			_ = service.MarkStatus("backing off")
+			return fmt.Errorf("stream: %w: %v", errFatal, err)
+		}
+	}
+
+	if !cfg.Network.IsZero() {
+		revert, err := netlink.Configure(tunIfaceName, cfg.Network)
+		if err != nil {
+			_ = conn.Close()
+			_ = dev.Close()
 
-			delay := time.NewTimer(backOffDelay)
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("dial: backoff: %w", ctx.Err())
-			case <-delay.C:
+			return fmt.Errorf("stream: %w: %v", errFatal, err)
+		}
+
+		defer func() {
+			if err := revert(); err != nil {
+				log.Error(err, "could not revert configured network settings")
 			}
+		}()
+	}
 
-			continue
+	if !hello.Network.IsZero() {
+		revert, err := netlink.Apply(tunIfaceName, hello.Network)
+		if err != nil {
+			log.Error(err, "could not apply network settings pushed by server")
+		} else {
+			defer func() {
+				if err := revert(); err != nil {
+					log.Error(err, "could not revert network settings pushed by server")
+				}
+			}()
 		}
+	}
+
+	_ = service.MarkStatus("streaming")
+
+	log.Info("streaming")
+
+	watcher, err := dev.Watch()
+	if err != nil {
+		_ = conn.Close()
+		_ = dev.Close()
 
-		tun, err := tun.New(tunIfaceName)
+		return fmt.Errorf("stream: %w: %v", errTunLost, err)
+	}
+
+	c := proto.Stream(conn, layer, hello.Offload, offload && hello.Offload)
+	t := dev.Queues()[0].Packets()
+
+	group := rungroup.New(ctx)
+	group.Go(func(ctx context.Context) error { return bridge.Bridge(ctx, c, t) })
+	group.Go(watcher.Run)
+
+	err = group.Wait()
+
+	switch {
+	case errors.Is(err, ctx.Err()):
+		return nil
+	case errors.Is(err, tun.ErrGone), errors.Is(err, tun.ErrDown):
+		return fmt.Errorf("stream: %w: %v", errTunLost, err)
+	case err != nil:
+		log.Error(err, "transport")
+	}
+
+	return nil
+}
+
+// openTun attaches the tun as specified by opts, either directly or through the helper from cfg.
+func openTun(cfg *config, opts tun.Options) (*tun.Tun, error) {
+	if cfg.Helper == "" {
+		dev, err := tun.OpenWith(tunIfaceName, opts)
 		if err != nil {
-			return fmt.Errorf("dial: %w", err)
+			return nil, fmt.Errorf("open tun: %w", err)
 		}
 
-		_ = service.MarkStatus("streaming")
+		return dev, nil
+	}
 
-		log.Info("streaming")
+	dev, err := tunhelper.Open(cfg.Helper, tunIfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("open tun: %w", err)
+	}
+
+	if dev.Mode() != opts.Mode || dev.Offload() != opts.Offload {
+		_ = dev.Close()
+
+		return nil, fmt.Errorf(
+			"open tun: %w: helper passed %s with offload %t, want %s with offload %t",
+			errHelperMismatch, dev.Mode(), dev.Offload(), opts.Mode, opts.Offload,
+		)
+	}
+
+	return dev, nil
+}
+
+// waitTun blocks until the tun is back after it was lost. Tuns configured by wallhack only have to exist, it sets
+// them up itself.
+func waitTun(ctx context.Context, log logr.Logger, service *service.Service, cfg *config) error {
+	log.Info("tun lost, waiting for it to come back")
+
+	_ = service.MarkStatus("waiting for tun")
+
+	if err := netlink.WaitLink(ctx, tunIfaceName, cfg.Network.IsZero()); err != nil {
+		return fmt.Errorf("wait tun: %w", err)
+	}
+
+	log.Info("tun is back")
+
+	return nil
+}
 
-		c := packet.NewReadWriteCloser(conn, packet.NewStreamReader(conn))
-		t := packet.NewReadWriteCloser(tun, packet.NewMTUReader(tun))
+// setup performs the session setup if the server negotiated a protocol that has one and returns
+// the answer of the server. Servers without session setup only carry IP. offload asks the server to carry offloads.
+func setup(conn *tls.Conn, layer proto.Layer, offload bool) (*proto.ServerHello, error) {
+	hello := &proto.ServerHello{}
 
-		if err := bridge.Bridge(ctx, c, t); err != nil {
-			log.Error(err, "transport")
+	if conn.ConnectionState().NegotiatedProtocol != proto.ALPN {
+		if layer != proto.LayerIP {
+			return nil, fmt.Errorf("setup: %w: server without session setup can not carry %s", proto.ErrLayer, layer)
 		}
+
+		return hello, nil
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(setupTimeout)); err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+
+	clientHello := proto.ClientHello{Layer: layer, Offload: offload, Segment: layer == proto.LayerIP}
+
+	if err := proto.WriteMessage(conn, clientHello); err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+
+	if err := proto.ReadMessage(conn, hello); err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
 	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+
+	return hello, nil
 }
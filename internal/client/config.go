@@ -0,0 +1,64 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"eqrx.net/service"
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/netlink"
+)
+
+// ConfigCredName is the name of the optional systemd credential that contains the YAML client configuration.
+const ConfigCredName = "config"
+
+// config is the optional configuration of the client. The zero value is a valid configuration that
+// reflects the default behavior.
+type config struct {
+	// TLS specifies where TLS material is loaded from.
+	TLS certs.Config `yaml:"tls"`
+	// Network is applied to the tun while connected to the server and removed afterwards. The tun is set down
+	// again when the connection ends.
+	Network netlink.Settings `yaml:"network"`
+	// TAP makes the wallhack device a tap that carries ethernet frames. The server has to treat the tun of this
+	// client as tap, too.
+	TAP bool `yaml:"tap"`
+	// Offload lets the kernel pass TCP super-packets to wallhack which carries them over the tunnel in one piece.
+	// Received TCP segments are merged into super-packets before they are written to the tun. Requires tun devices
+	// with virtio-net headers, so it does not work for taps.
+	Offload bool `yaml:"offload"`
+	// Helper is the path of the socket of a privileged tun helper. If set the tun is requested from it instead of
+	// being attached by wallhack. The helper has to agree with TAP and Offload.
+	Helper string `yaml:"helper"`
+}
+
+// loadConfig loads the client configuration from the systemd credential [ConfigCredName].
+// A missing credential results in the default configuration.
+func loadConfig(service *service.Service) (*config, error) {
+	cfg := &config{}
+
+	err := service.UnmarshalYAMLCred(ConfigCredName, cfg)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	return cfg, nil
+}
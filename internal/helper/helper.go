@@ -0,0 +1,175 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package helper provides the privileged tun helper. It listens on the unix seqpacket sockets given by systemd and
+// passes the tuns requested by wallhack, see [tunhelper].
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"eqrx.net/rungroup"
+	"eqrx.net/service"
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/server/tuns"
+	"eqrx.net/wallhack/internal/tun"
+	"eqrx.net/wallhack/internal/tunhelper"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// ConfigCredName is the name of the systemd credential that contains the YAML helper configuration.
+	ConfigCredName = "config"
+	// defaultUser is the user wallhack runs as if not configured otherwise.
+	defaultUser = "wallhack"
+)
+
+var (
+	// errListener indicates that systemd passed a listener that is not a unix seqpacket socket.
+	errListener = errors.New("tun helper needs unix seqpacket sockets")
+	// errNested indicates that the helper is configured to use another helper.
+	errNested = errors.New("tun helper can not use a helper itself")
+	// errNothingAllowed indicates that the helper is not allowed to pass any tun.
+	errNothingAllowed = errors.New("tun helper needs tuns to allow")
+)
+
+// config is the configuration of the helper.
+type config struct {
+	// Tuns specifies how tuns are opened. Tuns are configured as specified when they are passed and stay that way.
+	Tuns tuns.Config `yaml:"tuns"`
+	// User is the name of the user wallhack runs as. Requests of other users are rejected. Defaults to wallhack.
+	User string `yaml:"user"`
+	// Allow lists the names of the tuns that may be requested. Entries ending with * allow all names starting with
+	// the rest of the entry.
+	Allow []string `yaml:"allow"`
+}
+
+// loadConfig loads the helper configuration from the systemd credential [ConfigCredName].
+func loadConfig(service *service.Service) (*config, error) {
+	cfg := &config{}
+
+	err := service.UnmarshalYAMLCred(ConfigCredName, cfg)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("load config: %w: no config", errNothingAllowed)
+	default:
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// access returns the access restrictions described by cfg.
+func (c *config) access() (tunhelper.Access, error) {
+	if len(c.Allow) == 0 {
+		return tunhelper.Access{}, fmt.Errorf("access: %w", errNothingAllowed)
+	}
+
+	for _, allowed := range c.Allow {
+		if err := tun.ValidName(strings.TrimSuffix(allowed, "*")); err != nil {
+			return tunhelper.Access{}, fmt.Errorf("access: %w", err)
+		}
+	}
+
+	name := c.User
+	if name == "" {
+		name = defaultUser
+	}
+
+	account, err := user.Lookup(name)
+	if err != nil {
+		return tunhelper.Access{}, fmt.Errorf("access: %w", err)
+	}
+
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return tunhelper.Access{}, fmt.Errorf("access: uid of %s: %w", name, err)
+	}
+
+	return tunhelper.Access{UID: uint32(uid), Tuns: c.Allow}, nil
+}
+
+// Run the tun helper.
+func Run(ctx context.Context, log logr.Logger, service *service.Service) error {
+	cfg, err := loadConfig(service)
+	if err != nil {
+		return fmt.Errorf("tun helper: %w", err)
+	}
+
+	if cfg.Tuns.Helper != "" {
+		return fmt.Errorf("tun helper: %w", errNested)
+	}
+
+	access, err := cfg.access()
+	if err != nil {
+		return fmt.Errorf("tun helper: %w", err)
+	}
+
+	opener, err := tuns.New(cfg.Tuns)
+	if err != nil {
+		return fmt.Errorf("tun helper: %w", err)
+	}
+
+	open := func(name string) (*tun.Tun, error) {
+		dev, created, err := opener.Open(name)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		// The tun is in use after the helper let go of it, so the configuration is never reverted.
+		if _, err := opener.Configure(name, created, netlink.Settings{}); err != nil {
+			_ = dev.Close()
+
+			return nil, err //nolint:wrapcheck
+		}
+
+		return dev, nil
+	}
+
+	listeners := []*net.UnixListener{}
+
+	for _, listener := range service.Listeners() {
+		unixListener, ok := listener.(*net.UnixListener)
+		if !ok || unixListener.Addr().Network() != tunhelper.Network {
+			return fmt.Errorf("tun helper: %w: got %s", errListener, listener.Addr().Network())
+		}
+
+		listeners = append(listeners, unixListener)
+	}
+
+	group := rungroup.New(ctx)
+
+	for _, listener := range listeners {
+		listener := listener
+		group.Go(func(ctx context.Context) error { return tunhelper.Serve(ctx, log, listener, access, open) })
+	}
+
+	_ = service.MarkReady()
+
+	group.Go(service.RunNotify)
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("tun helper: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package netlink talks rtnetlink with the linux kernel to configure network interfaces.
+// It only implements the handful of requests wallhack needs.
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// receiveBufferLen is the size of the buffer used to receive netlink messages.
+	receiveBufferLen = 64 * 1024
+	// attrAlign is the alignment of netlink messages and attributes.
+	attrAlign = 4
+)
+
+var errShortMessage = errors.New("netlink message truncated")
+
+// Conn is a rtnetlink socket.
+type Conn struct {
+	fd  int
+	seq uint32
+}
+
+// Dial opens a new rtnetlink socket.
+func Dial() (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("netlink dial: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("netlink dial: %w", err)
+	}
+
+	return &Conn{fd, 0}, nil
+}
+
+// Close the socket.
+func (c *Conn) Close() error {
+	if err := unix.Close(c.fd); err != nil {
+		return fmt.Errorf("netlink close: %w", err)
+	}
+
+	return nil
+}
+
+// AddAddress assigns prefix (address and prefix length) to the interface with the given index.
+// Returns an error matching [unix.EEXIST] if the address is already assigned.
+func (c *Conn) AddAddress(index int, prefix netip.Prefix) error {
+	if err := c.address(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, index, prefix); err != nil {
+		return fmt.Errorf("add address %s: %w", prefix, err)
+	}
+
+	return nil
+}
+
+// DelAddress removes prefix from the interface with the given index.
+func (c *Conn) DelAddress(index int, prefix netip.Prefix) error {
+	if err := c.address(unix.RTM_DELADDR, 0, index, prefix); err != nil {
+		return fmt.Errorf("del address %s: %w", prefix, err)
+	}
+
+	return nil
+}
+
+// AddRoute adds a route for dst over the interface with the given index to the main table.
+// Returns an error matching [unix.EEXIST] if the route already exists.
+func (c *Conn) AddRoute(index int, dst netip.Prefix) error {
+	if err := c.route(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, index, dst); err != nil {
+		return fmt.Errorf("add route %s: %w", dst, err)
+	}
+
+	return nil
+}
+
+// DelRoute removes the route for dst over the interface with the given index from the main table.
+func (c *Conn) DelRoute(index int, dst netip.Prefix) error {
+	if err := c.route(unix.RTM_DELROUTE, 0, index, dst); err != nil {
+		return fmt.Errorf("del route %s: %w", dst, err)
+	}
+
+	return nil
+}
+
+// SetLink sets the interface with the given index up or down and changes its MTU if mtu is not zero.
+func (c *Conn) SetLink(index int, up bool, mtu int) error {
+	info := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(index), Change: unix.IFF_UP}
+	if up {
+		info.Flags = unix.IFF_UP
+	}
+
+	msg := message(asBytes(&info))
+
+	if mtu != 0 {
+		msg = msg.attr(unix.IFLA_MTU, uint32Bytes(uint32(mtu)))
+	}
+
+	if err := c.request(unix.RTM_NEWLINK, 0, msg); err != nil {
+		return fmt.Errorf("set link %d: %w", index, err)
+	}
+
+	return nil
+}
+
+// SetMTU changes the MTU of the interface with the given index without touching its state.
+func (c *Conn) SetMTU(index int, mtu int) error {
+	info := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(index)}
+	msg := message(asBytes(&info)).attr(unix.IFLA_MTU, uint32Bytes(uint32(mtu)))
+
+	if err := c.request(unix.RTM_NEWLINK, 0, msg); err != nil {
+		return fmt.Errorf("set mtu %d: %w", index, err)
+	}
+
+	return nil
+}
+
+func (c *Conn) address(msgType, flags uint16, index int, prefix netip.Prefix) error {
+	addrMsg := unix.IfAddrmsg{
+		Family:    family(prefix.Addr()),
+		Prefixlen: uint8(prefix.Bits()),
+		Scope:     unix.RT_SCOPE_UNIVERSE,
+		Index:     uint32(index),
+	}
+
+	if prefix.Addr().Is6() {
+		addrMsg.Flags = unix.IFA_F_NODAD
+	}
+
+	addr := prefix.Addr().AsSlice()
+	msg := message(asBytes(&addrMsg)).attr(unix.IFA_LOCAL, addr).attr(unix.IFA_ADDRESS, addr)
+
+	return c.request(msgType, flags, msg)
+}
+
+func (c *Conn) route(msgType, flags uint16, index int, dst netip.Prefix) error {
+	routeMsg := unix.RtMsg{
+		Family:   family(dst.Addr()),
+		Dst_len:  uint8(dst.Bits()),
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_STATIC,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+
+	msg := message(asBytes(&routeMsg)).
+		attr(unix.RTA_DST, dst.Masked().Addr().AsSlice()).
+		attr(unix.RTA_OIF, uint32Bytes(uint32(index)))
+
+	return c.request(msgType, flags, msg)
+}
+
+// request sends a request with the given body and waits for the kernel to acknowledge it.
+func (c *Conn) request(msgType, flags uint16, body message) error {
+	c.seq++
+
+	header := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(body)),
+		Type:  msgType,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   c.seq,
+	}
+
+	data := append(append([]byte{}, asBytes(&header)...), body...)
+
+	if err := unix.Sendto(c.fd, data, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+
+	buf := make([]byte, receiveBufferLen)
+
+	for {
+		bytesRead, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("receive: %w", err)
+		}
+
+		msgs, err := parse(buf[:bytesRead])
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			if msg.header.Seq != c.seq || msg.header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+
+			if len(msg.data) < unix.SizeofNlMsgerr {
+				return errShortMessage
+			}
+
+			if errno := *(*int32)(unsafe.Pointer(&msg.data[0])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+
+			return nil
+		}
+	}
+}
+
+// received is a netlink message read from the kernel.
+type received struct {
+	header unix.NlMsghdr
+	data   []byte
+}
+
+// parse splits buf into netlink messages.
+func parse(buf []byte) ([]received, error) {
+	var msgs []received
+
+	for len(buf) >= unix.SizeofNlMsghdr {
+		header := *(*unix.NlMsghdr)(unsafe.Pointer(&buf[0]))
+		if int(header.Len) < unix.SizeofNlMsghdr || int(header.Len) > len(buf) {
+			return nil, errShortMessage
+		}
+
+		msgs = append(msgs, received{header, buf[unix.SizeofNlMsghdr:header.Len]})
+
+		buf = buf[min(align(int(header.Len)), len(buf)):]
+	}
+
+	return msgs, nil
+}
+
+// message is the body of a netlink request.
+type message []byte
+
+// attr appends a route attribute to the message.
+func (m message) attr(attrType uint16, data []byte) message {
+	attr := unix.RtAttr{Len: uint16(unix.SizeofRtAttr + len(data)), Type: attrType}
+	m = append(append(m, asBytes(&attr)...), data...)
+
+	return append(m, make([]byte, align(len(m))-len(m))...)
+}
+
+func family(addr netip.Addr) uint8 {
+	if addr.Is4() {
+		return unix.AF_INET
+	}
+
+	return unix.AF_INET6
+}
+
+func align(length int) int { return (length + attrAlign - 1) &^ (attrAlign - 1) }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func uint32Bytes(value uint32) []byte { return append([]byte{}, asBytes(&value)...) }
+
+// asBytes returns the memory of the value pointed to by ptr in host byte order, which is what netlink expects.
+func asBytes[T any](ptr *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(ptr)), unsafe.Sizeof(*ptr))
+}
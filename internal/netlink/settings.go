@@ -0,0 +1,192 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// Settings is the network configuration of an interface.
+type Settings struct {
+	// Addresses to assign, including their prefix length.
+	Addresses []netip.Prefix `yaml:"addresses" json:"addresses,omitempty"`
+	// Routes to add over the interface.
+	Routes []netip.Prefix `yaml:"routes" json:"routes,omitempty"`
+	// MTU to set. Zero leaves the MTU untouched.
+	MTU int `yaml:"mtu" json:"mtu,omitempty"`
+}
+
+// IsZero returns true if the settings contain nothing to apply.
+func (s Settings) IsZero() bool { return len(s.Addresses) == 0 && len(s.Routes) == 0 && s.MTU == 0 }
+
+// Merge returns the settings with the addresses and routes of other added. The MTU of other takes precedence if set.
+func (s Settings) Merge(other Settings) Settings {
+	merged := Settings{
+		Addresses: append(append([]netip.Prefix{}, s.Addresses...), other.Addresses...),
+		Routes:    append(append([]netip.Prefix{}, s.Routes...), other.Routes...),
+		MTU:       s.MTU,
+	}
+
+	if other.MTU != 0 {
+		merged.MTU = other.MTU
+	}
+
+	return merged
+}
+
+// Revert undoes previously applied [Settings].
+type Revert func() error
+
+// Apply applies settings to the interface named iface and sets it up. Addresses and routes that already exist are
+// left alone and not removed by the returned [Revert], a changed MTU is set back to the previous one. On error
+// everything applied so far is reverted.
+func Apply(iface string, settings Settings) (Revert, error) { return apply(iface, settings, false) }
+
+// Configure applies settings like [Apply] does. Reverting also sets the interface down again, so only use it for
+// interfaces that are owned by wallhack.
+func Configure(iface string, settings Settings) (Revert, error) { return apply(iface, settings, true) }
+
+func apply(iface string, settings Settings, down bool) (Revert, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("apply settings: %w", err)
+	}
+
+	conn, err := Dial()
+	if err != nil {
+		return nil, fmt.Errorf("apply settings: %w", err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	index := netIface.Index
+	applied := &applied{index: index}
+
+	if err := conn.SetLink(index, true, settings.MTU); err != nil {
+		return nil, fmt.Errorf("apply settings: %w", err)
+	}
+
+	applied.down = down
+
+	if settings.MTU != 0 && settings.MTU != netIface.MTU {
+		applied.mtu = netIface.MTU
+	}
+
+	for _, addr := range settings.Addresses {
+		err := conn.AddAddress(index, addr)
+
+		switch {
+		case err == nil:
+			applied.addresses = append(applied.addresses, addr)
+		case errors.Is(err, unix.EEXIST):
+		default:
+			return nil, fmt.Errorf("apply settings: %w", applied.revertWith(conn, err))
+		}
+	}
+
+	for _, route := range settings.Routes {
+		err := conn.AddRoute(index, route)
+
+		switch {
+		case err == nil:
+			applied.routes = append(applied.routes, route)
+		case errors.Is(err, unix.EEXIST):
+		default:
+			return nil, fmt.Errorf("apply settings: %w", applied.revertWith(conn, err))
+		}
+	}
+
+	return applied.revert, nil
+}
+
+// applied keeps track of applied changes so they can be reverted.
+type applied struct {
+	index     int
+	addresses []netip.Prefix
+	routes    []netip.Prefix
+	// mtu is the MTU before it was changed, zero if it was not.
+	mtu int
+	// down sets the interface down on revert.
+	down bool
+}
+
+func (a *applied) revert() error {
+	conn, err := Dial()
+	if err != nil {
+		return fmt.Errorf("revert settings: %w", err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	if err := a.revertWith(conn, nil); err != nil {
+		return fmt.Errorf("revert settings: %w", err)
+	}
+
+	return nil
+}
+
+// revertWith removes all applied routes and addresses, restores the MTU and sets the interface down if requested.
+// Interfaces that are gone already count as reverted.
+// cause is the error that caused the revert and is returned together with the revert errors.
+func (a *applied) revertWith(conn *Conn, cause error) error {
+	errs := []error{}
+	if cause != nil {
+		errs = append(errs, cause)
+	}
+
+	for _, route := range a.routes {
+		if err := conn.DelRoute(a.index, route); err != nil && !gone(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, addr := range a.addresses {
+		if err := conn.DelAddress(a.index, addr); err != nil && !gone(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	if a.mtu != 0 {
+		if err := conn.SetMTU(a.index, a.mtu); err != nil && !gone(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	if a.down {
+		if err := conn.SetLink(a.index, false, 0); err != nil && !gone(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	a.routes, a.addresses, a.mtu, a.down = nil, nil, 0, false
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%w (and %d more errors while reverting)", errs[0], len(errs)-1)
+	}
+}
+
+// gone returns true if err indicates that the object to remove does not exist (anymore).
+func gone(err error) bool {
+	return errors.Is(err, unix.ENODEV) || errors.Is(err, unix.ESRCH) || errors.Is(err, unix.EADDRNOTAVAIL)
+}
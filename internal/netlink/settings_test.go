@@ -0,0 +1,129 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package netlink_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/tun"
+)
+
+// testTun creates a tun that is removed again when the test ends. The test is skipped without the privileges for it.
+func testTun(t *testing.T, suffix string) string {
+	t.Helper()
+
+	name := fmt.Sprintf("whtest%d%s", os.Getpid()%10000, suffix)
+
+	dev, _, err := tun.Create(name, tun.CreateOptions{Owner: -1, Group: -1})
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+		t.Skipf("can not create tuns: %v", err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = dev.Close() })
+
+	return name
+}
+
+func mtu(t *testing.T, name string) int {
+	t.Helper()
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return iface.MTU
+}
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+
+	name := testTun(t, "a")
+	before := mtu(t, name)
+
+	revert, err := netlink.Apply(name, netlink.Settings{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("fd0d:5619:c605::1/64")},
+		MTU:       before - 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := mtu(t, name); got != before-100 {
+		t.Fatalf("mtu is %d, want %d", got, before-100)
+	}
+
+	if err := revert(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := mtu(t, name); got != before {
+		t.Fatalf("mtu not restored, is %d, want %d", got, before)
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range addrs {
+		if addr.String() == "fd0d:5619:c605::1/64" {
+			t.Fatal("address not removed")
+		}
+	}
+
+	if iface.Flags&net.FlagUp == 0 {
+		t.Fatal("applied settings set interface down")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	t.Parallel()
+
+	name := testTun(t, "c")
+	before := mtu(t, name)
+
+	revert, err := netlink.Configure(name, netlink.Settings{MTU: before - 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revert(); err != nil {
+		t.Fatal(err)
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if iface.MTU != before || iface.Flags&net.FlagUp != 0 {
+		t.Fatalf("interface not reverted: mtu %d flags %s", iface.MTU, iface.Flags)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package netlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinkEvent is a change of a network interface reported by the kernel.
+type LinkEvent struct {
+	// Index of the interface.
+	Index int
+	// Name of the interface.
+	Name string
+	// MTU of the interface.
+	MTU int
+	// Up is true if the interface is administratively up.
+	Up bool
+	// Deleted is true if the interface is gone.
+	Deleted bool
+}
+
+// LinkWatcher receives link events from the kernel. The events are those of the network namespace the watcher was
+// created in.
+type LinkWatcher struct {
+	file    *os.File
+	buf     []byte
+	pending []LinkEvent
+}
+
+// WatchLinks subscribes to link events.
+func WatchLinks() (*LinkWatcher, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("watch links: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("watch links: %w", err)
+	}
+
+	// Going through the runtime poller lets Close interrupt a pending Next.
+	return &LinkWatcher{os.NewFile(uintptr(fd), "netlink"), make([]byte, receiveBufferLen), nil}, nil
+}
+
+// Close stops watching. A pending [LinkWatcher.Next] returns an error matching [os.ErrClosed].
+func (w *LinkWatcher) Close() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("close link watcher: %w", err)
+	}
+
+	return nil
+}
+
+// Next blocks until the next link event arrives.
+func (w *LinkWatcher) Next() (LinkEvent, error) {
+	for len(w.pending) == 0 {
+		bytesRead, err := w.file.Read(w.buf)
+		if err != nil {
+			return LinkEvent{}, fmt.Errorf("next link event: %w", err)
+		}
+
+		msgs, err := parse(w.buf[:bytesRead])
+		if err != nil {
+			return LinkEvent{}, fmt.Errorf("next link event: %w", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.header.Type != unix.RTM_NEWLINK && msg.header.Type != unix.RTM_DELLINK {
+				continue
+			}
+
+			event, err := linkEvent(msg)
+			if err != nil {
+				return LinkEvent{}, fmt.Errorf("next link event: %w", err)
+			}
+
+			w.pending = append(w.pending, event)
+		}
+	}
+
+	event := w.pending[0]
+	w.pending = w.pending[1:]
+
+	return event, nil
+}
+
+// linkEvent decodes a RTM_NEWLINK or RTM_DELLINK message.
+func linkEvent(msg received) (LinkEvent, error) {
+	if len(msg.data) < unix.SizeofIfInfomsg {
+		return LinkEvent{}, errShortMessage
+	}
+
+	info := *(*unix.IfInfomsg)(unsafe.Pointer(&msg.data[0]))
+	event := LinkEvent{
+		Index:   int(info.Index),
+		Up:      info.Flags&unix.IFF_UP != 0,
+		Deleted: msg.header.Type == unix.RTM_DELLINK,
+	}
+
+	attrs, err := parseAttrs(msg.data[align(unix.SizeofIfInfomsg):])
+	if err != nil {
+		return LinkEvent{}, err
+	}
+
+	if name, ok := attrs[unix.IFLA_IFNAME]; ok {
+		event.Name = string(trimNUL(name))
+	}
+
+	if mtu, ok := attrs[unix.IFLA_MTU]; ok && len(mtu) >= 4 {
+		event.MTU = int(*(*uint32)(unsafe.Pointer(&mtu[0])))
+	}
+
+	return event, nil
+}
+
+var errShortAttr = errors.New("netlink attribute truncated")
+
+// parseAttrs splits buf into route attributes by type.
+func parseAttrs(buf []byte) (map[uint16][]byte, error) {
+	attrs := map[uint16][]byte{}
+
+	for len(buf) >= unix.SizeofRtAttr {
+		attr := *(*unix.RtAttr)(unsafe.Pointer(&buf[0]))
+		if int(attr.Len) < unix.SizeofRtAttr || int(attr.Len) > len(buf) {
+			return nil, errShortAttr
+		}
+
+		attrs[attr.Type] = buf[unix.SizeofRtAttr:attr.Len]
+		buf = buf[min(align(int(attr.Len)), len(buf)):]
+	}
+
+	return attrs, nil
+}
+
+func trimNUL(data []byte) []byte {
+	for i, b := range data {
+		if b == 0 {
+			return data[:i]
+		}
+	}
+
+	return data
+}
+
+// WaitLink blocks until the interface called name exists and, if up is true, is up. Returns the error of ctx if it is
+// done before.
+func WaitLink(ctx context.Context, name string, up bool) error {
+	watcher, err := WatchLinks()
+	if err != nil {
+		return fmt.Errorf("wait link: %w", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+
+		_ = watcher.Close()
+	}()
+
+	// Subscribed first so the interface can not appear unnoticed between the check and the first event.
+	if iface, err := net.InterfaceByName(name); err == nil && (!up || iface.Flags&net.FlagUp != 0) {
+		return nil
+	}
+
+	for {
+		event, err := watcher.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("wait link: %w", ctx.Err())
+			}
+
+			return fmt.Errorf("wait link: %w", err)
+		}
+
+		if event.Name == name && !event.Deleted && (!up || event.Up) {
+			return nil
+		}
+	}
+}
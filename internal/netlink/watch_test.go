@@ -0,0 +1,69 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package netlink_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"eqrx.net/wallhack/internal/netlink"
+)
+
+func TestWaitLinkExisting(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := netlink.WaitLink(ctx, "lo", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitLinkCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := netlink.WaitLink(ctx, "wallhack-none", false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline, got %v", err)
+	}
+}
+
+func TestWatchLinksClose(t *testing.T) {
+	t.Parallel()
+
+	watcher, err := netlink.WatchLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		_, err := watcher.Next()
+		done <- err
+	}()
+
+	if err := watcher.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err == nil {
+		t.Fatal("next after close succeeded")
+	}
+}
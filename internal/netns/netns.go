@@ -0,0 +1,105 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package netns runs code inside named linux network namespaces like the ones created by `ip netns add`.
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Dir is the directory named network namespaces are bind mounted to.
+	Dir = "/run/netns"
+	// selfPath is the network namespace of the calling thread.
+	selfPath = "/proc/thread-self/ns/net"
+)
+
+// ErrName indicates that a name can not be used as namespace name.
+var ErrName = errors.New("invalid namespace name")
+
+// ValidName checks if name may be used as name of a namespace in [Dir].
+func ValidName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("%w: %q", ErrName, name)
+	}
+
+	return nil
+}
+
+// Do runs fn on a goroutine of its own that is switched into the network namespace called name and waits for it.
+// Only fn runs inside the namespace, file descriptors and sockets it opens stay bound to it afterwards.
+func Do(name string, fn func() error) error {
+	if err := ValidName(name); err != nil {
+		return fmt.Errorf("netns %s: %w", name, err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- do(name, fn) }()
+
+	return <-done
+}
+
+// do switches the calling goroutine into the network namespace called name, runs fn and switches back. If switching
+// back fails, the goroutine stays locked to its thread, so the runtime terminates the thread once the goroutine exits
+// instead of reusing it in the wrong namespace. The caller has to exit the goroutine afterwards.
+func do(name string, fn func() error) error {
+	// Namespaces are per thread, so the goroutine must not be moved around while it is switched.
+	runtime.LockOSThread()
+
+	origin, err := os.Open(selfPath)
+	if err != nil {
+		runtime.UnlockOSThread()
+
+		return fmt.Errorf("netns %s: %w", name, err)
+	}
+
+	defer func() { _ = origin.Close() }()
+
+	target, err := os.Open(filepath.Join(Dir, name))
+	if err != nil {
+		runtime.UnlockOSThread()
+
+		return fmt.Errorf("netns %s: %w", name, err)
+	}
+
+	defer func() { _ = target.Close() }()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+
+		return fmt.Errorf("netns %s: enter: %w", name, err)
+	}
+
+	fnErr := fn()
+
+	if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("netns %s: leave: %w", name, err)
+	}
+
+	runtime.UnlockOSThread()
+
+	if fnErr != nil {
+		return fmt.Errorf("netns %s: %w", name, fnErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package netns_test
+
+import (
+	"errors"
+	"testing"
+
+	"eqrx.net/wallhack/internal/netns"
+)
+
+func TestValidName(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"", ".", "..", "a/b", "../chicken"} {
+		if err := netns.ValidName(name); !errors.Is(err, netns.ErrName) {
+			t.Errorf("%q: expected ErrName, got %v", name, err)
+		}
+	}
+
+	if err := netns.ValidName("chicken"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDoInvalidName(t *testing.T) {
+	t.Parallel()
+
+	called := false
+
+	err := netns.Do("../chicken", func() error {
+		called = true
+
+		return nil
+	})
+	if !errors.Is(err, netns.ErrName) || called {
+		t.Errorf("expected ErrName without running fn, got %v", err)
+	}
+}
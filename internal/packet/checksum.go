@@ -0,0 +1,51 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// checksum adds data as big endian 16 bit words to the one's complement sum initial. An odd trailing byte is padded
+// with zero.
+func checksum(initial uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		initial += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+
+	if len(data) == 1 {
+		initial += uint32(data[0]) << 8
+	}
+
+	return initial
+}
+
+// fold folds the carries of sum into its lower 16 bits.
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return uint16(sum)
+}
+
+// pseudoHeaderSum returns the sum of the IPv6 pseudo header of an upper layer packet of length bytes with the
+// next header value nextHeader.
+func pseudoHeaderSum(src, dst net.IP, nextHeader uint8, length int) uint32 {
+	sum := checksum(checksum(0, src.To16()), dst.To16())
+
+	return sum + uint32(length>>16) + uint32(length&0xffff) + uint32(nextHeader)
+}
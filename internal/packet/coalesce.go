@@ -0,0 +1,209 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/net/ipv6"
+)
+
+// Coalescer reads IP packets with virtio-net headers from an [OffloadStreamReader] and merges consecutive TCP
+// segments of a flow into one super-packet, like GRO does, so they can be written to a tun with offloads at once.
+// Only packets that already arrived are merged, the coalescer never waits for more. Segments are merged if they
+// continue each other, have the same headers besides sequence number, checksum and PSH, carry a valid checksum and are
+// not larger than the first one. A segment with PSH or one smaller than the first ends the super-packet.
+// Consecutive packet reads use the same buffer.
+type Coalescer struct {
+	reader *OffloadStreamReader
+	// next is a packet that was read but could not be merged. It is still in the buffer of reader.
+	next *Packet
+	// err is the error of reading the packet after the last returned one.
+	err error
+	// buffer holds the virtio-net header and the packet that is being merged.
+	buffer []byte
+	// size is the payload length of the first merged segment and the segment size of the super-packet.
+	size int
+	// segments is the number of merged segments.
+	segments int
+	// ended is true if no more segments may be merged.
+	ended bool
+}
+
+// NewCoalescer creates a new [Coalescer] that reads from reader.
+func NewCoalescer(reader *OffloadStreamReader) *Coalescer {
+	return &Coalescer{reader: reader, buffer: make([]byte, 0, maxOffloadLen)}
+}
+
+// ReadPacket reads the next packet, merging all segments that follow it and already arrived.
+func (c *Coalescer) ReadPacket() (*Packet, error) {
+	first := c.next
+	c.next = nil
+
+	if first == nil {
+		if c.err != nil {
+			err := c.err
+			c.err = nil
+
+			return nil, err
+		}
+
+		var err error
+
+		if first, err = c.reader.ReadPacket(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Later reads overwrite the buffer of the reader, so the first packet is copied before reading further.
+	c.buffer = append(append(c.buffer[:0], first.Offload...), first.Marshalled...)
+	if len(first.Offload) != VirtioHeaderLen {
+		c.buffer = append(append(c.buffer[:0], make([]byte, VirtioHeaderLen)...), first.Marshalled...)
+	}
+
+	c.segments, c.ended = 1, true
+
+	if payload, ok := mergeable(first); ok {
+		c.size, c.ended = len(payload), first.Marshalled[ipv6.HeaderLen+13]&tcpPSH != 0
+
+		for !c.ended && c.reader.buffered() {
+			next, err := c.reader.ReadPacket()
+			if err != nil {
+				c.err = err
+
+				break
+			}
+
+			if !c.merge(next) {
+				c.next = next
+
+				break
+			}
+		}
+	}
+
+	return c.packet()
+}
+
+// merge appends the payload of p to the super-packet if p continues it. Returns false if it does not.
+func (c *Coalescer) merge(p *Packet) bool {
+	payload, ok := mergeable(p)
+	if !ok || len(payload) > c.size {
+		return false
+	}
+
+	merged := c.buffer[VirtioHeaderLen:]
+	tcpLen := len(p.Marshalled) - ipv6.HeaderLen - len(payload)
+	headersLen := ipv6.HeaderLen + tcpLen
+
+	switch {
+	case len(merged)+len(payload) > ipv6.HeaderLen+0xffff:
+		return false
+	case len(merged) < headersLen || merged[ipv6.HeaderLen+12] != p.Marshalled[ipv6.HeaderLen+12]:
+		return false
+	case !sameHeaders(merged[:headersLen], p.Marshalled[:headersLen]):
+		return false
+	}
+
+	mergedSeq := binary.BigEndian.Uint32(merged[ipv6.HeaderLen+4:])
+	if binary.BigEndian.Uint32(p.Marshalled[ipv6.HeaderLen+4:]) != mergedSeq+uint32(len(merged)-headersLen) {
+		return false
+	}
+
+	c.buffer = append(c.buffer, payload...)
+	c.segments++
+
+	flags := p.Marshalled[ipv6.HeaderLen+13]
+	c.buffer[VirtioHeaderLen+ipv6.HeaderLen+13] |= flags & tcpPSH
+
+	// Nothing may follow a smaller segment or one with PSH.
+	c.ended = len(payload) < c.size || flags&tcpPSH != 0
+
+	return true
+}
+
+// packet returns the merged packet. Super-packets get a virtio-net header that tells the kernel to segment them
+// and to complete their checksum, which is set to the sum of the pseudo header for that.
+func (c *Coalescer) packet() (*Packet, error) {
+	data := c.buffer[VirtioHeaderLen:]
+
+	if c.segments > 1 {
+		binary.BigEndian.PutUint16(data[4:], uint16(len(data)-ipv6.HeaderLen))
+
+		tcpLen, err := tcpHeaderLen(data[ipv6.HeaderLen:])
+		if err != nil {
+			return nil, fmt.Errorf("read packet: %w", err)
+		}
+
+		header, err := asHeader(data)
+		if err != nil {
+			return nil, fmt.Errorf("read packet: %w", err)
+		}
+
+		tcp := data[ipv6.HeaderLen:]
+		binary.BigEndian.PutUint16(
+			tcp[tcpChecksumOffset:], fold(pseudoHeaderSum(header.Src, header.Dst, protoTCP, len(tcp))),
+		)
+
+		virtioHeader{
+			flags:      virtioNeedsCsum,
+			gsoType:    virtioGSOTCPv6,
+			hdrLen:     uint16(ipv6.HeaderLen + tcpLen),
+			gsoSize:    uint16(c.size),
+			csumStart:  ipv6.HeaderLen,
+			csumOffset: tcpChecksumOffset,
+		}.marshal(c.buffer[:VirtioHeaderLen])
+	}
+
+	header, err := asHeader(data)
+	if err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+
+	return &Packet{header, data, c.buffer[:VirtioHeaderLen]}, nil
+}
+
+// mergeable returns the TCP payload of p if p is a complete TCP segment that may be merged with others. That is one
+// without offloads left to do, a valid checksum, a payload and no flags besides ACK and PSH.
+func mergeable(p *Packet) ([]byte, bool) {
+	if parseVirtioHeader(p.Offload).pending() || p.Header.NextHeader != protoTCP {
+		return nil, false
+	}
+
+	tcp := p.Marshalled[ipv6.HeaderLen:]
+
+	tcpLen, err := tcpHeaderLen(tcp)
+	if err != nil || len(tcp) == tcpLen || tcp[13]&^tcpPSH != tcpACK {
+		return nil, false
+	}
+
+	if fold(checksum(pseudoHeaderSum(p.Header.Src, p.Header.Dst, protoTCP, len(tcp)), tcp)) != 0xffff {
+		return nil, false
+	}
+
+	return tcp[tcpLen:], true
+}
+
+// sameHeaders returns true if the IPv6 and TCP headers a and b only differ in payload length, sequence number, PSH and
+// checksum.
+func sameHeaders(a, b []byte) bool {
+	tcpA, tcpB := a[ipv6.HeaderLen:], b[ipv6.HeaderLen:]
+
+	return bytes.Equal(a[:4], b[:4]) && bytes.Equal(a[6:ipv6.HeaderLen], b[6:ipv6.HeaderLen]) &&
+		bytes.Equal(tcpA[:4], tcpB[:4]) && bytes.Equal(tcpA[8:13], tcpB[8:13]) &&
+		tcpA[13]&^tcpPSH == tcpB[13]&^tcpPSH && bytes.Equal(tcpA[14:16], tcpB[14:16]) &&
+		bytes.Equal(tcpA[18:], tcpB[18:])
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"eqrx.net/wallhack/internal/packet"
+	"golang.org/x/net/ipv6"
+)
+
+// coalesce passes packets through a [packet.Coalescer] and returns what it read.
+func coalesce(t *testing.T, packets ...[]byte) []*packet.Packet {
+	t.Helper()
+
+	stream := &bytes.Buffer{}
+	for _, p := range packets {
+		stream.Write(make([]byte, packet.VirtioHeaderLen))
+		stream.Write(p)
+	}
+
+	coalescer, read := packet.NewCoalescer(packet.NewOffloadStreamReader(stream)), []*packet.Packet{}
+
+	for {
+		p, err := coalescer.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return read
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read = append(read, p.Clone())
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	t.Parallel()
+
+	segments := [][]byte{
+		tcpPacket(9000, 1, tcpACK, payload(1400)),
+		tcpPacket(9000, 1401, tcpACK, payload(1400)),
+		tcpPacket(9000, 2801, tcpACK|tcpPSH, payload(300)),
+		tcpPacket(9000, 3101, tcpACK, payload(1400)),
+	}
+
+	read := coalesce(t, segments...)
+	if len(read) != 2 {
+		t.Fatalf("segments coalesced into %d packets", len(read))
+	}
+
+	if read[0].Offload[1] != 4 || binary.LittleEndian.Uint16(read[0].Offload[4:]) != 1400 {
+		t.Fatalf("super-packet has virtio-net header %v", read[0].Offload)
+	}
+
+	if !bytes.Equal(read[1].Marshalled, segments[3]) {
+		t.Fatal("segment after PSH was changed")
+	}
+
+	plain := &closingBuffer{}
+	if err := packet.NewReadWriteCloser(plain, nil).WritePacket(read[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(plain.Bytes(), bytes.Join(segments[:3], nil)) {
+		t.Fatal("segmenting the super-packet does not result in the original segments")
+	}
+}
+
+func TestCoalesceUnmergeable(t *testing.T) {
+	t.Parallel()
+
+	badChecksum := tcpPacket(9000, 1401, tcpACK, payload(1400))
+	badChecksum[ipv6.HeaderLen+16]++
+
+	for name, second := range map[string][]byte{
+		"gap":        tcpPacket(9000, 1402, tcpACK, payload(1400)),
+		"flow":       tcpPacket(9001, 1401, tcpACK, payload(1400)),
+		"checksum":   badChecksum,
+		"larger":     tcpPacket(9000, 1401, tcpACK, payload(1401)),
+		"flags":      tcpPacket(9000, 1401, tcpACK|tcpFIN, payload(1400)),
+		"no payload": tcpPacket(9000, 1401, tcpACK, nil),
+		"not tcp":    dummyPacket(20),
+	} {
+		segments := [][]byte{tcpPacket(9000, 1, tcpACK, payload(1400)), second}
+
+		read := coalesce(t, segments...)
+		if len(read) != len(segments) {
+			t.Fatalf("%s: segments merged", name)
+		}
+
+		for i, p := range read {
+			if !bytes.Equal(p.Marshalled, segments[i]) || !bytes.Equal(p.Offload, make([]byte, packet.VirtioHeaderLen)) {
+				t.Fatalf("%s: packet %d changed", name, i)
+			}
+		}
+	}
+}
+
+func TestCoalesceAfterSmaller(t *testing.T) {
+	t.Parallel()
+
+	last := tcpPacket(9000, 1901, tcpACK, payload(900))
+	read := coalesce(t, tcpPacket(9000, 1, tcpACK, payload(1000)), tcpPacket(9000, 1001, tcpACK, payload(900)), last)
+
+	if len(read) != 2 || len(read[0].Marshalled) != ipv6.HeaderLen+20+1900 || !bytes.Equal(read[1].Marshalled, last) {
+		t.Fatal("segment merged after a smaller one")
+	}
+}
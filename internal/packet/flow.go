@@ -0,0 +1,72 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// protoTCP and protoUDP are the next header values of transports that have ports.
+	protoTCP = 6
+	protoUDP = 17
+	// portsLen is the length of the source and destination port at the start of TCP and UDP headers.
+	portsLen = 4
+	// macsLen is the length of the destination and source address at the start of ethernet frames.
+	macsLen = 12
+)
+
+// FlowHash returns a hash that is the same for all packets of a flow, so packets of a flow can be kept in order while
+// different flows are handled in parallel. IP packets are hashed by addresses, flow label, transport and ports.
+// Packets without header, like ethernet frames, are hashed by their addresses.
+func (p *Packet) FlowHash() uint32 {
+	hash := fnv.New32a()
+
+	if p.Header == nil {
+		macs := p.Marshalled
+		if len(macs) > macsLen {
+			macs = macs[:macsLen]
+		}
+
+		_, _ = hash.Write(macs)
+
+		return hash.Sum32()
+	}
+
+	var meta [5]byte
+
+	binary.BigEndian.PutUint32(meta[:], uint32(p.Header.FlowLabel))
+	meta[4] = byte(p.Header.NextHeader)
+
+	_, _ = hash.Write(p.Header.Src)
+	_, _ = hash.Write(p.Header.Dst)
+	_, _ = hash.Write(meta[:])
+
+	transport := p.Marshalled[ipv6.HeaderLen:]
+	hasPorts := p.Header.NextHeader == protoTCP || p.Header.NextHeader == protoUDP
+
+	if hasPorts && len(transport) >= portsLen {
+		_, _ = hash.Write(transport[:portsLen])
+	}
+
+	return hash.Sum32()
+}
+
+// Clone returns a copy of the packet that does not share memory with buffers of readers.
+func (p *Packet) Clone() *Packet {
+	return &Packet{p.Header, append([]byte{}, p.Marshalled...), append([]byte(nil), p.Offload...)}
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// FrameOverhead is the number of bytes an ethernet frame is larger than its payload: destination and source
+	// address, one VLAN tag and the ethertype.
+	FrameOverhead = 6 + 6 + 4 + 2
+	// framePrefixLen is the length of the length prefix of framed streams in bytes.
+	framePrefixLen = 2
+	// maxFrameLen is the largest frame that fits into the length prefix.
+	maxFrameLen = 1<<(8*framePrefixLen) - 1
+)
+
+var (
+	errEmptyFrame = errors.New("empty frame")
+	errFrameLen   = fmt.Errorf("frame longer than %d bytes", maxFrameLen)
+)
+
+// TapReader reads ethernet frames from a tap. Like [MTUReader] it expects one frame per read but it does not look
+// into the frames. Returned packets have no header.
+type TapReader struct {
+	reader MTUByteReader
+	buffer []byte
+}
+
+// NewTapReader creates a new [TapReader] with the given [MTUByteReader] as its source.
+func NewTapReader(reader MTUByteReader) *TapReader {
+	return &TapReader{reader, make([]byte, reader.MTU()+FrameOverhead+1)}
+}
+
+// ReadPacket reads an ethernet frame. Frames larger than the last queried MTU allows are dropped, the buffer is
+// resized to the current MTU and a new read is performed.
+func (t *TapReader) ReadPacket() (*Packet, error) {
+	for {
+		bytesRead, err := t.reader.Read(t.buffer)
+		if err != nil {
+			return nil, fmt.Errorf("read frame: %w", err)
+		}
+
+		if bytesRead == len(t.buffer) {
+			t.buffer = make([]byte, t.reader.MTU()+FrameOverhead+1)
+
+			continue
+		}
+
+		if bytesRead == 0 {
+			return nil, fmt.Errorf("read frame: %w", errEmptyFrame)
+		}
+
+		return &Packet{nil, t.buffer[:bytesRead], nil}, nil
+	}
+}
+
+// FramedReader reads packets from a stream where each of them is prefixed by its length as big endian uint16.
+// Unlike [StreamReader] it does not depend on IP headers, so it can carry ethernet frames. Returned packets have no
+// header.
+type FramedReader struct {
+	reader io.Reader
+	buffer []byte
+}
+
+// NewFramedReader creates a new [FramedReader] with the underlying reader.
+func NewFramedReader(reader io.Reader) *FramedReader {
+	return &FramedReader{reader, make([]byte, framePrefixLen+maxFrameLen)}
+}
+
+// ReadPacket reads a packet from the stream.
+func (f *FramedReader) ReadPacket() (*Packet, error) {
+	if _, err := io.ReadFull(f.reader, f.buffer[:framePrefixLen]); err != nil {
+		return nil, fmt.Errorf("read frame: %w", err)
+	}
+
+	frameLen := int(binary.BigEndian.Uint16(f.buffer))
+	if frameLen == 0 {
+		return nil, fmt.Errorf("read frame: %w", errEmptyFrame)
+	}
+
+	data := f.buffer[framePrefixLen : framePrefixLen+frameLen]
+
+	if _, err := io.ReadFull(f.reader, data); err != nil {
+		return nil, fmt.Errorf("read frame: %w", err)
+	}
+
+	return &Packet{nil, data, nil}, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"eqrx.net/wallhack/internal/packet"
+)
+
+type closingBuffer struct{ bytes.Buffer }
+
+func (c *closingBuffer) Close() error { return nil }
+
+func TestFramed(t *testing.T) {
+	t.Parallel()
+
+	stream := packet.NewFramedReadWriteCloser(&closingBuffer{})
+	frames := [][]byte{{1, 2, 3}, bytes.Repeat([]byte{4}, 1500), {5}}
+
+	for _, frame := range frames {
+		if err := stream.WritePacket(&packet.Packet{Marshalled: frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, frame := range frames {
+		read, err := stream.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(read.Marshalled, frame) || read.Header != nil {
+			t.Fatalf("want %v, have %v", frame, read.Marshalled)
+		}
+	}
+
+	if _, err := stream.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+
+	err := stream.WritePacket(&packet.Packet{Marshalled: make([]byte, 1<<16)})
+	if err == nil {
+		t.Fatal("expected oversized frame to be rejected")
+	}
+}
+
+func TestFramedTruncated(t *testing.T) {
+	t.Parallel()
+
+	reader := packet.NewFramedReader(bytes.NewReader([]byte{0, 5, 1, 2}))
+
+	if _, err := reader.ReadPacket(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal(err)
+	}
+}
+
+func TestTapReader(t *testing.T) {
+	t.Parallel()
+
+	chunkBuf := &chunkBuffer{[][]byte{}, mtu}
+	reader := packet.NewTapReader(chunkBuf)
+
+	oversized := make([]byte, mtu+packet.FrameOverhead+1)
+	frame := make([]byte, mtu+packet.FrameOverhead)
+	chunkBuf.AddChunk(oversized)
+	chunkBuf.AddChunk(frame)
+
+	read, err := reader.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(read.Marshalled) != len(frame) {
+		t.Fatalf("expected oversized frame to be dropped, read %d bytes", len(read.Marshalled))
+	}
+
+	if _, err := reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+}
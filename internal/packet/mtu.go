@@ -69,5 +69,5 @@ mturetry:
 		return nil, fmt.Errorf("%w: expected %d, got %d", errPortionMissing, header.PayloadLen+ipv6.HeaderLen, bytesRead)
 	}
 
-	return &Packet{header, data}, nil
+	return &Packet{header, data, nil}, nil
 }
@@ -0,0 +1,167 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// VirtioHeaderLen is the length of the virtio-net header in front of packets of tuns with offloads.
+	VirtioHeaderLen = 10
+	// maxOffloadLen is the length of the largest super-packet including its virtio-net header.
+	maxOffloadLen = VirtioHeaderLen + ipv6.HeaderLen + 0xffff
+	// virtioNeedsCsum tells that the transport checksum of a packet is partial and still has to be completed.
+	virtioNeedsCsum = 1
+	// virtioGSONone and virtioGSOTCPv6 are the segmentation types of packets. virtioGSOECN may be set in addition
+	// to tell that the CWR flag has to be kept on the first segment only.
+	virtioGSONone  = 0
+	virtioGSOTCPv6 = 4
+	virtioGSOECN   = 0x80
+)
+
+// virtioHeader is the virtio-net header in front of packets of tuns with offloads. It tells which offloads are left
+// to do for the packet. Its fields are little endian, like on the tuns of little endian hosts.
+type virtioHeader struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+// parseVirtioHeader parses the virtio-net header data. Packets without header have nothing left to do.
+func parseVirtioHeader(data []byte) virtioHeader {
+	if len(data) < VirtioHeaderLen {
+		return virtioHeader{}
+	}
+
+	return virtioHeader{
+		flags:      data[0],
+		gsoType:    data[1],
+		hdrLen:     binary.LittleEndian.Uint16(data[2:]),
+		gsoSize:    binary.LittleEndian.Uint16(data[4:]),
+		csumStart:  binary.LittleEndian.Uint16(data[6:]),
+		csumOffset: binary.LittleEndian.Uint16(data[8:]),
+	}
+}
+
+// marshal writes the header into data, which has to be [VirtioHeaderLen] bytes long.
+func (v virtioHeader) marshal(data []byte) {
+	data[0], data[1] = v.flags, v.gsoType
+	binary.LittleEndian.PutUint16(data[2:], v.hdrLen)
+	binary.LittleEndian.PutUint16(data[4:], v.gsoSize)
+	binary.LittleEndian.PutUint16(data[6:], v.csumStart)
+	binary.LittleEndian.PutUint16(data[8:], v.csumOffset)
+}
+
+// pending returns true if the packet still needs its checksum completed or has to be segmented.
+func (v virtioHeader) pending() bool {
+	return v.flags&virtioNeedsCsum != 0 || v.gsoType != virtioGSONone
+}
+
+// OffloadReader reads IP packets from a tun that prepends a virtio-net header to each of them. Since the packets
+// may be super-packets that are larger than the MTU, the buffer is large enough for the largest IP packet.
+// Consecutive packet reads use the same buffer.
+type OffloadReader struct {
+	reader io.Reader
+	buffer []byte
+}
+
+// NewOffloadReader creates a new [OffloadReader] with the given reader as its source.
+func NewOffloadReader(reader io.Reader) *OffloadReader {
+	return &OffloadReader{reader, make([]byte, maxOffloadLen)}
+}
+
+// ReadPacket reads an IP packet and its virtio-net header.
+func (o *OffloadReader) ReadPacket() (*Packet, error) {
+	bytesRead, err := o.reader.Read(o.buffer)
+	if err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+
+	if bytesRead < VirtioHeaderLen {
+		return nil, fmt.Errorf("read packet: %w: virtio-net header", errPortionMissing)
+	}
+
+	data := o.buffer[VirtioHeaderLen:bytesRead]
+
+	header, err := asHeader(data)
+	if err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+
+	if header.PayloadLen != len(data)-ipv6.HeaderLen {
+		return nil, fmt.Errorf("%w: expected %d, got %d", errPortionMissing, header.PayloadLen+ipv6.HeaderLen, len(data))
+	}
+
+	return &Packet{header, data, o.buffer[:VirtioHeaderLen]}, nil
+}
+
+// OffloadStreamReader reads IP packets from a stream where each of them is preceded by its virtio-net header.
+// The stream is read ahead, so [Coalescer] can tell which packets already arrived.
+type OffloadStreamReader struct {
+	reader *bufio.Reader
+	buffer *bytes.Buffer
+}
+
+// NewOffloadStreamReader creates a new [OffloadStreamReader] with the underlying reader.
+func NewOffloadStreamReader(reader io.Reader) *OffloadStreamReader {
+	return &OffloadStreamReader{bufio.NewReaderSize(reader, maxOffloadLen), &bytes.Buffer{}}
+}
+
+// ReadPacket reads an IP packet and its virtio-net header from the stream.
+func (o *OffloadStreamReader) ReadPacket() (*Packet, error) {
+	if _, err := io.CopyN(o.buffer, o.reader, VirtioHeaderLen+ipv6.HeaderLen); err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+
+	header, err := asHeader(o.buffer.Bytes()[VirtioHeaderLen:])
+	if err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+
+	if _, err := io.CopyN(o.buffer, o.reader, int64(header.PayloadLen)); err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+
+	data := o.buffer.Bytes()
+	o.buffer.Reset()
+
+	return &Packet{header, data[VirtioHeaderLen:], data[:VirtioHeaderLen]}, nil
+}
+
+// buffered returns true if the next packet arrived completely, so reading it does not block.
+func (o *OffloadStreamReader) buffered() bool {
+	const headersLen = VirtioHeaderLen + ipv6.HeaderLen
+
+	available := o.reader.Buffered()
+	if available < headersLen {
+		return false
+	}
+
+	headers, err := o.reader.Peek(headersLen)
+	if err != nil {
+		return false
+	}
+
+	return available >= headersLen+int(binary.BigEndian.Uint16(headers[VirtioHeaderLen+4:]))
+}
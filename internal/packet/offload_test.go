@@ -0,0 +1,93 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"eqrx.net/wallhack/internal/packet"
+	"golang.org/x/net/ipv6"
+)
+
+// superPacket returns a virtio-net header followed by a TCP super-packet that is larger than any MTU and has to be
+// cut into segments of 1400 bytes.
+func superPacket() []byte {
+	data := tcpPacket(9000, 1, tcpACK, payload(20000))
+	binary.BigEndian.PutUint16(data[ipv6.HeaderLen+16:], pseudoSum(data))
+
+	return append([]byte{1, 4, 60, 0, 0x78, 0x05, 40, 0, 16, 0}, data...)
+}
+
+func TestOffload(t *testing.T) {
+	t.Parallel()
+
+	raw := superPacket()
+
+	device := &chunkBuffer{[][]byte{raw}, mtu}
+
+	read, err := packet.NewOffloadReader(device).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, data := raw[:packet.VirtioHeaderLen], raw[packet.VirtioHeaderLen:]
+
+	if !bytes.Equal(read.Offload, header) || !bytes.Equal(read.Marshalled, data) {
+		t.Fatal("offload reader split packet wrong")
+	}
+
+	stream := &closingBuffer{}
+	if err := packet.NewOffloadReadWriteCloser(stream, nil).WritePacket(read); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stream.Bytes(), raw) {
+		t.Fatal("offload writer did not write header and packet")
+	}
+
+	streamed, err := packet.NewOffloadStreamReader(stream).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(streamed.Offload, read.Offload) || !bytes.Equal(streamed.Marshalled, read.Marshalled) {
+		t.Fatal("offload stream reader split packet wrong")
+	}
+
+	plain := &closingBuffer{}
+	if err := packet.NewReadWriteCloser(plain, nil).WritePacket(streamed); err != nil {
+		t.Fatal(err)
+	}
+
+	if segments := readAll(t, plain.Bytes()); len(segments) != 15 {
+		t.Fatalf("plain writer wrote %d segments", len(segments))
+	}
+}
+
+func TestOffloadZeroHeader(t *testing.T) {
+	t.Parallel()
+
+	stream := &closingBuffer{}
+	pkt := dummyPacket(5)
+
+	if err := packet.NewOffloadReadWriteCloser(stream, nil).WritePacket(&packet.Packet{Marshalled: pkt}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stream.Bytes(), append(make([]byte, packet.VirtioHeaderLen), pkt...)) {
+		t.Fatal("packet without header did not get a zero header")
+	}
+}
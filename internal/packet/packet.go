@@ -30,6 +30,8 @@ var (
 type Packet struct {
 	Header     *ipv6.Header
 	Marshalled []byte
+	// Offload is the virtio-net header that came with the packet. Nil if there was none.
+	Offload []byte
 }
 
 func asHeader(data []byte) (*ipv6.Header, error) {
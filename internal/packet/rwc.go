@@ -14,6 +14,7 @@
 package packet
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 )
@@ -29,18 +30,65 @@ type (
 	ReadWriteCloser struct {
 		io.ReadWriteCloser
 		Reader
+		framed   bool
+		offload  bool
+		segments []byte
 	}
 )
 
 // NewReadWriteCloser creates a new [ReadWriteCloser] with sub as the underlying [io.ReadWriteCloser]
 // and reader as [Reader] implementation.
 func NewReadWriteCloser(sub io.ReadWriteCloser, reader Reader) *ReadWriteCloser {
-	return &ReadWriteCloser{sub, reader}
+	return &ReadWriteCloser{sub, reader, false, false, nil}
 }
 
-// WritePacket writes the marshalled form of [Packet] over the stream.
+// NewOffloadReadWriteCloser creates a new [ReadWriteCloser] that writes packets prefixed by their virtio-net header.
+// Packets without one get a header of zeros, which means there is nothing left to do for them.
+func NewOffloadReadWriteCloser(sub io.ReadWriteCloser, reader Reader) *ReadWriteCloser {
+	return &ReadWriteCloser{sub, reader, false, true, nil}
+}
+
+// NewFramedReadWriteCloser creates a new [ReadWriteCloser] for a stream that carries length prefixed packets as read
+// by [FramedReader].
+func NewFramedReadWriteCloser(sub io.ReadWriteCloser) *ReadWriteCloser {
+	return &ReadWriteCloser{sub, NewFramedReader(sub), true, false, nil}
+}
+
+// WritePacket writes the marshalled form of [Packet] over the stream, prefixed by its length if the stream is framed
+// or by its virtio-net header if the stream carries offloads. Otherwise the offloads the virtio-net header asks for
+// are done by wallhack: super-packets are written as separate TCP segments and partial checksums are completed.
 func (r *ReadWriteCloser) WritePacket(p *Packet) error {
-	_, err := r.Write(p.Marshalled)
+	data := p.Marshalled
+
+	switch {
+	case !r.offload && !r.framed && parseVirtioHeader(p.Offload).pending():
+		var err error
+
+		r.segments, err = finish(p, r.segments, func(segment []byte) error {
+			_, err := r.Write(segment)
+
+			return err //nolint:wrapcheck
+		})
+		if err != nil {
+			return fmt.Errorf("write packet: %w", err)
+		}
+
+		return nil
+	case r.offload:
+		data = make([]byte, VirtioHeaderLen, VirtioHeaderLen+len(p.Marshalled))
+		copy(data, p.Offload)
+		data = append(data, p.Marshalled...)
+	case r.framed:
+		if len(data) > maxFrameLen {
+			return fmt.Errorf("write packet: %w", errFrameLen)
+		}
+
+		data = make([]byte, framePrefixLen, framePrefixLen+len(p.Marshalled))
+		binary.BigEndian.PutUint16(data, uint16(len(p.Marshalled)))
+		data = append(data, p.Marshalled...)
+	}
+
+	_, err := r.Write(data)
 	if err != nil {
 		return fmt.Errorf("write packet: %w", err)
 	}
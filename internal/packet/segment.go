@@ -0,0 +1,150 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// tcpMinHeaderLen is the length of a TCP header without options.
+	tcpMinHeaderLen = 20
+	// tcpChecksumOffset is the offset of the checksum within the TCP header.
+	tcpChecksumOffset = 16
+	// TCP flags.
+	tcpFIN = 0x01
+	tcpPSH = 0x08
+	tcpACK = 0x10
+	tcpCWR = 0x80
+)
+
+// errOffload indicates that the virtio-net header of a packet asks for offloads wallhack can not do.
+var errOffload = errors.New("unsupported offload")
+
+// tcpHeaderLen returns the length of the TCP header at the start of segment.
+func tcpHeaderLen(segment []byte) (int, error) {
+	if len(segment) < tcpMinHeaderLen {
+		return 0, fmt.Errorf("%w: tcp header", errPortionMissing)
+	}
+
+	length := int(segment[12]>>4) * 4
+	if length < tcpMinHeaderLen || length > len(segment) {
+		return 0, fmt.Errorf("%w: tcp header", errPortionMissing)
+	}
+
+	return length, nil
+}
+
+// tcpChecksum computes the checksum of the TCP segment carried by the IPv6 packet with header. The checksum field of
+// the segment has to be zero.
+func tcpChecksum(header *ipv6.Header, segment []byte) uint16 {
+	return ^fold(checksum(pseudoHeaderSum(header.Src, header.Dst, protoTCP, len(segment)), segment))
+}
+
+// finish completes the offloads the virtio-net header of p asks for, so the result can be written to a tun without
+// offloads. write is called with each resulting packet, buffer is used for them. Super-packets are cut into TCP
+// segments that are not larger than the segment size given by the header, partial checksums are completed in place.
+// Returns the buffer so it can be reused.
+func finish(p *Packet, buffer []byte, write func([]byte) error) ([]byte, error) {
+	offloads := parseVirtioHeader(p.Offload)
+
+	switch offloads.gsoType &^ virtioGSOECN {
+	case virtioGSONone:
+		if offloads.flags&virtioNeedsCsum != 0 {
+			if err := completeChecksum(p.Marshalled, offloads); err != nil {
+				return buffer, err
+			}
+		}
+
+		return buffer, write(p.Marshalled)
+	case virtioGSOTCPv6:
+		return segment(p, offloads, buffer, write)
+	default:
+		return buffer, fmt.Errorf("%w: segmentation type %d", errOffload, offloads.gsoType)
+	}
+}
+
+// completeChecksum completes the partial checksum of data. The checksum field already holds the sum of the pseudo
+// header, the rest is summed from the checksum start to the end of the packet.
+func completeChecksum(data []byte, offloads virtioHeader) error {
+	start, field := int(offloads.csumStart), int(offloads.csumStart)+int(offloads.csumOffset)
+	if field+2 > len(data) {
+		return fmt.Errorf("%w: checksum at %d of %d bytes", errOffload, field, len(data))
+	}
+
+	binary.BigEndian.PutUint16(data[field:], ^fold(checksum(0, data[start:])))
+
+	return nil
+}
+
+// segment cuts the TCP super-packet p into segments of the segment size given by offloads, like the kernel does for
+// TCP segmentation offload. Each segment gets the sequence number of its payload and a complete checksum. FIN and PSH
+// are only kept on the last segment, CWR only on the first.
+func segment(p *Packet, offloads virtioHeader, buffer []byte, write func([]byte) error) ([]byte, error) {
+	if p.Header.NextHeader != protoTCP {
+		return buffer, fmt.Errorf("%w: tcp segmentation of next header %d", errOffload, p.Header.NextHeader)
+	}
+
+	if offloads.gsoSize == 0 {
+		return buffer, fmt.Errorf("%w: segment size zero", errOffload)
+	}
+
+	tcpLen, err := tcpHeaderLen(p.Marshalled[ipv6.HeaderLen:])
+	if err != nil {
+		return buffer, err
+	}
+
+	headers := p.Marshalled[:ipv6.HeaderLen+tcpLen]
+	payload := p.Marshalled[len(headers):]
+	seq := binary.BigEndian.Uint32(headers[ipv6.HeaderLen+4:])
+	flags := headers[ipv6.HeaderLen+13]
+	size := int(offloads.gsoSize)
+
+	for offset := 0; ; offset += size {
+		end := offset + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		buffer = append(append(buffer[:0], headers...), payload[offset:end]...)
+		binary.BigEndian.PutUint16(buffer[4:], uint16(len(buffer)-ipv6.HeaderLen))
+
+		tcp := buffer[ipv6.HeaderLen:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(offset))
+
+		tcp[13] = flags
+		if end != len(payload) {
+			tcp[13] &^= tcpFIN | tcpPSH
+		}
+
+		if offset != 0 {
+			tcp[13] &^= tcpCWR
+		}
+
+		binary.BigEndian.PutUint16(tcp[tcpChecksumOffset:], 0)
+		binary.BigEndian.PutUint16(tcp[tcpChecksumOffset:], tcpChecksum(p.Header, tcp))
+
+		if err := write(buffer); err != nil {
+			return buffer, err
+		}
+
+		if end == len(payload) {
+			return buffer, nil
+		}
+	}
+}
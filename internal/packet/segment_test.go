@@ -0,0 +1,199 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package packet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"eqrx.net/wallhack/internal/packet"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// sum returns the one's complement sum of data.
+func sum(initial uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		initial += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+
+	if len(data)%2 == 1 {
+		initial += uint32(data[len(data)-1]) << 8
+	}
+
+	for initial > 0xffff {
+		initial = initial>>16 + initial&0xffff
+	}
+
+	return uint16(initial)
+}
+
+// pseudoSum returns the one's complement sum of the pseudo header of the IPv6 packet data.
+func pseudoSum(data []byte) uint16 {
+	pseudo := make([]byte, 40)
+	copy(pseudo, data[8:ipv6.HeaderLen])
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(data)-ipv6.HeaderLen))
+	pseudo[39] = data[6]
+
+	return sum(0, pseudo)
+}
+
+// tcpSum returns the one's complement sum of the TCP segment in the IPv6 packet data including its pseudo header.
+// It is 0xffff if the checksum is valid.
+func tcpSum(data []byte) uint16 { return sum(uint32(pseudoSum(data)), data[ipv6.HeaderLen:]) }
+
+// tcpPacket returns an IPv6 packet with a TCP segment of the given flow port, sequence number, flags and payload.
+func tcpPacket(port uint16, seq uint32, flags byte, payload []byte) []byte {
+	data := make([]byte, ipv6.HeaderLen+20, ipv6.HeaderLen+20+len(payload))
+	data[0], data[6], data[7] = 0x60, 6, 64
+	data[23], data[39] = 1, 2
+	data[8], data[24] = 0xfd, 0xfd
+
+	tcp := data[ipv6.HeaderLen:]
+	binary.BigEndian.PutUint16(tcp, port)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 77)
+	tcp[12], tcp[13] = 5<<4, flags
+	binary.BigEndian.PutUint16(tcp[14:], 512)
+
+	data = append(data, payload...)
+	binary.BigEndian.PutUint16(data[4:], uint16(len(data)-ipv6.HeaderLen))
+	binary.BigEndian.PutUint16(data[ipv6.HeaderLen+16:], ^tcpSum(data))
+
+	return data
+}
+
+// payload returns length bytes of payload that differ from each other.
+func payload(length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	return data
+}
+
+// readAll reads all IP packets from the stream data.
+func readAll(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+
+	reader, packets := packet.NewStreamReader(bytes.NewReader(data)), [][]byte{}
+
+	for {
+		p, err := reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return packets
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packets = append(packets, append([]byte{}, p.Marshalled...))
+	}
+}
+
+// offloaded reads the IP packet data with the virtio-net header offload.
+func offloaded(t *testing.T, offload, data []byte) *packet.Packet {
+	t.Helper()
+
+	p, err := packet.NewOffloadStreamReader(bytes.NewReader(append(offload, data...))).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestSegment(t *testing.T) {
+	t.Parallel()
+
+	const (
+		seq  = 1000
+		size = 1400
+	)
+
+	super := tcpPacket(9000, seq, tcpACK|tcpPSH|tcpFIN, payload(5000))
+	// The checksum of super-packets only covers the pseudo header.
+	binary.BigEndian.PutUint16(super[ipv6.HeaderLen+16:], pseudoSum(super))
+
+	offload := []byte{1, 4, 60, 0, size & 0xff, size >> 8, 40, 0, 16, 0}
+
+	plain := &closingBuffer{}
+	if err := packet.NewReadWriteCloser(plain, nil).WritePacket(offloaded(t, offload, super)); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := readAll(t, plain.Bytes())
+	joined := []byte{}
+
+	for i, lengths := range []int{1400, 1400, 1400, 800} {
+		segment := segments[i]
+		if len(segment) != ipv6.HeaderLen+20+lengths {
+			t.Fatalf("segment %d has length %d", i, len(segment))
+		}
+
+		if tcpSum(segment) != 0xffff {
+			t.Fatalf("segment %d has a bad checksum", i)
+		}
+
+		if s := binary.BigEndian.Uint32(segment[ipv6.HeaderLen+4:]); s != uint32(seq+i*size) {
+			t.Fatalf("segment %d has sequence number %d", i, s)
+		}
+
+		flags, want := segment[ipv6.HeaderLen+13], byte(tcpACK)
+		if i == 3 {
+			want = tcpACK | tcpPSH | tcpFIN
+		}
+
+		if flags != want {
+			t.Fatalf("segment %d has flags %x", i, flags)
+		}
+
+		joined = append(joined, segment[ipv6.HeaderLen+20:]...)
+	}
+
+	if len(segments) != 4 || !bytes.Equal(joined, super[ipv6.HeaderLen+20:]) {
+		t.Fatal("payload not segmented")
+	}
+}
+
+func TestCompleteChecksum(t *testing.T) {
+	t.Parallel()
+
+	data := tcpPacket(9000, 1, tcpACK, payload(99))
+	want := append([]byte{}, data...)
+	// The partial checksum is the sum of the pseudo header.
+	binary.BigEndian.PutUint16(data[ipv6.HeaderLen+16:], pseudoSum(data))
+
+	plain := &closingBuffer{}
+	offload := []byte{1, 0, 0, 0, 0, 0, 40, 0, 16, 0}
+
+	if err := packet.NewReadWriteCloser(plain, nil).WritePacket(offloaded(t, offload, data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(plain.Bytes(), want) {
+		t.Fatal("checksum not completed")
+	}
+}
@@ -50,5 +50,5 @@ func (n *StreamReader) ReadPacket() (*Packet, error) {
 	marshalled := n.buffer.Bytes()
 	n.buffer.Reset()
 
-	return &Packet{header, marshalled}, nil
+	return &Packet{header, marshalled, nil}, nil
 }
@@ -0,0 +1,163 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package proto defines the session setup of the wallhack protocol.
+//
+// Clients and servers that negotiate [ALPN] exchange a [ClientHello] and a [ServerHello] right after the TLS
+// handshake before any packets are sent. Connections that negotiate [ALPNLegacy] start with packets right away.
+// Each hello is JSON prefixed by its length as big endian uint32.
+//
+// Connections carry IP packets as they are unless the client asked for [LayerEthernet] in its hello. Ethernet frames
+// do not tell their length, so each of them is prefixed by its length as big endian uint16. If both sides agreed on
+// offloads in their hellos each IP packet is preceded by its virtio-net header instead. A side whose tun has no
+// offloads segments the super-packets it receives itself. A side whose tun has offloads merges the TCP segments it
+// receives into super-packets again.
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/packet"
+)
+
+const (
+	// ALPN is the ALPN protocol name of wallhack connections that start with a session setup.
+	ALPN = "wallhack/2"
+	// ALPNLegacy is the ALPN protocol name of wallhack connections that carry packets only.
+	ALPNLegacy = "wallhack"
+	// maxMessageLen is the maximum accepted length of a hello in bytes.
+	maxMessageLen = 64 * 1024
+	// lenPrefixLen is the length of the length prefix of hellos in bytes.
+	lenPrefixLen = 4
+)
+
+// Layer is the network layer a connection carries.
+type Layer string
+
+const (
+	// LayerIP means the connection carries IP packets. This is the default.
+	LayerIP Layer = ""
+	// LayerEthernet means the connection carries ethernet frames.
+	LayerEthernet Layer = "ethernet"
+)
+
+// String returns the name of the layer.
+func (l Layer) String() string {
+	if l == LayerIP {
+		return "ip"
+	}
+
+	return string(l)
+}
+
+var (
+	// ErrLayer indicates that client and server do not agree on the layer of a connection.
+	ErrLayer      = errors.New("layer mismatch")
+	errMessageLen = fmt.Errorf("message longer than %d bytes", maxMessageLen)
+)
+
+// NextProtos are the ALPN protocol names wallhack supports, preferred first.
+func NextProtos() []string { return []string{ALPN, ALPNLegacy} }
+
+// IsWallhack returns true if the given ALPN protocol name belongs to wallhack.
+func IsWallhack(proto string) bool { return proto == ALPN || proto == ALPNLegacy }
+
+// ClientHello is sent by the client to start the session setup.
+type ClientHello struct {
+	// Layer is the network layer the client wants to carry over the connection.
+	Layer Layer `json:"layer,omitempty"`
+	// Offload tells that the tun of the client has offloads, see [ServerHello.Offload].
+	Offload bool `json:"offload,omitempty"`
+	// Segment tells that the client can carry virtio-net headers even though its tun has no offloads because it
+	// segments super-packets itself.
+	Segment bool `json:"segment,omitempty"`
+}
+
+// ServerHello is the answer of the server to a [ClientHello].
+type ServerHello struct {
+	// Network is the configuration the client should apply to its tun.
+	Network netlink.Settings `json:"network"`
+	// Offload tells that both sides carry IP packets with virtio-net headers, so super-packets of the tuns can be
+	// carried in one piece. Only set if the client asked for it and at least one of the tuns has offloads.
+	Offload bool `json:"offload,omitempty"`
+}
+
+// Stream returns the packet stream of conn after the session setup for the given layer and whether offloads were
+// agreed on. With coalesce TCP segments that are read are merged into super-packets, which only helps if they are
+// written to a tun with offloads.
+func Stream(conn io.ReadWriteCloser, layer Layer, offload, coalesce bool) *packet.ReadWriteCloser {
+	switch {
+	case layer == LayerEthernet:
+		return packet.NewFramedReadWriteCloser(conn)
+	case offload && coalesce:
+		return packet.NewOffloadReadWriteCloser(conn, packet.NewCoalescer(packet.NewOffloadStreamReader(conn)))
+	case offload:
+		return packet.NewOffloadReadWriteCloser(conn, packet.NewOffloadStreamReader(conn))
+	default:
+		return packet.NewReadWriteCloser(conn, packet.NewStreamReader(conn))
+	}
+}
+
+// WriteMessage writes msg as length prefixed JSON to w.
+func WriteMessage(w io.Writer, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+
+	if len(data) > maxMessageLen {
+		return fmt.Errorf("write message: %w", errMessageLen)
+	}
+
+	buf := make([]byte, lenPrefixLen, lenPrefixLen+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+
+	if _, err := w.Write(append(buf, data...)); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+
+	return nil
+}
+
+// ReadMessage reads length prefixed JSON from r into msg. It never reads more than the message from r.
+func ReadMessage(r io.Reader, msg interface{}) error {
+	prefix := make([]byte, lenPrefixLen)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return fmt.Errorf("read message: %w", err)
+	}
+
+	msgLen := binary.BigEndian.Uint32(prefix)
+	if msgLen > maxMessageLen {
+		return fmt.Errorf("read message: %w", errMessageLen)
+	}
+
+	data := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return fmt.Errorf("read message: %w", err)
+	}
+
+	if err := json.Unmarshal(data, msg); err != nil {
+		return fmt.Errorf("read message: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package proto_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/proto"
+)
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	sent := proto.ServerHello{Network: netlink.Settings{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("fd00::2/64")},
+		Routes:    []netip.Prefix{netip.MustParsePrefix("fd01::/64")},
+	}}
+
+	buf := &bytes.Buffer{}
+	if err := proto.WriteMessage(buf, sent); err != nil {
+		t.Fatal(err)
+	}
+
+	trailer := []byte{0x60}
+	buf.Write(trailer)
+
+	received := proto.ServerHello{}
+	if err := proto.ReadMessage(buf, &received); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Network.Addresses[0] != sent.Network.Addresses[0] || received.Network.Routes[0] != sent.Network.Routes[0] {
+		t.Fatal(received)
+	}
+
+	if !bytes.Equal(buf.Bytes(), trailer) {
+		t.Fatal("read past message")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	if err := proto.WriteMessage(buf, proto.ClientHello{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+
+	err := proto.ReadMessage(bytes.NewReader(data[:len(data)-1]), &proto.ClientHello{})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal(err)
+	}
+}
+
+func TestTooLong(t *testing.T) {
+	t.Parallel()
+
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, 1<<30)
+
+	if err := proto.ReadMessage(bytes.NewReader(prefix), &proto.ClientHello{}); err == nil {
+		t.Fatal("oversized message accepted")
+	}
+}
+
+func TestLayer(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	if err := proto.WriteMessage(buf, struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := proto.WriteMessage(buf, proto.ClientHello{Layer: proto.LayerEthernet}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []proto.Layer{proto.LayerIP, proto.LayerEthernet} {
+		hello := proto.ClientHello{}
+		if err := proto.ReadMessage(buf, &hello); err != nil {
+			t.Fatal(err)
+		}
+
+		if hello.Layer != want {
+			t.Fatalf("want layer %s, have %s", want, hello.Layer)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package abuse protects the server against clients that hammer it with connections or fail handshakes over and
+// over again. It rate limits new connections per address and per prefix, bans addresses temporarily after repeated
+// failures and limits the number of sessions.
+package abuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepInterval is the interval in which idle state is dropped.
+	sweepInterval = time.Minute
+	// defaultPrefixBits4 and defaultPrefixBits6 are the prefix lengths addresses are grouped by for per prefix rate
+	// limiting if not configured otherwise.
+	defaultPrefixBits4 = 24
+	defaultPrefixBits6 = 64
+	// defaultBanWindow is the window failures are counted in if not configured otherwise.
+	defaultBanWindow = 10 * time.Minute
+	// defaultBanDuration is the duration of bans if not configured otherwise.
+	defaultBanDuration = time.Hour
+)
+
+var (
+	// ErrBanned indicates that the address of a client is banned.
+	ErrBanned = errors.New("client banned")
+	// ErrRateLimited indicates that a client opens connections too fast.
+	ErrRateLimited = errors.New("client rate limited")
+	// ErrSessionLimit indicates that no more sessions are allowed.
+	ErrSessionLimit = errors.New("session limit reached")
+)
+
+// Rate limits events with a token bucket. The zero value means no limit.
+type Rate struct {
+	// PerSecond is the number of events allowed per second on average.
+	PerSecond float64 `yaml:"perSecond"`
+	// Burst is the number of events allowed at once.
+	Burst int `yaml:"burst"`
+}
+
+func (r Rate) enabled() bool { return r.PerSecond > 0 }
+
+// capacity returns the size of the token bucket, at least one.
+func (r Rate) capacity() float64 {
+	if r.Burst < 1 {
+		return 1
+	}
+
+	return float64(r.Burst)
+}
+
+// Config contains the limits. The zero value disables all of them.
+type Config struct {
+	// PerAddress limits new connections per client address.
+	PerAddress Rate `yaml:"perAddress"`
+	// PerPrefix limits new connections per client prefix.
+	PerPrefix Rate `yaml:"perPrefix"`
+	// PrefixBits4 is the prefix length IPv4 addresses are grouped by for PerPrefix. Defaults to 24.
+	PrefixBits4 int `yaml:"prefixBits4"`
+	// PrefixBits6 is the prefix length IPv6 addresses are grouped by for PerPrefix. Defaults to 64.
+	PrefixBits6 int `yaml:"prefixBits6"`
+	// BanAfter is the number of failures within BanWindow after which an address gets banned. 0 disables bans.
+	BanAfter int `yaml:"banAfter"`
+	// BanWindow is the window failures are counted in.
+	BanWindow time.Duration `yaml:"banWindow"`
+	// BanDuration is the duration of bans.
+	BanDuration time.Duration `yaml:"banDuration"`
+	// MaxSessions is the number of sessions allowed in total. 0 means no limit.
+	MaxSessions int `yaml:"maxSessions"`
+	// MaxSessionsPerClient is the number of sessions allowed per client identity. 0 means no limit.
+	MaxSessionsPerClient int `yaml:"maxSessionsPerClient"`
+	// Exempt contains prefixes that are never rate limited or banned.
+	Exempt []netip.Prefix `yaml:"exempt"`
+}
+
+// Ban is an active ban.
+type Ban struct {
+	Addr     netip.Addr `json:"addr"`
+	Until    time.Time  `json:"until"`
+	Failures int        `json:"failures"`
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket according to rate and takes a token if possible.
+func (b *bucket) take(rate Rate, now time.Time) bool {
+	b.tokens = math.Min(rate.capacity(), b.tokens+now.Sub(b.updated).Seconds()*rate.PerSecond)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// full returns true if the bucket would be full at now and can therefore be forgotten.
+func (b *bucket) full(rate Rate, now time.Time) bool {
+	return b.tokens+now.Sub(b.updated).Seconds()*rate.PerSecond >= rate.capacity()
+}
+
+// failures counts the failures of an address within the ban window.
+type failures struct {
+	count int
+	since time.Time
+}
+
+// Guard keeps track of clients and enforces the limits.
+type Guard struct {
+	cfg           Config
+	mtx           sync.Mutex
+	addresses     map[netip.Addr]*bucket
+	prefixes      map[netip.Prefix]*bucket
+	failures      map[netip.Addr]*failures
+	bans          map[netip.Addr]Ban
+	sessions      map[string]int
+	sessionsTotal int
+}
+
+// New creates a new [Guard] enforcing cfg.
+func New(cfg Config) *Guard {
+	if cfg.PrefixBits4 <= 0 {
+		cfg.PrefixBits4 = defaultPrefixBits4
+	}
+
+	if cfg.PrefixBits6 <= 0 {
+		cfg.PrefixBits6 = defaultPrefixBits6
+	}
+
+	if cfg.BanWindow <= 0 {
+		cfg.BanWindow = defaultBanWindow
+	}
+
+	if cfg.BanDuration <= 0 {
+		cfg.BanDuration = defaultBanDuration
+	}
+
+	return &Guard{
+		cfg:       cfg,
+		addresses: map[netip.Addr]*bucket{},
+		prefixes:  map[netip.Prefix]*bucket{},
+		failures:  map[netip.Addr]*failures{},
+		bans:      map[netip.Addr]Ban{},
+		sessions:  map[string]int{},
+	}
+}
+
+// Addr returns the IP address of addr. The result is invalid if addr is no IP address.
+func Addr(addr net.Addr) netip.Addr {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort().Addr().Unmap()
+	}
+
+	parsed, _ := netip.ParseAddrPort(addr.String())
+
+	return parsed.Addr().Unmap()
+}
+
+// exempt returns true if addr is not subject to rate limits and bans.
+func (g *Guard) exempt(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return true
+	}
+
+	for _, prefix := range g.cfg.Exempt {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prefix returns the prefix addr is grouped into for per prefix rate limiting.
+func (g *Guard) prefix(addr netip.Addr) netip.Prefix {
+	bits := g.cfg.PrefixBits6
+	if addr.Is4() {
+		bits = g.cfg.PrefixBits4
+	}
+
+	prefix, _ := addr.Prefix(bits)
+
+	return prefix
+}
+
+// Allow checks if a new connection from addr is allowed. Returns [ErrBanned] or [ErrRateLimited] if not.
+func (g *Guard) Allow(addr netip.Addr) error {
+	if g.exempt(addr) {
+		return nil
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := time.Now()
+
+	if ban, ok := g.bans[addr]; ok {
+		if now.Before(ban.Until) {
+			return fmt.Errorf("%w until %s", ErrBanned, ban.Until.Format(time.RFC3339))
+		}
+
+		delete(g.bans, addr)
+	}
+
+	if g.cfg.PerAddress.enabled() && !take(g.addresses, addr, g.cfg.PerAddress, now) {
+		return fmt.Errorf("%w: address %s", ErrRateLimited, addr)
+	}
+
+	if prefix := g.prefix(addr); g.cfg.PerPrefix.enabled() && !take(g.prefixes, prefix, g.cfg.PerPrefix, now) {
+		return fmt.Errorf("%w: prefix %s", ErrRateLimited, prefix)
+	}
+
+	return nil
+}
+
+func take[K comparable](buckets map[K]*bucket, key K, rate Rate, now time.Time) bool {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{rate.capacity(), now}
+		buckets[key] = b
+	}
+
+	return b.take(rate, now)
+}
+
+// Fail records a failed handshake or certificate validation of addr. Returns true if addr got banned because of it.
+func (g *Guard) Fail(addr netip.Addr) bool {
+	if g.cfg.BanAfter <= 0 || g.exempt(addr) {
+		return false
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := time.Now()
+
+	failed, ok := g.failures[addr]
+	if !ok || now.Sub(failed.since) > g.cfg.BanWindow {
+		failed = &failures{0, now}
+		g.failures[addr] = failed
+	}
+
+	failed.count++
+
+	if failed.count < g.cfg.BanAfter {
+		return false
+	}
+
+	delete(g.failures, addr)
+	g.bans[addr] = Ban{addr, now.Add(g.cfg.BanDuration), failed.count}
+
+	return true
+}
+
+// Bans returns all active bans ordered by address.
+func (g *Guard) Bans() []Ban {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(g.bans))
+
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Addr.Less(bans[j].Addr) })
+
+	return bans
+}
+
+// StartSession checks the session limits for a new session of the client identified by key and counts it.
+// replacing tells that the session takes over a running session of the same client that is about to end, such
+// sessions are not checked since they do not add to the sessions running once the old one is gone.
+// The returned function has to be called once the session ends.
+func (g *Guard) StartSession(key string, replacing bool) (func(), error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	switch {
+	case replacing:
+	case g.cfg.MaxSessions > 0 && g.sessionsTotal >= g.cfg.MaxSessions:
+		return nil, fmt.Errorf("%w: %d in total", ErrSessionLimit, g.sessionsTotal)
+	case g.cfg.MaxSessionsPerClient > 0 && g.sessions[key] >= g.cfg.MaxSessionsPerClient:
+		return nil, fmt.Errorf("%w: %d for %s", ErrSessionLimit, g.sessions[key], key)
+	}
+
+	g.sessions[key]++
+	g.sessionsTotal++
+
+	once := sync.Once{}
+
+	return func() {
+		once.Do(func() {
+			g.mtx.Lock()
+			defer g.mtx.Unlock()
+
+			g.sessionsTotal--
+			if g.sessions[key]--; g.sessions[key] == 0 {
+				delete(g.sessions, key)
+			}
+		})
+	}, nil
+}
+
+// Run drops state that is not needed anymore until ctx is done.
+func (g *Guard) Run(ctx context.Context) error {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			g.sweep()
+		}
+	}
+}
+
+func (g *Guard) sweep() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := time.Now()
+
+	for addr, b := range g.addresses {
+		if b.full(g.cfg.PerAddress, now) {
+			delete(g.addresses, addr)
+		}
+	}
+
+	for prefix, b := range g.prefixes {
+		if b.full(g.cfg.PerPrefix, now) {
+			delete(g.prefixes, prefix)
+		}
+	}
+
+	for addr, failed := range g.failures {
+		if now.Sub(failed.since) > g.cfg.BanWindow {
+			delete(g.failures, addr)
+		}
+	}
+
+	for addr, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, addr)
+		}
+	}
+}
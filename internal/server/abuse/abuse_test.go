@@ -0,0 +1,179 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package abuse_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/session"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	guard := abuse.New(abuse.Config{
+		PerAddress: abuse.Rate{PerSecond: 0.001, Burst: 2},
+		PerPrefix:  abuse.Rate{PerSecond: 0.001, Burst: 3},
+		Exempt:     []netip.Prefix{netip.MustParsePrefix("192.0.2.42/32")},
+	})
+
+	chicken := netip.MustParseAddr("192.0.2.1")
+	goose := netip.MustParseAddr("192.0.2.2")
+
+	for i := 0; i < 2; i++ {
+		if err := guard.Allow(chicken); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := guard.Allow(chicken); !errors.Is(err, abuse.ErrRateLimited) {
+		t.Fatal(err)
+	}
+
+	if err := guard.Allow(goose); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := guard.Allow(goose); !errors.Is(err, abuse.ErrRateLimited) {
+		t.Fatal("prefix limit not applied", err)
+	}
+
+	if err := guard.Allow(netip.MustParseAddr("192.0.3.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := guard.Allow(netip.MustParseAddr("192.0.2.42")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBan(t *testing.T) {
+	t.Parallel()
+
+	guard := abuse.New(abuse.Config{BanAfter: 3, BanDuration: 100 * time.Millisecond})
+	chicken := netip.MustParseAddr("2001:db8::1")
+
+	for i := 0; i < 2; i++ {
+		if guard.Fail(chicken) {
+			t.Fatal("banned too early")
+		}
+	}
+
+	if !guard.Fail(chicken) {
+		t.Fatal("not banned")
+	}
+
+	if err := guard.Allow(chicken); !errors.Is(err, abuse.ErrBanned) {
+		t.Fatal(err)
+	}
+
+	if bans := guard.Bans(); len(bans) != 1 || bans[0].Addr != chicken || bans[0].Failures != 3 {
+		t.Fatal(bans)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if err := guard.Allow(chicken); err != nil {
+		t.Fatal(err)
+	}
+
+	if bans := guard.Bans(); len(bans) != 0 {
+		t.Fatal(bans)
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	t.Parallel()
+
+	guard := abuse.New(abuse.Config{MaxSessions: 3, MaxSessionsPerClient: 2})
+
+	release, err := guard.StartSession("chicken", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := guard.StartSession("chicken", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := guard.StartSession("chicken", false); !errors.Is(err, abuse.ErrSessionLimit) {
+		t.Fatal(err)
+	}
+
+	if _, err := guard.StartSession("goose", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := guard.StartSession("duck", false); !errors.Is(err, abuse.ErrSessionLimit) {
+		t.Fatal(err)
+	}
+
+	release()
+	release()
+
+	if _, err := guard.StartSession("duck", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionLimitReplace(t *testing.T) {
+	t.Parallel()
+
+	guard := abuse.New(abuse.Config{MaxSessions: 1, MaxSessionsPerClient: 1})
+
+	registry, err := session.New(session.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	old, replaced, err := registry.Start(ctx, "chicken", "a")
+	if err != nil || replaced != nil {
+		t.Fatal(err, replaced)
+	}
+
+	releaseOld, err := guard.StartSession("chicken", replaced != nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client reconnects from a new address while the guard still counts its stale session.
+	reconnect, replaced, err := registry.Start(ctx, "chicken", "b")
+	if err != nil || replaced != old {
+		t.Fatal(err, replaced)
+	}
+
+	release, err := guard.StartSession("chicken", replaced != nil)
+	if err != nil {
+		t.Fatalf("reconnect did not replace the old session: %v", err)
+	}
+
+	old.End()
+	releaseOld()
+
+	if _, err := guard.StartSession("chicken", false); !errors.Is(err, abuse.ErrSessionLimit) {
+		t.Fatal(err)
+	}
+
+	reconnect.End()
+	release()
+}
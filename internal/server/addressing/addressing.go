@@ -0,0 +1,311 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package addressing assigns tunnel addresses to clients out of address pools owned by the server.
+//
+// Addresses are derived from a hash of the client identity so a client gets the same address every time it connects
+// without the server having to keep state.
+package addressing
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"eqrx.net/wallhack/internal/netlink"
+)
+
+// maxAttempts is the number of hashed candidates tried before a pool counts as exhausted.
+const maxAttempts = 1024
+
+var (
+	// ErrExhausted indicates that no free address could be found for a client.
+	ErrExhausted = errors.New("address pool exhausted")
+	// ErrPool indicates that a pool is misconfigured.
+	ErrPool = errors.New("invalid address pool")
+)
+
+// Pool is an address pool clients get their address from.
+type Pool struct {
+	// Prefix is the prefix client addresses are taken from. Only IPv6 is supported.
+	Prefix netip.Prefix `yaml:"prefix"`
+	// Server is the address of the server within Prefix. Defaults to the first address after the prefix address.
+	Server netip.Addr `yaml:"server"`
+	// Routes are pushed to clients in addition to Prefix.
+	Routes []netip.Prefix `yaml:"routes"`
+	// Static assigns fixed addresses to client identities.
+	Static map[string]netip.Addr `yaml:"static"`
+}
+
+// Config contains the address pools of the server.
+type Config struct {
+	// Pool is used for all tuns that have no pool of their own. Unset means no address management.
+	Pool `yaml:",inline"`
+	// Tuns contains pools for specific tuns, keyed by tun name.
+	Tuns map[string]Pool `yaml:"tuns"`
+	// Tenants contains pools for the clients of specific tenants, keyed by tenant name. They take precedence over the
+	// pools of tuns, so clients of different tenants sharing a tun get addresses from their own pool.
+	Tenants map[string]Pool `yaml:"tenants"`
+}
+
+// Lease is an address assigned to a client.
+type Lease struct {
+	// Client is the configuration pushed to the client.
+	Client netlink.Settings
+	// Server is the configuration applied to the server side tun of the client.
+	Server netlink.Settings
+
+	key  string
+	addr netip.Addr
+	pool *pool
+}
+
+// Release returns the address to its pool.
+func (l *Lease) Release() { l.pool.release(l.key, l.addr) }
+
+// Allocator hands out leases from its pools.
+type Allocator struct {
+	fallback *pool
+	tuns     map[string]*pool
+	tenants  map[string]*pool
+}
+
+// New creates a new [Allocator] from cfg.
+func New(cfg Config) (*Allocator, error) {
+	allocator := &Allocator{tuns: map[string]*pool{}, tenants: map[string]*pool{}}
+
+	if cfg.Pool.Prefix.IsValid() {
+		fallback, err := newPool(cfg.Pool)
+		if err != nil {
+			return nil, fmt.Errorf("new address allocator: %w", err)
+		}
+
+		allocator.fallback = fallback
+	}
+
+	for tun, poolCfg := range cfg.Tuns {
+		pool, err := newPool(poolCfg)
+		if err != nil {
+			return nil, fmt.Errorf("new address allocator: tun %s: %w", tun, err)
+		}
+
+		allocator.tuns[tun] = pool
+	}
+
+	for tenant, poolCfg := range cfg.Tenants {
+		pool, err := newPool(poolCfg)
+		if err != nil {
+			return nil, fmt.Errorf("new address allocator: tenant %s: %w", tenant, err)
+		}
+
+		allocator.tenants[tenant] = pool
+	}
+
+	return allocator, nil
+}
+
+// Lease assigns an address to the client session identified by key of the tenant called tenant that is bridged to
+// the tun named tunName. Returns nil if no pool is responsible for the tenant or the tun.
+func (a *Allocator) Lease(key, tenant, tunName string) (*Lease, error) {
+	pool, ok := a.tenants[tenant]
+	if !ok {
+		pool = a.tunPool(tunName)
+	}
+
+	if pool == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	lease, err := pool.lease(key)
+	if err != nil {
+		return nil, fmt.Errorf("lease: %w", err)
+	}
+
+	return lease, nil
+}
+
+// Shared returns the configuration of a tun that is shared by all clients, so the pool responsible for tunName and
+// the pools of all tenants. The server addresses get the prefix length of their pool so the whole pools are routed
+// over the tun. Returns false if no pool is responsible for the tun.
+func (a *Allocator) Shared(tunName string) (netlink.Settings, bool) {
+	pools := []*pool{}
+
+	if pool := a.tunPool(tunName); pool != nil {
+		pools = append(pools, pool)
+	}
+
+	names := make([]string, 0, len(a.tenants))
+	for name := range a.tenants {
+		names = append(names, name)
+	}
+
+	// Sorted so the tun gets its addresses in the same order every time.
+	sort.Strings(names)
+
+	for _, name := range names {
+		pools = append(pools, a.tenants[name])
+	}
+
+	if len(pools) == 0 {
+		return netlink.Settings{}, false
+	}
+
+	settings := netlink.Settings{}
+
+	for _, pool := range pools {
+		settings.Addresses = append(settings.Addresses, netip.PrefixFrom(pool.cfg.Server, pool.cfg.Prefix.Bits()))
+	}
+
+	return settings, true
+}
+
+// tunPool returns the pool responsible for the tun named tunName or nil if there is none.
+func (a *Allocator) tunPool(tunName string) *pool {
+	if pool, ok := a.tuns[tunName]; ok {
+		return pool
+	}
+
+	return a.fallback
+}
+
+// pool is the runtime state of a [Pool].
+type pool struct {
+	cfg      Pool
+	mtx      sync.Mutex
+	leased   map[netip.Addr]string
+	refs     map[string]int
+	reserved map[netip.Addr]string
+}
+
+func newPool(cfg Pool) (*pool, error) {
+	if !cfg.Prefix.Addr().Is6() || cfg.Prefix.Addr().Is4In6() {
+		return nil, fmt.Errorf("%w: %s is no IPv6 prefix", ErrPool, cfg.Prefix)
+	}
+
+	cfg.Prefix = cfg.Prefix.Masked()
+
+	if !cfg.Server.IsValid() {
+		cfg.Server = cfg.Prefix.Addr().Next()
+	}
+
+	if !cfg.Prefix.Contains(cfg.Server) {
+		return nil, fmt.Errorf("%w: server address %s not in %s", ErrPool, cfg.Server, cfg.Prefix)
+	}
+
+	reserved := map[netip.Addr]string{}
+
+	for key, addr := range cfg.Static {
+		if !cfg.Prefix.Contains(addr) || addr == cfg.Server {
+			return nil, fmt.Errorf("%w: static address %s of %q not usable", ErrPool, addr, key)
+		}
+
+		reserved[addr] = key
+	}
+
+	return &pool{cfg, sync.Mutex{}, map[netip.Addr]string{}, map[string]int{}, reserved}, nil
+}
+
+func (p *pool) lease(key string) (*Lease, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	addr, err := p.pick(key)
+	if err != nil {
+		return nil, err
+	}
+
+	p.leased[addr] = key
+	p.refs[key]++
+
+	return &Lease{
+		Client: netlink.Settings{
+			Addresses: []netip.Prefix{netip.PrefixFrom(addr, p.cfg.Prefix.Bits())},
+			Routes:    p.cfg.Routes,
+		},
+		Server: netlink.Settings{
+			Addresses: []netip.Prefix{netip.PrefixFrom(p.cfg.Server, p.cfg.Server.BitLen())},
+			Routes:    []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())},
+		},
+		key:  key,
+		addr: addr,
+		pool: p,
+	}, nil
+}
+
+// pick returns the address for key. Must be called with the lock held.
+func (p *pool) pick(key string) (netip.Addr, error) {
+	if addr, ok := p.cfg.Static[key]; ok {
+		return addr, nil
+	}
+
+	for attempt := uint32(0); attempt < maxAttempts; attempt++ {
+		addr := p.candidate(key, attempt)
+
+		if owner, ok := p.leased[addr]; ok && owner != key {
+			continue
+		}
+
+		if _, ok := p.reserved[addr]; ok || addr == p.cfg.Server || addr == p.cfg.Prefix.Addr() {
+			continue
+		}
+
+		return addr, nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("%w: %s", ErrExhausted, p.cfg.Prefix)
+}
+
+// candidate derives an address for key by putting a hash of key and attempt into the host bits of the pool prefix.
+func (p *pool) candidate(key string, attempt uint32) netip.Addr {
+	input := make([]byte, 4, 4+len(key))
+	binary.BigEndian.PutUint32(input, attempt)
+	sum := sha256.Sum256(append(input, key...))
+
+	addr := p.cfg.Prefix.Addr().As16()
+	bits := p.cfg.Prefix.Bits()
+
+	for i := range addr {
+		hostMask := byte(0xff)
+
+		switch {
+		case (i+1)*8 <= bits:
+			hostMask = 0
+		case i*8 < bits:
+			hostMask = 0xff >> (bits - i*8)
+		}
+
+		addr[i] |= sum[i] & hostMask
+	}
+
+	return netip.AddrFrom16(addr)
+}
+
+func (p *pool) release(key string, addr netip.Addr) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.refs[key]--
+	if p.refs[key] > 0 {
+		return
+	}
+
+	delete(p.refs, key)
+
+	if p.leased[addr] == key {
+		delete(p.leased, addr)
+	}
+}
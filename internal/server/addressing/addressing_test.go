@@ -0,0 +1,182 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package addressing_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"eqrx.net/wallhack/internal/server/addressing"
+)
+
+func allocator(t *testing.T, cfg addressing.Config) *addressing.Allocator {
+	t.Helper()
+
+	allocator, err := addressing.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return allocator
+}
+
+func lease(t *testing.T, allocator *addressing.Allocator, key, tun string) *addressing.Lease {
+	t.Helper()
+
+	return tenantLease(t, allocator, key, "", tun)
+}
+
+func tenantLease(t *testing.T, allocator *addressing.Allocator, key, tenant, tun string) *addressing.Lease {
+	t.Helper()
+
+	lease, err := allocator.Lease(key, tenant, tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lease
+}
+
+func TestNoPool(t *testing.T) {
+	t.Parallel()
+
+	if lease := lease(t, allocator(t, addressing.Config{}), "chicken", "chicken"); lease != nil {
+		t.Fatal(lease)
+	}
+}
+
+func TestStable(t *testing.T) {
+	t.Parallel()
+
+	prefix := netip.MustParsePrefix("fd0d:5619:c605::/64")
+	pool := addressing.Pool{Prefix: prefix}
+	first := lease(t, allocator(t, addressing.Config{Pool: pool}), "chicken", "chicken")
+	second := lease(t, allocator(t, addressing.Config{Pool: pool}), "chicken", "chicken")
+
+	if first.Client.Addresses[0] != second.Client.Addresses[0] {
+		t.Fatalf("address not stable: %s, %s", first.Client.Addresses[0], second.Client.Addresses[0])
+	}
+
+	if !prefix.Contains(first.Client.Addresses[0].Addr()) || first.Client.Addresses[0].Bits() != prefix.Bits() {
+		t.Fatal(first.Client.Addresses[0])
+	}
+
+	if server := first.Server.Addresses[0]; server != netip.MustParsePrefix("fd0d:5619:c605::1/128") {
+		t.Fatal(server)
+	}
+
+	if route := first.Server.Routes[0]; route.Addr() != first.Client.Addresses[0].Addr() || route.Bits() != 128 {
+		t.Fatal(route)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	t.Parallel()
+
+	allocator := allocator(t, addressing.Config{Pool: addressing.Pool{Prefix: netip.MustParsePrefix("fd00::/124")}})
+	seen := map[netip.Addr]bool{}
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n"} {
+		addr := lease(t, allocator, key, "tun").Client.Addresses[0].Addr()
+		if seen[addr] {
+			t.Fatalf("%s assigned twice", addr)
+		}
+
+		if addr == netip.MustParseAddr("fd00::") || addr == netip.MustParseAddr("fd00::1") {
+			t.Fatalf("reserved address %s assigned", addr)
+		}
+
+		seen[addr] = true
+	}
+}
+
+func TestRelease(t *testing.T) {
+	t.Parallel()
+
+	allocator := allocator(t, addressing.Config{Pool: addressing.Pool{Prefix: netip.MustParsePrefix("fd00::/126")}})
+
+	first := lease(t, allocator, "a", "tun")
+	_ = lease(t, allocator, "b", "tun")
+
+	if _, err := allocator.Lease("c", "", "tun"); !errors.Is(err, addressing.ErrExhausted) {
+		t.Fatal(err)
+	}
+
+	first.Release()
+
+	_ = lease(t, allocator, "c", "tun")
+}
+
+func TestStaticAndTunPools(t *testing.T) {
+	t.Parallel()
+
+	static := netip.MustParseAddr("fd00::42")
+	allocator := allocator(t, addressing.Config{
+		Pool: addressing.Pool{Prefix: netip.MustParsePrefix("fd00::/64"), Static: map[string]netip.Addr{"chicken": static}},
+		Tuns: map[string]addressing.Pool{"goose": {Prefix: netip.MustParsePrefix("fd01::/64")}},
+	})
+
+	if addr := lease(t, allocator, "chicken", "chicken").Client.Addresses[0].Addr(); addr != static {
+		t.Fatal(addr)
+	}
+
+	addr := lease(t, allocator, "goose", "goose").Client.Addresses[0].Addr()
+	if !netip.MustParsePrefix("fd01::/64").Contains(addr) {
+		t.Fatal(addr)
+	}
+}
+
+func TestTenantPools(t *testing.T) {
+	t.Parallel()
+
+	acme, initech := netip.MustParsePrefix("fd02::/64"), netip.MustParsePrefix("fd03::/64")
+	allocator := allocator(t, addressing.Config{
+		Pool: addressing.Pool{Prefix: netip.MustParsePrefix("fd00::/64")},
+		Tuns: map[string]addressing.Pool{"hub": {Prefix: netip.MustParsePrefix("fd01::/64")}},
+		Tenants: map[string]addressing.Pool{
+			"acme":    {Prefix: acme},
+			"initech": {Prefix: initech, Static: map[string]netip.Addr{"initech/chicken": netip.MustParseAddr("fd03::42")}},
+		},
+	})
+
+	// Clients of both tenants share the tun hub but get addresses from the pool of their tenant.
+	if addr := tenantLease(t, allocator, "acme/chicken", "acme", "hub").Client.Addresses[0].Addr(); !acme.Contains(addr) {
+		t.Fatal(addr)
+	}
+
+	addr := tenantLease(t, allocator, "initech/chicken", "initech", "hub").Client.Addresses[0].Addr()
+	if addr != netip.MustParseAddr("fd03::42") {
+		t.Fatal(addr)
+	}
+
+	addr = tenantLease(t, allocator, "goose", "", "hub").Client.Addresses[0].Addr()
+	if !netip.MustParsePrefix("fd01::/64").Contains(addr) {
+		t.Fatal(addr)
+	}
+
+	shared, ok := allocator.Shared("hub")
+	if !ok || len(shared.Addresses) != 3 || shared.Addresses[1] != netip.MustParsePrefix("fd02::1/64") {
+		t.Fatalf("unexpected shared settings %+v", shared)
+	}
+}
+
+func TestIPv4Rejected(t *testing.T) {
+	t.Parallel()
+
+	_, err := addressing.New(addressing.Config{Pool: addressing.Pool{Prefix: netip.MustParsePrefix("10.0.0.0/24")}})
+	if !errors.Is(err, addressing.ErrPool) {
+		t.Fatal(err)
+	}
+}
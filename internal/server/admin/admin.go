@@ -0,0 +1,157 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package admin exposes the state of the server as JSON over HTTP on a local unix socket and lets admins approve
+// enrollments of pinned keys.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"eqrx.net/rungroup"
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/listener"
+	"eqrx.net/wallhack/internal/server/tenant"
+	"github.com/go-logr/logr"
+)
+
+// readHeaderTimeout is the time clients get to send the request header.
+const readHeaderTimeout = 10 * time.Second
+
+// Config enables and configures the admin interface.
+type Config struct {
+	// Socket is the path of the unix socket the admin interface listens on. The admin interface is disabled if empty.
+	Socket string `yaml:"socket"`
+}
+
+// Enabled returns true if the admin interface is configured.
+func (c Config) Enabled() bool { return c.Socket != "" }
+
+// Admin serves the admin interface.
+type Admin struct {
+	socket   string
+	guard    *abuse.Guard
+	listener *listener.Listener
+	tenants  tenant.Set
+}
+
+// New creates a new [Admin] that reports the state of guard, listener and the enrollments of tenants.
+func New(cfg Config, guard *abuse.Guard, listener *listener.Listener, tenants tenant.Set) *Admin {
+	return &Admin{cfg.Socket, guard, listener, tenants}
+}
+
+// handler returns the HTTP handler of the admin interface.
+func (a *Admin) handler(log logr.Logger) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, _ *http.Request) {
+		respond(log, w, a.guard.Bans())
+	})
+	mux.HandleFunc("/handshakes", func(w http.ResponseWriter, _ *http.Request) {
+		respond(log, w, a.listener.HandshakeStats())
+	})
+	mux.HandleFunc("/enrollments", func(w http.ResponseWriter, _ *http.Request) {
+		respond(log, w, a.tenants.Pending())
+	})
+	mux.HandleFunc("/enrollments/approve", a.resolveEnrollment(log, a.tenants.Approve))
+	mux.HandleFunc("/enrollments/deny", a.resolveEnrollment(log, a.tenants.Deny))
+
+	return mux
+}
+
+// resolveEnrollment returns a handler that applies resolve to the enrollment named by the tenant and fingerprint
+// query parameters of POST requests.
+func (a *Admin) resolveEnrollment(
+	log logr.Logger, resolve func(tenant, fingerprint string) (bool, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		found, err := resolve(r.URL.Query().Get("tenant"), r.URL.Query().Get("fingerprint"))
+
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case !found:
+			http.Error(w, "no such enrollment", http.StatusNotFound)
+		default:
+			log.Info("resolved enrollment", "path", r.URL.Path, "fingerprint", r.URL.Query().Get("fingerprint"))
+			respond(log, w, a.tenants.Pending())
+		}
+	}
+}
+
+// respond writes value as JSON to w.
+func respond(log logr.Logger, w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.V(1).Info("write admin response", "err", err.Error())
+	}
+}
+
+// Serve listens on the configured socket and serves the admin interface until ctx is done. A stale socket left
+// behind by a previous run is removed first.
+func (a *Admin) Serve(ctx context.Context, log logr.Logger) error {
+	if err := os.Remove(a.socket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("admin: remove stale socket: %w", err)
+	}
+
+	socket, err := net.Listen("unix", a.socket)
+	if err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+
+	server := &http.Server{Handler: a.handler(log), ReadHeaderTimeout: readHeaderTimeout}
+
+	group := rungroup.New(ctx)
+
+	group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		if err := server.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+
+		return nil
+	})
+
+	group.Go(func(ctx context.Context) error {
+		err := server.Serve(socket)
+
+		switch {
+		case errors.Is(err, http.ErrServerClosed), errors.Is(err, net.ErrClosed):
+			return nil
+		default:
+			return fmt.Errorf("serve: %w", err)
+		}
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"eqrx.net/service"
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/addressing"
+	"eqrx.net/wallhack/internal/server/admin"
+	"eqrx.net/wallhack/internal/server/fallback"
+	"eqrx.net/wallhack/internal/server/hub"
+	"eqrx.net/wallhack/internal/server/identity"
+	"eqrx.net/wallhack/internal/server/listener"
+	"eqrx.net/wallhack/internal/server/pinning"
+	"eqrx.net/wallhack/internal/server/policy"
+	"eqrx.net/wallhack/internal/server/session"
+	"eqrx.net/wallhack/internal/server/tenant"
+	"eqrx.net/wallhack/internal/server/tuns"
+)
+
+// ConfigCredName is the name of the optional systemd credential that contains the YAML server configuration.
+const ConfigCredName = "config"
+
+// config is the optional configuration of the server. The zero value is a valid configuration that
+// reflects the default behavior.
+type config struct {
+	// TLS specifies where TLS material is loaded from.
+	TLS certs.Config `yaml:"tls"`
+	// Pins authenticates clients by their public key instead of the CA.
+	Pins pinning.Config `yaml:"pins"`
+	// Identity specifies how clients are identified and mapped to tuns.
+	Identity identity.Config `yaml:"identity"`
+	// Policy decides what clients may do based on their certificates.
+	Policy policy.Config `yaml:"policy"`
+	// Sessions specifies how clients with more than one connection are handled.
+	Sessions session.Config `yaml:"sessions"`
+	// TunPrefix is put in front of the tun names of the clients of the default tenant. Defaults to
+	// [tenant.DefaultTunPrefix] if there are other tenants and to no prefix otherwise.
+	TunPrefix *string `yaml:"tunPrefix"`
+	// Tenants are further client CAs, each with its own clients, tun names, policies and limits. The settings above
+	// form the default tenant.
+	Tenants []tenant.Config `yaml:"tenants"`
+	// Tuns specifies how the tuns of clients are opened and if they are created on demand.
+	Tuns tuns.Config `yaml:"tuns"`
+	// Addressing specifies the address pools clients get their tunnel addresses from.
+	Addressing addressing.Config `yaml:"addressing"`
+	// Hub lets all clients share one server tun.
+	Hub hub.Config `yaml:"hub"`
+	// Listener specifies how incoming connections are accepted.
+	Listener listener.Config `yaml:"listener"`
+	// Fallback serves connections that do not speak wallhack.
+	Fallback fallback.Config `yaml:"fallback"`
+	// Abuse limits how fast and how often clients may connect.
+	Abuse abuse.Config `yaml:"abuse"`
+	// Admin exposes the state of the server on a local socket.
+	Admin admin.Config `yaml:"admin"`
+}
+
+// loadConfig loads the server configuration from the systemd credential [ConfigCredName].
+// A missing credential results in the default configuration.
+func loadConfig(service *service.Service) (*config, error) {
+	cfg := &config{}
+
+	err := service.UnmarshalYAMLCred(ConfigCredName, cfg)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	return cfg, nil
+}
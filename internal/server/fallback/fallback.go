@@ -0,0 +1,181 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package fallback serves connections that do not speak wallhack so the server looks like an ordinary website. It
+// either proxies them to an upstream web server or serves a static directory.
+package fallback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"eqrx.net/rungroup"
+	"eqrx.net/wallhack/internal/server/upstream"
+	"github.com/go-logr/logr"
+)
+
+// readHeaderTimeout is the time clients get to send the request header when serving a static directory.
+const readHeaderTimeout = 10 * time.Second
+
+// ErrConfig indicates that the fallback is misconfigured.
+var ErrConfig = errors.New("invalid fallback config")
+
+// NextProtos are the ALPN protocols the fallback speaks.
+var NextProtos = []string{"http/1.1"} //nolint:gochecknoglobals
+
+// Config specifies where non-wallhack connections are sent to. Upstream and Root are mutually exclusive.
+// The fallback is disabled if neither is set.
+type Config struct {
+	// Upstream is the web server connections are proxied to, for example tcp:127.0.0.1:8080 or unix:/run/web.sock.
+	Upstream string `yaml:"upstream"`
+	// Root is a directory that is served as static website.
+	Root string `yaml:"root"`
+	// ProxyProtocol is the version of the PROXY protocol header sent to the upstream. 0 sends none.
+	ProxyProtocol int `yaml:"proxyProtocol"`
+}
+
+// Enabled returns true if a fallback is configured.
+func (c Config) Enabled() bool { return c.Upstream != "" || c.Root != "" }
+
+// Fallback serves non-wallhack connections.
+type Fallback struct {
+	upstream upstream.Upstream
+	root     string
+}
+
+// New creates a new [Fallback] from cfg.
+func New(cfg Config) (*Fallback, error) {
+	switch {
+	case cfg.Upstream != "" && cfg.Root != "":
+		return nil, fmt.Errorf("new fallback: %w: upstream and root are both set", ErrConfig)
+	case cfg.Root != "":
+		return &Fallback{root: cfg.Root}, nil
+	case cfg.Upstream != "":
+		upstream, err := upstream.Parse(cfg.Upstream)
+		if err == nil {
+			upstream, err = upstream.WithProxyProtocol(cfg.ProxyProtocol)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("new fallback: %w", err)
+		}
+
+		return &Fallback{upstream: upstream}, nil
+	default:
+		return nil, fmt.Errorf("new fallback: %w: neither upstream nor root set", ErrConfig)
+	}
+}
+
+// Serve serves connections accepted from listener until ctx is done or accepting fails.
+func (f *Fallback) Serve(ctx context.Context, log logr.Logger, listener net.Listener) error {
+	if f.root != "" {
+		return f.serveRoot(ctx, listener)
+	}
+
+	return f.serveUpstream(ctx, log, listener)
+}
+
+func (f *Fallback) serveRoot(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           http.FileServer(http.Dir(f.root)),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	group := rungroup.New(ctx)
+
+	group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		if err := server.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+
+		return nil
+	})
+
+	group.Go(func(ctx context.Context) error {
+		err := server.Serve(listener)
+
+		switch {
+		case errors.Is(err, http.ErrServerClosed), errors.Is(err, net.ErrClosed):
+			return nil
+		default:
+			return fmt.Errorf("serve root: %w", err)
+		}
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("fallback: %w", err)
+	}
+
+	return nil
+}
+
+func (f *Fallback) serveUpstream(ctx context.Context, log logr.Logger, listener net.Listener) error {
+	group := rungroup.New(ctx)
+
+	group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		if err := listener.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+
+		return nil
+	})
+
+	group.Go(func(ctx context.Context) error {
+		for {
+			conn, err := listener.Accept()
+
+			switch {
+			case err == nil:
+				group.Go(func(ctx context.Context) error {
+					f.proxy(ctx, log.WithValues("raddr", conn.RemoteAddr().String()), conn)
+
+					return nil
+				}, rungroup.NoCancelOnSuccess)
+			case errors.Is(err, net.ErrClosed):
+				return nil
+			default:
+				return fmt.Errorf("accept: %w", err)
+			}
+		}
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("fallback: %w", err)
+	}
+
+	return nil
+}
+
+// proxy splices conn to a new connection to the upstream.
+func (f *Fallback) proxy(ctx context.Context, log logr.Logger, conn net.Conn) {
+	upstreamConn, err := f.upstream.Dial(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+
+		log.Error(err, "proxy to fallback")
+
+		return
+	}
+
+	if err := upstream.Splice(ctx, conn, upstreamConn); err != nil {
+		log.V(1).Info("proxy to fallback ended", "err", err.Error())
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package hub lets all client sessions share a single server tun. Packets read from the tun are routed to the
+// session that owns the destination address, packets from sessions are written to the tun or, if relaying is
+// enabled, directly to the session owning the destination.
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"eqrx.net/rungroup"
+	"eqrx.net/wallhack/internal/bridge"
+	"eqrx.net/wallhack/internal/packet"
+)
+
+// defaultQueueLen is the number of packets queued per session if not configured otherwise.
+const defaultQueueLen = 256
+
+// ErrNoPrefix indicates that a session has no prefixes that could be routed to it.
+var ErrNoPrefix = errors.New("session has no routable prefixes")
+
+// Config enables and configures hub mode.
+type Config struct {
+	// Tun is the name of the tun shared by all sessions. Hub mode is disabled if empty.
+	Tun string `yaml:"tun"`
+	// Relay sends packets between clients directly instead of passing them through the kernel.
+	Relay bool `yaml:"relay"`
+	// Allowed contains prefixes routed to clients in addition to their assigned address, keyed by client identity.
+	Allowed map[string][]netip.Prefix `yaml:"allowed"`
+	// QueueLen is the number of packets queued for each session before packets get dropped.
+	QueueLen int `yaml:"queueLen"`
+}
+
+// Enabled returns true if hub mode is configured.
+func (c Config) Enabled() bool { return c.Tun != "" }
+
+// port is the attachment point of a session.
+type port struct {
+	queue    chan *packet.Packet
+	prefixes []netip.Prefix
+}
+
+// enqueue queues p for sending to the session. The packet is dropped if the queue is full.
+func (p *port) enqueue(pkt *packet.Packet) {
+	select {
+	case p.queue <- pkt:
+	default:
+	}
+}
+
+// owns returns true if addr is within one of the prefixes of the port.
+func (p *port) owns(addr netip.Addr) bool {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Hub routes packets between a shared tun and client sessions.
+type Hub struct {
+	tun      bridge.ReadWriteCloser
+	relay    bool
+	queueLen int
+	table    *Table[*port]
+}
+
+// New creates a new [Hub] on top of tun as configured by cfg.
+func New(cfg Config, tun bridge.ReadWriteCloser) *Hub {
+	queueLen := cfg.QueueLen
+	if queueLen <= 0 {
+		queueLen = defaultQueueLen
+	}
+
+	return &Hub{tun, cfg.Relay, queueLen, NewTable[*port]()}
+}
+
+// Run reads packets from the tun and hands them to the sessions owning their destination until ctx is done or
+// reading fails. Packets without owner are dropped.
+func (h *Hub) Run(ctx context.Context) error {
+	group := rungroup.New(ctx)
+
+	group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		if err := h.tun.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+
+		return nil
+	})
+
+	group.Go(func(ctx context.Context) error {
+		for {
+			pkt, err := h.tun.ReadPacket()
+
+			switch {
+			case err == nil:
+			case ctx.Err() != nil:
+				return nil
+			default:
+				return fmt.Errorf("read tun: %w", err)
+			}
+
+			if target, ok := h.table.Lookup(destination(pkt)); ok {
+				target.enqueue(clone(pkt))
+			}
+		}
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("hub: %w", err)
+	}
+
+	return nil
+}
+
+// Serve attaches the session behind conn to the hub and routes prefixes to it. Packets from the session are only
+// accepted if their source lies in prefixes. Blocks until ctx is done or conn fails and closes conn.
+func (h *Hub) Serve(ctx context.Context, conn bridge.ReadWriteCloser, prefixes []netip.Prefix) error {
+	if len(prefixes) == 0 {
+		_ = conn.Close()
+
+		return ErrNoPrefix
+	}
+
+	port := &port{make(chan *packet.Packet, h.queueLen), prefixes}
+
+	if err := h.table.Insert(prefixes, port); err != nil {
+		_ = conn.Close()
+
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	defer h.table.Remove(prefixes, port)
+
+	group := rungroup.New(ctx)
+
+	group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		if err := conn.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+
+		return nil
+	})
+	group.Go(func(_ context.Context) error { return h.fromSession(conn, port) })
+	group.Go(func(ctx context.Context) error { return toSession(ctx, conn, port) })
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	return nil
+}
+
+// fromSession reads packets from conn and routes them to the tun or other sessions.
+func (h *Hub) fromSession(conn bridge.Reader, port *port) error {
+	for {
+		pkt, err := conn.ReadPacket()
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+
+		if !port.owns(source(pkt)) {
+			continue
+		}
+
+		if h.relay {
+			if target, ok := h.table.Lookup(destination(pkt)); ok && target != port {
+				target.enqueue(clone(pkt))
+
+				continue
+			}
+		}
+
+		if err := h.tun.WritePacket(pkt); err != nil {
+			return fmt.Errorf("write tun: %w", err)
+		}
+	}
+}
+
+// toSession writes queued packets to conn until ctx is done.
+func toSession(ctx context.Context, conn bridge.Writer, port *port) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pkt := <-port.queue:
+			if err := conn.WritePacket(pkt); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+
+				return fmt.Errorf("write: %w", err)
+			}
+		}
+	}
+}
+
+func source(pkt *packet.Packet) netip.Addr {
+	addr, _ := netip.AddrFromSlice(pkt.Header.Src)
+
+	return addr
+}
+
+func destination(pkt *packet.Packet) netip.Addr {
+	addr, _ := netip.AddrFromSlice(pkt.Header.Dst)
+
+	return addr
+}
+
+// clone copies pkt so it stays valid after the reader it came from reuses its buffer.
+func clone(pkt *packet.Packet) *packet.Packet {
+	return &packet.Packet{Header: pkt.Header, Marshalled: append([]byte{}, pkt.Marshalled...)}
+}
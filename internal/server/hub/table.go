@@ -0,0 +1,106 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// ErrConflict indicates that a prefix is already routed to another session.
+var ErrConflict = errors.New("prefix already routed to another session")
+
+// Table is a longest prefix match routing table.
+type Table[T comparable] struct {
+	mtx    sync.RWMutex
+	routes map[int]map[netip.Prefix]T
+	lens   []int
+}
+
+// NewTable creates a new empty [Table].
+func NewTable[T comparable]() *Table[T] {
+	return &Table[T]{routes: map[int]map[netip.Prefix]T{}}
+}
+
+// Insert routes all prefixes to target. Either all or none of the prefixes are inserted.
+// Returns [ErrConflict] if one of the prefixes is already routed somewhere else.
+func (t *Table[T]) Insert(prefixes []netip.Prefix, target T) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		if existing, ok := t.routes[prefix.Bits()][prefix]; ok && existing != target {
+			return fmt.Errorf("insert: %w: %s", ErrConflict, prefix)
+		}
+	}
+
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+
+		byLen, ok := t.routes[prefix.Bits()]
+		if !ok {
+			byLen = map[netip.Prefix]T{}
+			t.routes[prefix.Bits()] = byLen
+			t.lens = append(t.lens, prefix.Bits())
+			sort.Sort(sort.Reverse(sort.IntSlice(t.lens)))
+		}
+
+		byLen[prefix] = target
+	}
+
+	return nil
+}
+
+// Remove removes the routes of all prefixes that point to target.
+func (t *Table[T]) Remove(prefixes []netip.Prefix, target T) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		if existing, ok := t.routes[prefix.Bits()][prefix]; ok && existing == target {
+			delete(t.routes[prefix.Bits()], prefix)
+		}
+	}
+}
+
+// Lookup returns the target of the most specific prefix that contains addr.
+func (t *Table[T]) Lookup(addr netip.Addr) (T, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	for _, bits := range t.lens {
+		byLen := t.routes[bits]
+		if len(byLen) == 0 {
+			continue
+		}
+
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+
+		if target, ok := byLen[prefix]; ok {
+			return target, true
+		}
+	}
+
+	var zero T
+
+	return zero, false
+}
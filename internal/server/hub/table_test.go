@@ -0,0 +1,99 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package hub_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"eqrx.net/wallhack/internal/server/hub"
+)
+
+func prefixes(strs ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(strs))
+	for _, str := range strs {
+		prefixes = append(prefixes, netip.MustParsePrefix(str))
+	}
+
+	return prefixes
+}
+
+func TestLongestMatch(t *testing.T) {
+	t.Parallel()
+
+	table := hub.NewTable[string]()
+
+	if err := table.Insert(prefixes("fd00::/64"), "chicken"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := table.Insert(prefixes("fd00::42/128", "fd01::/48"), "goose"); err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, expected := range map[string]string{
+		"fd00::41":   "chicken",
+		"fd00::42":   "goose",
+		"fd01:0:0::": "goose",
+	} {
+		if target, ok := table.Lookup(netip.MustParseAddr(addr)); !ok || target != expected {
+			t.Fatalf("%s routed to %q", addr, target)
+		}
+	}
+
+	if target, ok := table.Lookup(netip.MustParseAddr("fd02::1")); ok {
+		t.Fatalf("unrouted address routed to %q", target)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	t.Parallel()
+
+	table := hub.NewTable[string]()
+
+	if err := table.Insert(prefixes("fd00::/64"), "chicken"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := table.Insert(prefixes("fd01::/64", "fd00::1/64"), "goose"); !errors.Is(err, hub.ErrConflict) {
+		t.Fatal(err)
+	}
+
+	if _, ok := table.Lookup(netip.MustParseAddr("fd01::1")); ok {
+		t.Fatal("partial insert")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	t.Parallel()
+
+	table := hub.NewTable[string]()
+
+	if err := table.Insert(prefixes("fd00::/64"), "chicken"); err != nil {
+		t.Fatal(err)
+	}
+
+	table.Remove(prefixes("fd00::/64"), "goose")
+
+	if _, ok := table.Lookup(netip.MustParseAddr("fd00::1")); !ok {
+		t.Fatal("route of other target removed")
+	}
+
+	table.Remove(prefixes("fd00::/64"), "chicken")
+
+	if _, ok := table.Lookup(netip.MustParseAddr("fd00::1")); ok {
+		t.Fatal("route not removed")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package identity extracts the identity of wallhack clients from their certificates and maps it to the name of the
+// tun device the client is bridged to.
+package identity
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"eqrx.net/wallhack/internal/netns"
+	"eqrx.net/wallhack/internal/tun"
+)
+
+// Source names the certificate field the identity of a client is taken from.
+type Source string
+
+const (
+	// SourceCommonName takes the identity from the subject common name. This is the default.
+	SourceCommonName Source = "cn"
+	// SourceDNS takes the identity from the first DNS SAN.
+	SourceDNS Source = "dns"
+	// SourceURI takes the identity from the first URI SAN, for example a SPIFFE ID.
+	SourceURI Source = "uri"
+	// SourceEmail takes the identity from the first email SAN.
+	SourceEmail Source = "email"
+
+	// HashPrefix is put in front of hashed tun names so they are recognizable as such.
+	HashPrefix = "wh"
+)
+
+var (
+	// ErrNoIdentity indicates that the client certificate does not contain the configured identity field.
+	ErrNoIdentity = errors.New("certificate carries no identity")
+	// ErrUnknown indicates that the identity is not listed in the mapping table while strict mapping is requested.
+	ErrUnknown = errors.New("unknown identity")
+	// ErrSource indicates that the configured identity source is not supported.
+	ErrSource = errors.New("unsupported identity source")
+)
+
+// Config specifies how clients are identified and how identities are mapped to tun names.
+type Config struct {
+	// Source is the certificate field that holds the identity. Defaults to [SourceCommonName].
+	Source Source `yaml:"source"`
+	// Map maps identities to tun names. Takes precedence over Template.
+	Map map[string]string `yaml:"map"`
+	// Template is a text/template that renders the tun name of identities not listed in Map.
+	// It gets passed the identity as dot. Defaults to the identity itself.
+	Template string `yaml:"template"`
+	// Strict rejects all identities that are not listed in Map.
+	Strict bool `yaml:"strict"`
+	// Namespaces maps identities to named network namespaces (see [netns.Dir]) their tun lives in. Tuns of
+	// identities not listed here live in the namespace of wallhack.
+	Namespaces map[string]string `yaml:"namespaces"`
+}
+
+// Resolver extracts identities from certificates and maps them to tun names.
+type Resolver struct {
+	source     Source
+	mapping    map[string]string
+	template   *template.Template
+	strict     bool
+	namespaces map[string]string
+}
+
+// New creates a new [Resolver] from the given config.
+func New(cfg Config) (*Resolver, error) {
+	source := cfg.Source
+	if source == "" {
+		source = SourceCommonName
+	}
+
+	switch source {
+	case SourceCommonName, SourceDNS, SourceURI, SourceEmail:
+	default:
+		return nil, fmt.Errorf("new identity resolver: %w: %q", ErrSource, source)
+	}
+
+	for id, name := range cfg.Map {
+		if err := tun.ValidName(name); err != nil {
+			return nil, fmt.Errorf("new identity resolver: mapping for %q: %w", id, err)
+		}
+	}
+
+	for id, name := range cfg.Namespaces {
+		if err := netns.ValidName(name); err != nil {
+			return nil, fmt.Errorf("new identity resolver: namespace for %q: %w", id, err)
+		}
+	}
+
+	resolver := &Resolver{source, cfg.Map, nil, cfg.Strict, cfg.Namespaces}
+
+	if cfg.Template != "" {
+		tmpl, err := template.New("tun").Option("missingkey=error").Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("new identity resolver: %w", err)
+		}
+
+		resolver.template = tmpl
+	}
+
+	return resolver, nil
+}
+
+// Identity extracts the identity from the given certificate.
+func (r *Resolver) Identity(cert *x509.Certificate) (string, error) {
+	var identity string
+
+	switch r.source {
+	case SourceCommonName:
+		identity = cert.Subject.CommonName
+	case SourceDNS:
+		if len(cert.DNSNames) != 0 {
+			identity = cert.DNSNames[0]
+		}
+	case SourceURI:
+		if len(cert.URIs) != 0 {
+			identity = cert.URIs[0].String()
+		}
+	case SourceEmail:
+		if len(cert.EmailAddresses) != 0 {
+			identity = cert.EmailAddresses[0]
+		}
+	}
+
+	if identity == "" {
+		return "", fmt.Errorf("identity: %w: %s", ErrNoIdentity, r.source)
+	}
+
+	return identity, nil
+}
+
+// TunName maps the given identity to the name of a tun device. Names that are no valid interface names are replaced
+// by a hash of the identity. Returns [ErrUnknown] if the identity is not mapped and strict mapping is configured.
+func (r *Resolver) TunName(identity string) (string, error) {
+	if name, ok := r.mapping[identity]; ok {
+		return name, nil
+	}
+
+	if r.strict {
+		return "", fmt.Errorf("tun name: %w: %q", ErrUnknown, identity)
+	}
+
+	name := identity
+
+	if r.template != nil {
+		rendered := &strings.Builder{}
+		if err := r.template.Execute(rendered, identity); err != nil {
+			return "", fmt.Errorf("tun name: %w", err)
+		}
+
+		name = rendered.String()
+	}
+
+	if tun.ValidName(name) != nil {
+		return Hashed(identity), nil
+	}
+
+	return name, nil
+}
+
+// Namespace returns the name of the network namespace the tun of identity lives in. Empty means the namespace of
+// wallhack.
+func (r *Resolver) Namespace(identity string) string { return r.namespaces[identity] }
+
+// Resolve extracts the identity from cert and maps it to a tun name.
+func (r *Resolver) Resolve(cert *x509.Certificate) (identity, tunName string, err error) {
+	identity, err = r.Identity(cert)
+	if err != nil {
+		return "", "", fmt.Errorf("resolve: %w", err)
+	}
+
+	tunName, err = r.TunName(identity)
+	if err != nil {
+		return "", "", fmt.Errorf("resolve: %w", err)
+	}
+
+	return identity, tunName, nil
+}
+
+// Hashed returns a deterministic tun name for identity that is always a valid interface name.
+func Hashed(identity string) string {
+	sum := sha256.Sum256([]byte(identity))
+
+	return HashPrefix + hex.EncodeToString(sum[:])[:tun.IfaceNameMaxLen-1-len(HashPrefix)]
+}
+
+// Slot returns the tun name for the parallel session slot of a client whose first session uses name.
+// Slot zero uses name itself, other slots append their index. Names that get too long are hashed.
+func Slot(name string, slot int) string {
+	if slot == 0 {
+		return name
+	}
+
+	slotted := fmt.Sprintf("%s-%d", name, slot)
+	if tun.ValidName(slotted) != nil {
+		return Hashed(slotted)
+	}
+
+	return slotted
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package identity_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/url"
+	"testing"
+
+	"eqrx.net/wallhack/internal/netns"
+	"eqrx.net/wallhack/internal/server/identity"
+	"eqrx.net/wallhack/internal/tun"
+)
+
+func cert(t *testing.T) *x509.Certificate {
+	t.Helper()
+
+	uri, err := url.Parse("spiffe://example.org/host/laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "chicken"},
+		DNSNames:       []string{"laptop.example.org"},
+		URIs:           []*url.URL{uri},
+		EmailAddresses: []string{"me@example.org"},
+	}
+}
+
+func TestSources(t *testing.T) {
+	t.Parallel()
+
+	for source, want := range map[identity.Source]string{
+		"":                        "chicken",
+		identity.SourceCommonName: "chicken",
+		identity.SourceDNS:        "laptop.example.org",
+		identity.SourceURI:        "spiffe://example.org/host/laptop",
+		identity.SourceEmail:      "me@example.org",
+	} {
+		resolver, err := identity.New(identity.Config{Source: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have, err := resolver.Identity(cert(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have != want {
+			t.Fatalf("source %q: want %q, have %q", source, want, have)
+		}
+	}
+}
+
+func TestNoIdentity(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := identity.New(identity.Config{Source: identity.SourceDNS})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolver.Identity(&x509.Certificate{}); !errors.Is(err, identity.ErrNoIdentity) {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidSource(t *testing.T) {
+	t.Parallel()
+
+	if _, err := identity.New(identity.Config{Source: "serial"}); !errors.Is(err, identity.ErrSource) {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidMapping(t *testing.T) {
+	t.Parallel()
+
+	_, err := identity.New(identity.Config{Map: map[string]string{"chicken": "way-too-long-for-a-tun"}})
+	if !errors.Is(err, tun.ErrName) {
+		t.Fatal(err)
+	}
+}
+
+func TestTunName(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := identity.New(identity.Config{
+		Map:      map[string]string{"spiffe://example.org/host/laptop": "laptop"},
+		Template: "c-{{.}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]string{
+		"spiffe://example.org/host/laptop": "laptop",
+		"chicken":                          "c-chicken",
+		"spiffe://example.org/host/phone":  identity.Hashed("spiffe://example.org/host/phone"),
+		"a-very-long-name":                 identity.Hashed("a-very-long-name"),
+	} {
+		have, err := resolver.TunName(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have != want {
+			t.Fatalf("%q: want %q, have %q", id, want, have)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	t.Parallel()
+
+	resolver, err := identity.New(identity.Config{Map: map[string]string{"chicken": "chicken"}, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolver.TunName("goose"); !errors.Is(err, identity.ErrUnknown) {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	t.Parallel()
+
+	_, err := identity.New(identity.Config{Namespaces: map[string]string{"chicken": "../host"}})
+	if !errors.Is(err, netns.ErrName) {
+		t.Fatal(err)
+	}
+
+	resolver, err := identity.New(identity.Config{Namespaces: map[string]string{"chicken": "coop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have := resolver.Namespace("chicken"); have != "coop" {
+		t.Fatalf("expected namespace coop, got %q", have)
+	}
+
+	if have := resolver.Namespace("goose"); have != "" {
+		t.Fatalf("expected no namespace, got %q", have)
+	}
+}
+
+func TestHashed(t *testing.T) {
+	t.Parallel()
+
+	name := identity.Hashed("spiffe://example.org/host/laptop")
+	if err := tun.ValidName(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if name != identity.Hashed("spiffe://example.org/host/laptop") {
+		t.Fatal("hash not deterministic")
+	}
+
+	if name == identity.Hashed("spiffe://example.org/host/phone") {
+		t.Fatal("hash collision")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package listener
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// peekConn is a connection whose first bytes were already read for sniffing or parsing a PROXY protocol header.
+type peekConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// remote overrides the remote address of the connection if set.
+	remote net.Addr
+}
+
+// peek wraps conn into a [peekConn] unless it already is one.
+func peek(conn net.Conn) *peekConn {
+	if peeked, ok := conn.(*peekConn); ok {
+		return peeked
+	}
+
+	return &peekConn{conn, bufio.NewReader(conn), nil}
+}
+
+func (c *peekConn) Read(b []byte) (int, error) { return c.reader.Read(b) } //nolint:wrapcheck
+
+// RemoteAddr returns the address of the original client if the connection came through a proxy.
+func (c *peekConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half closes the connection if the underlying connection supports it and closes it otherwise.
+func (c *peekConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite() //nolint:wrapcheck
+	}
+
+	return c.Conn.Close() //nolint:wrapcheck
+}
+
+// watch interrupts blocked reads on conn once ctx is done. The returned function stops watching and clears the read
+// deadline of conn.
+func watch(ctx context.Context, conn net.Conn) func() {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -11,58 +11,178 @@
 // You should have received a copy of the GNU Affero General Public License along with this program.
 // If not, see <https://www.gnu.org/licenses/>.
 
-// Package listener handles TLS ALPN routing magic.
+// Package listener handles TLS SNI and ALPN routing magic.
 package listener
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 )
 
+const (
+	// defaultHandshakeTimeout is the time clients get to complete the TLS handshake if not configured otherwise.
+	defaultHandshakeTimeout = 10 * time.Second
+	// defaultMaxHandshakes is the number of concurrent handshakes if not configured otherwise.
+	defaultMaxHandshakes = 64
+	// defaultSilentTimeout is the time a client may stay silent before it is handed to the silent protocol if not
+	// configured otherwise.
+	defaultSilentTimeout = 2 * time.Second
+)
+
+// ErrAction indicates that a configured action can not be used.
+var ErrAction = errors.New("invalid action")
+
+// Action decides what happens to connections.
+type Action string
+
+const (
+	// ActionWallhack hands connections to wallhack.
+	ActionWallhack Action = "wallhack"
+	// ActionPlugin hands connections to the first plugin. Use "plugin:<name>" to pick a specific plugin.
+	ActionPlugin Action = "plugin"
+	// ActionFallback hands connections to the built-in fallback.
+	ActionFallback Action = "fallback"
+	// ActionClose closes connections.
+	ActionClose Action = "close"
+)
+
+// Config contains the settings of the listener.
+type Config struct {
+	// HandshakeTimeout is the time clients get to complete the TLS handshake.
+	HandshakeTimeout time.Duration `yaml:"handshakeTimeout"`
+	// MaxHandshakes is the number of TLS handshakes that may be in flight at the same time. Accepting new connections
+	// pauses while the limit is reached.
+	MaxHandshakes int `yaml:"maxHandshakes"`
+	// Default is the action for connections that match no route and do not offer a wallhack protocol. Defaults to
+	// [ActionPlugin] if a plugin is loaded, to [ActionFallback] if a fallback is configured and to [ActionClose]
+	// otherwise.
+	Default Action `yaml:"default"`
+	// Routes are checked in order before the default routing applies. The first matching route wins.
+	Routes []Route `yaml:"routes"`
+	// Protocols are non-TLS protocols that share the port. Connections are sniffed only if this is set.
+	Protocols []Protocol `yaml:"protocols"`
+	// Silent is the name of the protocol clients are handed to if they send nothing at all for SilentTimeout, for
+	// example ssh clients that wait for the server to speak first.
+	Silent string `yaml:"silent"`
+	// SilentTimeout is the time a client may stay silent before it is handed to the silent protocol.
+	SilentTimeout time.Duration `yaml:"silentTimeout"`
+	// TrustedProxies contains the addresses of proxies in front of the listener. Connections from them have to start
+	// with a PROXY protocol header, its client address is then used as remote address of the connection.
+	TrustedProxies []netip.Prefix `yaml:"trustedProxies"`
+}
+
+// Gate decides whether connections from a client address are accepted and learns about clients that fail.
+type Gate interface {
+	// Allow returns an error if connections from addr are not accepted right now.
+	Allow(addr netip.Addr) error
+	// Fail records a failure of addr and returns true if addr got banned because of it.
+	Fail(addr netip.Addr) bool
+}
+
 // Listener that sources connections from all given backends,
-// and routes TLS connection to wallhack and the plugin according to the ALPN
-// field of the client.
+// and routes TLS connection to wallhack, the plugin, the fallback and upstreams according to the SNI and ALPN
+// fields of the client.
 type Listener struct {
 	backends         []net.Listener
 	wallhackFrontend frontend
-	pluginFrontend   frontend
-	hasPlugin        bool
+	plugins          []*attached
+	fallbackFrontend frontend
+	routes           []*route
+	vetoed           *route
+	protocols        []*protocol
+	silent           *protocol
+	silentTimeout    time.Duration
+	trustedProxies   []netip.Prefix
+	gate             Gate
+	handshakeTimeout time.Duration
+	handshakeSlots   chan struct{}
+	statsMtx         sync.Mutex
+	stats            HandshakeStats
 }
 
 // WallhackListener returns the frontend listener for wallhack.
 func (l *Listener) WallhackListener() net.Listener { return l.wallhackFrontend }
 
-// PluginListener returns the frontend listener for the configured plugin.
-func (l *Listener) PluginListener() net.Listener { return l.pluginFrontend }
+// SetGate makes the listener consult gate for every new connection. Must be called before [Listener.Listen].
+func (l *Listener) SetGate(gate Gate) { l.gate = gate }
+
+// FallbackListener returns the frontend listener for the built-in fallback.
+func (l *Listener) FallbackListener() net.Listener { return l.fallbackFrontend }
 
 // New creates a new listener that sources connections from all given backends,
-// and routes TLS connection to wallhack and the plugin according to the ALPN
-// field of the client.
-func New(backends []net.Listener, wallhackCfg, pluginCfg *tls.Config) *Listener {
+// and routes TLS connection to wallhack, the plugin, the fallback and upstreams according to the SNI and ALPN
+// fields of the client. Plugins are asked about connections before routes apply. fallbackCfg is nil if there is no
+// fallback.
+func New(
+	cfg Config, backends []net.Listener, wallhackCfg *tls.Config, plugins []Plugin, fallbackCfg *tls.Config,
+) (*Listener, error) {
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	if cfg.MaxHandshakes <= 0 {
+		cfg.MaxHandshakes = defaultMaxHandshakes
+	}
+
+	if cfg.SilentTimeout <= 0 {
+		cfg.SilentTimeout = defaultSilentTimeout
+	}
+
+	switch {
+	case cfg.Default != "":
+	case len(plugins) > 0:
+		cfg.Default = ActionPlugin
+	case fallbackCfg != nil:
+		cfg.Default = ActionFallback
+	default:
+		cfg.Default = ActionClose
+	}
+
 	listener := &Listener{
-		make([]net.Listener, 0, len(backends)),
-		frontend{make(chan net.Conn), frontendAddr{"frontend for wallhack alpns"}},
-		frontend{make(chan net.Conn), frontendAddr{"frontend for plugin"}},
-		pluginCfg != nil,
+		backends:         backends,
+		wallhackFrontend: frontend{make(chan net.Conn), frontendAddr{"frontend for wallhack alpns"}},
+		fallbackFrontend: frontend{make(chan net.Conn), frontendAddr{"frontend for fallback"}},
+		handshakeTimeout: cfg.HandshakeTimeout,
+		handshakeSlots:   make(chan struct{}, cfg.MaxHandshakes),
+		silentTimeout:    cfg.SilentTimeout,
+		trustedProxies:   cfg.TrustedProxies,
+		vetoed:           &route{Route: Route{Backend: ActionClose}, reason: ReasonVetoed},
+	}
+
+	if err := listener.attach(plugins); err != nil {
+		return nil, fmt.Errorf("new listener: %w", err)
 	}
 
-	if listener.hasPlugin {
-		wallhackCfg.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
-			if chi.SupportedProtos != nil {
-				for _, proto := range chi.SupportedProtos {
-					if proto == "wallhack" {
-						return nil, nil //nolint: nilnil
-					}
-				}
-			}
-
-			return pluginCfg, nil
+	for _, p := range cfg.Protocols {
+		resolved, err := newProtocol(p)
+		if err != nil {
+			return nil, fmt.Errorf("new listener: %w", err)
+		}
+
+		listener.protocols = append(listener.protocols, resolved)
+
+		if p.Name == cfg.Silent {
+			listener.silent = resolved
 		}
 	}
 
-	for _, l := range backends {
-		listener.backends = append(listener.backends, tls.NewListener(l, wallhackCfg))
+	if cfg.Silent != "" && listener.silent == nil {
+		return nil, fmt.Errorf("new listener: %w: silent protocol %s not configured", ErrProtocol, cfg.Silent)
+	}
+
+	for i, r := range append(append([]Route{}, cfg.Routes...), defaultRoutes(cfg.Default)...) {
+		resolved, err := listener.newRoute(r, wallhackCfg, fallbackCfg)
+		if err != nil {
+			return nil, fmt.Errorf("new listener: route %d: %w", i, err)
+		}
+
+		listener.routes = append(listener.routes, resolved)
 	}
 
-	return listener
+	return listener, nil
 }
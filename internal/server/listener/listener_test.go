@@ -0,0 +1,547 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package listener_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"eqrx.net/wallhack/internal/proto"
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/listener"
+	"eqrx.net/wallhack/internal/server/proxyproto"
+	"eqrx.net/wallhack/internal/testpki"
+	"eqrx.net/wallhack/plugin"
+	"github.com/go-logr/logr"
+)
+
+func certificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	issued := testpki.Issue(t, "chicken", nil)
+
+	return tls.Certificate{Certificate: [][]byte{issued.Cert.Raw}, PrivateKey: issued.Key}
+}
+
+// listen starts a listener configured by cfg on a local port. The listener is stopped when the test ends.
+func listen(
+	t *testing.T, cfg listener.Config, cert tls.Certificate, fallbackCfg *tls.Config,
+) (*listener.Listener, string) {
+	t.Helper()
+
+	combo, addr := build(t, cfg, cert, fallbackCfg)
+	run(t, combo)
+
+	return combo, addr
+}
+
+// build creates a listener on a random local port without starting it.
+func build(
+	t *testing.T, cfg listener.Config, cert tls.Certificate, fallbackCfg *tls.Config, plugins ...listener.Plugin,
+) (*listener.Listener, string) {
+	t.Helper()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		NextProtos:   proto.NextProtos(),
+	}
+
+	combo, err := listener.New(cfg, []net.Listener{backend}, serverCfg, plugins, fallbackCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return combo, backend.Addr().String()
+}
+
+// run starts combo and stops it when the test is done.
+func run(t *testing.T, combo *listener.Listener) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() { done <- combo.Listen(ctx, logr.Discard()) }()
+
+	t.Cleanup(func() {
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+	}
+}
+
+func dial(t *testing.T, addr string, cert tls.Certificate, alpns ...string) *tls.Conn {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true, //nolint:gosec
+		NextProtos:         alpns,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func TestStalledHandshake(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	cfg := listener.Config{HandshakeTimeout: 200 * time.Millisecond, MaxHandshakes: 2}
+	combo, addr := listen(t, cfg, cert, nil)
+
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	_ = dial(t, addr, cert, proto.ALPN)
+
+	accepted, err := combo.WallhackListener().Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	if _, err := stalled.Read(make([]byte, 1)); err == nil {
+		t.Fatal("stalled conn not closed")
+	}
+
+	// The conn may be closed by the canceled handshake before the outcome is recorded.
+	waitFor(t, func() bool { return combo.HandshakeStats().Outcomes[listener.OutcomeTimedOut] != 0 })
+
+	stats := combo.HandshakeStats()
+	if stats.Outcomes[listener.OutcomeSucceeded] != 1 || stats.Outcomes[listener.OutcomeTimedOut] != 1 ||
+		stats.InFlight != 0 {
+		t.Fatal(stats)
+	}
+
+	if stats.Max < cfg.HandshakeTimeout {
+		t.Fatal(stats.Max)
+	}
+}
+
+func TestRejectForeignProtocol(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	combo, addr := listen(t, listener.Config{}, cert, nil)
+
+	clientCfg := &tls.Config{MinVersion: tls.VersionTLS13, InsecureSkipVerify: true} //nolint:gosec
+	if _, err := tls.Dial("tcp", addr, clientCfg); err == nil {
+		t.Fatal("foreign protocol accepted")
+	}
+
+	waitFor(t, func() bool { return combo.HandshakeStats().Rejections[listener.ReasonClosed] == 1 })
+
+	_ = dial(t, addr, cert, proto.ALPN)
+
+	accepted, err := combo.WallhackListener().Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = accepted.Close()
+}
+
+func TestFallback(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	fallbackCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}
+	combo, addr := listen(t, listener.Config{}, cert, fallbackCfg)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, //nolint:gosec
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "http/1.1" {
+		t.Fatal(protocol)
+	}
+
+	accepted, err := combo.FallbackListener().Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = accepted.Close()
+}
+
+// echo starts a TCP server that echos everything back and returns its address.
+func echo(t *testing.T) string {
+	t.Helper()
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = server.Close() })
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return server.Addr().String()
+}
+
+func TestRoutes(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	routeCert := certificate(t)
+	combo, addr := listen(t, listener.Config{Routes: []listener.Route{{
+		SNI:     "*.example.com",
+		ALPN:    []string{"chicken"},
+		Backend: listener.Action("tcp:" + echo(t)),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &routeCert, nil
+		},
+	}}}, cert, nil)
+
+	clientCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         "goose.EXAMPLE.com",
+		InsecureSkipVerify: true, //nolint:gosec
+		NextProtos:         []string{"chicken"},
+	}
+
+	conn, err := tls.Dial("tcp", addr, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !bytes.Equal(conn.ConnectionState().PeerCertificates[0].Raw, routeCert.Certificate[0]) {
+		t.Fatal("route certificate not used")
+	}
+
+	if _, err := conn.Write([]byte("goose")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]byte, len("goose"))
+	if _, err := io.ReadFull(conn, received); err != nil || string(received) != "goose" {
+		t.Fatal(string(received), err)
+	}
+
+	clientCfg.ServerName = "goose.chicken.example.com"
+
+	if _, err := tls.Dial("tcp", addr, clientCfg); err == nil {
+		t.Fatal("name matched more than one label")
+	}
+
+	waitFor(t, func() bool { return combo.HandshakeStats().Rejections[listener.ReasonClosed] == 1 })
+}
+
+func TestPluginActionWithoutPlugin(t *testing.T) {
+	t.Parallel()
+
+	_, err := listener.New(listener.Config{Default: listener.ActionPlugin}, nil, &tls.Config{}, nil, nil) //nolint:gosec
+	if !errors.Is(err, listener.ErrAction) {
+		t.Fatal(err)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	combo, addr := listen(t, listener.Config{
+		Protocols: []listener.Protocol{
+			{Name: "ssh", Upstream: "tcp:" + echo(t)},
+			{Name: "chicken", Prefixes: []string{"CHICKEN"}, Upstream: "tcp:" + echo(t)},
+		},
+		Silent:        "ssh",
+		SilentTimeout: 100 * time.Millisecond,
+	}, cert, nil)
+
+	for _, greeting := range []string{"SSH-2.0-OpenSSH_9.0\r\n", "CHICKEN!"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write([]byte(greeting)); err != nil {
+			t.Fatal(err)
+		}
+
+		received := make([]byte, len(greeting))
+		if _, err := io.ReadFull(conn, received); err != nil || string(received) != greeting {
+			t.Fatal(string(received), err)
+		}
+
+		_ = conn.Close()
+	}
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := silent.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]byte, len("late"))
+	if _, err := io.ReadFull(silent, received); err != nil || string(received) != "late" {
+		t.Fatal(string(received), err)
+	}
+
+	unknown, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unknown.Close()
+
+	if _, err := unknown.Write([]byte("CHICKS")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unknown.Read(make([]byte, 1)); err == nil {
+		t.Fatal("unknown protocol not rejected")
+	}
+
+	waitFor(t, func() bool { return combo.HandshakeStats().Rejections[listener.ReasonUnknownProtocol] == 1 })
+
+	_ = dial(t, addr, cert, proto.ALPN)
+
+	accepted, err := combo.WallhackListener().Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = accepted.Close()
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	combo, addr := listen(t, listener.Config{
+		Protocols:      []listener.Protocol{{Name: "ssh", Upstream: "tcp:" + echo(t), ProxyProtocol: 1}},
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}, cert, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := netip.MustParseAddrPort("192.0.2.1:56324")
+
+	header, err := proxyproto.Header(2, client, netip.MustParseAddrPort(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write(append(header, "SSH-2.0-chicken\r\n"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	src, _, err := proxyproto.Read(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if src != client {
+		t.Fatal(src)
+	}
+
+	direct, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+
+	if _, err := direct.Write([]byte("SSH-2.0-chicken\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return combo.HandshakeStats().Rejections[listener.ReasonProxyHeader] == 1 })
+}
+
+func TestGate(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	combo, addr := build(t, listener.Config{}, cert, nil)
+	guard := abuse.New(abuse.Config{BanAfter: 1})
+	combo.SetGate(guard)
+	run(t, combo)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = conn.Write([]byte("garbage that is no client hello"))
+	_, _ = io.Copy(io.Discard, conn)
+	_ = conn.Close()
+
+	waitFor(t, func() bool { return len(guard.Bans()) == 1 })
+
+	clientCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		Certificates:       []tls.Certificate{cert},
+		NextProtos:         []string{proto.ALPN},
+		InsecureSkipVerify: true, //nolint:gosec
+	}
+	if _, err := tls.Dial("tcp", addr, clientCfg); err == nil {
+		t.Fatal("banned client accepted")
+	}
+
+	waitFor(t, func() bool { return combo.HandshakeStats().Outcomes[listener.OutcomeRefused] == 1 })
+
+	if rejections := combo.HandshakeStats().Rejections[listener.ReasonRefused]; rejections != 1 {
+		t.Fatalf("expected 1 refusal, got %d", rejections)
+	}
+}
+
+var errVeto = errors.New("veto")
+
+// stubPlugin claims connections for claim.example, rejects reject.example and vetoes veto.example.
+type stubPlugin struct{}
+
+func (stubPlugin) Name() string                                 { return "stub" }
+func (stubPlugin) TLSConfig() *tls.Config                       { return nil }
+func (stubPlugin) Serve(context.Context, plugin.Listener) error { return nil }
+
+func (stubPlugin) Route(hello plugin.Hello) plugin.Verdict {
+	switch hello.ServerName {
+	case "claim.example":
+		return plugin.VerdictClaim
+	case "reject.example":
+		return plugin.VerdictReject
+	default:
+		return plugin.VerdictPass
+	}
+}
+
+func (stubPlugin) Check(meta plugin.Meta) error {
+	if meta.ServerName == "veto.example" {
+		return errVeto
+	}
+
+	return nil
+}
+
+func TestPlugins(t *testing.T) {
+	t.Parallel()
+
+	cert := certificate(t)
+	pluginCfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	combo, addr := build(t, listener.Config{
+		Routes: []listener.Route{{SNI: "route.example", Backend: "plugin:stub"}},
+	}, cert, nil, listener.Plugin{Plugin: stubPlugin{}, TLS: pluginCfg})
+	run(t, combo)
+
+	clientCfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: true} //nolint:gosec
+
+	for _, name := range []string{"claim.example", "route.example"} {
+		clientCfg.ServerName = name
+
+		conn, err := tls.Dial("tcp", addr, clientCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		accepted, err := combo.PluginListener("stub").Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if accepted.Meta.ServerName != name || accepted.Meta.RemoteAddr.String() != conn.LocalAddr().String() {
+			t.Fatalf("unexpected metadata %+v", accepted.Meta)
+		}
+
+		_ = accepted.Close()
+		_ = conn.Close()
+	}
+
+	clientCfg.ServerName = "reject.example"
+
+	if _, err := tls.Dial("tcp", addr, clientCfg); err == nil {
+		t.Fatal("rejected connection accepted")
+	}
+
+	waitFor(t, func() bool { return combo.HandshakeStats().Rejections[listener.ReasonVetoed] == 1 })
+
+	clientCfg.ServerName = "veto.example"
+	clientCfg.Certificates = []tls.Certificate{cert}
+	clientCfg.NextProtos = []string{proto.ALPN}
+
+	if conn, err := tls.Dial("tcp", addr, clientCfg); err == nil {
+		_ = conn.Close()
+	}
+
+	waitFor(t, func() bool { return combo.HandshakeStats().Rejections[listener.ReasonVetoed] == 2 })
+}
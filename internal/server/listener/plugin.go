@@ -0,0 +1,148 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package listener
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"eqrx.net/wallhack/plugin"
+)
+
+// pluginActionPrefix prefixes actions that name the plugin connections are handed to.
+const pluginActionPrefix = "plugin:"
+
+// ErrPlugin indicates that a plugin can not be used.
+var ErrPlugin = errors.New("invalid plugin")
+
+// Plugin is a loaded plugin connections can be routed to.
+type Plugin struct {
+	plugin.Plugin
+	// TLS is the TLS configuration for connections handed to the plugin.
+	TLS *tls.Config
+}
+
+// attached is the runtime state of a [Plugin].
+type attached struct {
+	Plugin
+	frontend frontend
+	// route hands connections claimed by the plugin to it.
+	route *route
+}
+
+// pluginListener hands the connections of a plugin out together with their metadata.
+type pluginListener struct{ frontend }
+
+func (p pluginListener) Accept() (*plugin.Conn, error) {
+	conn, err := p.frontend.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, _ := conn.(*tls.Conn)
+
+	return &plugin.Conn{Conn: tlsConn, Meta: plugin.NewMeta(tlsConn)}, nil
+}
+
+// PluginListener returns the frontend listener for the plugin called name. Returns nil if there is no such plugin.
+func (l *Listener) PluginListener(name string) plugin.Listener { //nolint:ireturn
+	for _, attached := range l.plugins {
+		if attached.Name() == name {
+			return pluginListener{attached.frontend}
+		}
+	}
+
+	return nil
+}
+
+// attach makes plugins available for routing in the order given.
+func (l *Listener) attach(plugins []Plugin) error {
+	for _, p := range plugins {
+		if p.TLS == nil {
+			return fmt.Errorf("attach %s: %w: no tls config", p.Name(), ErrPlugin)
+		}
+
+		if p.Name() == "" || l.lookup(Action(pluginActionPrefix+p.Name())) != nil {
+			return fmt.Errorf("attach %q: %w: name empty or used twice", p.Name(), ErrPlugin)
+		}
+
+		attached := &attached{Plugin: p, frontend: frontend{
+			make(chan net.Conn), frontendAddr{"frontend for plugin " + p.Name()},
+		}}
+		attached.route = &route{Route: Route{Backend: Action(pluginActionPrefix + p.Name())}, sink: &attached.frontend}
+		attached.route.cfg = p.TLS
+
+		l.plugins = append(l.plugins, attached)
+	}
+
+	return nil
+}
+
+// lookup returns the plugin an action refers to. [ActionPlugin] refers to the first plugin.
+func (l *Listener) lookup(action Action) *attached {
+	if action == ActionPlugin {
+		if len(l.plugins) == 0 {
+			return nil
+		}
+
+		return l.plugins[0]
+	}
+
+	name := strings.TrimPrefix(string(action), pluginActionPrefix)
+
+	for _, attached := range l.plugins {
+		if attached.Name() == name {
+			return attached
+		}
+	}
+
+	return nil
+}
+
+// claim asks the plugins about the connection described by chi. Returns nil if no plugin is interested.
+func (l *Listener) claim(chi *tls.ClientHelloInfo) *route {
+	hello := plugin.Hello{ServerName: chi.ServerName, ALPN: chi.SupportedProtos, RemoteAddr: chi.Conn.RemoteAddr()}
+
+	for _, attached := range l.plugins {
+		switch attached.Route(hello) {
+		case plugin.VerdictPass:
+		case plugin.VerdictClaim:
+			return attached.route
+		case plugin.VerdictReject:
+			return l.vetoed
+		}
+	}
+
+	return nil
+}
+
+// vet lets all plugins check conn after its handshake. Returns the error of the first plugin that vetoes.
+func (l *Listener) vet(conn *tls.Conn) error {
+	if len(l.plugins) == 0 {
+		return nil
+	}
+
+	meta := plugin.NewMeta(conn)
+
+	for _, attached := range l.plugins {
+		if err := attached.Check(meta); err != nil {
+			return fmt.Errorf("plugin %s: %w", attached.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"eqrx.net/wallhack/internal/server/proxyproto"
+)
+
+// trusted returns true if conn comes from a proxy that is trusted to send PROXY protocol headers.
+func (l *Listener) trusted(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip := addr.AddrPort().Addr().Unmap()
+
+	for _, prefix := range l.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unproxy reads the PROXY protocol header of conn if it comes from a trusted proxy. The returned connection reports
+// the original client as remote address. Connections from other sources are returned as they are.
+func (l *Listener) unproxy(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if !l.trusted(conn) {
+		return conn, nil
+	}
+
+	peeked := peek(conn)
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+
+	defer watch(ctx, conn)()
+
+	src, _, err := proxyproto.Read(peeked.reader)
+	if err != nil {
+		return peeked, fmt.Errorf("unproxy: %w", err)
+	}
+
+	if src.IsValid() {
+		peeked.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src.Addr().Unmap(), src.Port()))
+	}
+
+	return peeked, nil
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"eqrx.net/wallhack/internal/proto"
+	"eqrx.net/wallhack/internal/server/upstream"
+)
+
+// Route sends connections that match its SNI and ALPN to a backend.
+type Route struct {
+	// SNI is the server name the client has to ask for. A leading "*." matches exactly one label. Empty matches all
+	// clients, including those that send no server name.
+	SNI string `yaml:"sni"`
+	// ALPN contains protocols of which the client has to offer at least one. Empty matches all clients.
+	ALPN []string `yaml:"alpn"`
+	// Backend is the action for matching connections. Besides the actions it may also be an upstream address like
+	// tcp:127.0.0.1:22 or unix:/run/web.sock, matching connections are then spliced to it after TLS termination.
+	Backend Action `yaml:"backend"`
+	// Cert is the path to the PEM encoded certificate chain presented to matching clients. The server certificate
+	// is used if unset.
+	Cert string `yaml:"cert"`
+	// Key is the path to the PEM encoded private key of Cert.
+	Key string `yaml:"key"`
+	// ProxyProtocol is the version of the PROXY protocol header sent to upstreams. 0 sends none.
+	ProxyProtocol int `yaml:"proxyProtocol"`
+	// Tenant is the name of the tenant unknown client keys arriving on the route are offered for enrollment to. Only
+	// used for wallhack routes, empty means the default tenant.
+	Tenant string `yaml:"tenant"`
+	// GetCertificate is set by the server for routes with their own certificate.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error) `yaml:"-"`
+	// VerifyPeerCertificate is set by the server for routes with a tenant.
+	VerifyPeerCertificate func([][]byte, [][]*x509.Certificate) error `yaml:"-"`
+}
+
+// route is the runtime state of a [Route].
+type route struct {
+	Route
+	// sink is the frontend matching connections are handed to. Nil for upstreams and closing routes.
+	sink *frontend
+	// upstream is the upstream matching connections are spliced to if Backend is an upstream address.
+	upstream upstream.Upstream
+	// cfg is the TLS configuration for matching connections. Nil for closing routes.
+	cfg *tls.Config
+	// reason is counted for connections closed by the route.
+	reason Reason
+}
+
+// newRoute resolves the backend of r against the available frontends and TLS configurations.
+func (l *Listener) newRoute(r Route, wallhackCfg, fallbackCfg *tls.Config) (*route, error) {
+	resolved := &route{Route: r}
+
+	var base *tls.Config
+
+	switch {
+	case r.Backend == ActionWallhack:
+		resolved.sink, base = &l.wallhackFrontend, wallhackCfg
+	case r.Backend == ActionPlugin || strings.HasPrefix(string(r.Backend), pluginActionPrefix):
+		if attached := l.lookup(r.Backend); attached != nil {
+			resolved.sink, base = &attached.frontend, attached.TLS
+		}
+	case r.Backend == ActionFallback:
+		resolved.sink, base = &l.fallbackFrontend, fallbackCfg
+	case r.Backend == ActionClose:
+		resolved.reason = ReasonClosed
+
+		return resolved, nil
+	default:
+		upstream, err := upstream.Parse(string(r.Backend))
+		if err == nil {
+			upstream, err = upstream.WithProxyProtocol(r.ProxyProtocol)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("route: %w: %s", ErrAction, err.Error())
+		}
+
+		resolved.upstream = upstream
+		base = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			Certificates:   wallhackCfg.Certificates,
+			GetCertificate: wallhackCfg.GetCertificate,
+			NextProtos:     r.ALPN,
+		}
+	}
+
+	if base == nil {
+		return nil, fmt.Errorf("route: %w: %s not configured", ErrAction, r.Backend)
+	}
+
+	resolved.cfg = base.Clone()
+
+	if r.GetCertificate != nil {
+		resolved.cfg.Certificates = nil
+		resolved.cfg.GetCertificate = r.GetCertificate
+	}
+
+	if r.VerifyPeerCertificate != nil {
+		resolved.cfg.VerifyPeerCertificate = r.VerifyPeerCertificate
+	}
+
+	return resolved, nil
+}
+
+// matches returns true if the client hello matches the SNI and ALPN of the route.
+func (r *route) matches(chi *tls.ClientHelloInfo) bool {
+	if r.SNI != "" && !matchName(r.SNI, chi.ServerName) {
+		return false
+	}
+
+	if len(r.ALPN) == 0 {
+		return true
+	}
+
+	for _, offered := range chi.SupportedProtos {
+		for _, wanted := range r.ALPN {
+			if offered == wanted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchName returns true if name matches pattern. A leading "*." in pattern matches exactly one label.
+func matchName(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == name
+	}
+
+	label, rest, ok := strings.Cut(name, ".")
+
+	return ok && label != "" && rest == pattern[len("*."):]
+}
+
+// defaultRoutes returns the routes that apply if no configured route matches: clients offering a wallhack
+// protocol go to wallhack, everything else is handled by the default action.
+func defaultRoutes(action Action) []Route {
+	return []Route{
+		{ALPN: proto.NextProtos(), Backend: ActionWallhack},
+		{Backend: action},
+	}
+}
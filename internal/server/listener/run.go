@@ -19,61 +19,297 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"time"
 
 	"eqrx.net/rungroup"
+	"eqrx.net/wallhack/internal/proto"
+	"eqrx.net/wallhack/internal/server/proxyproto"
+	"eqrx.net/wallhack/internal/server/upstream"
 	"github.com/go-logr/logr"
 )
 
-func (l *Listener) pickSink(state tls.ConnectionState) chan<- net.Conn {
-	switch {
-	case state.NegotiatedProtocol == "wallhack":
-		if state.Version != tls.VersionTLS13 {
-			panic("version drop")
-		}
+// errClosed is returned to TLS clients that hit a closing route.
+var errClosed = errors.New("closed by route")
+
+// match returns the route claimed by a plugin or else the first route that matches chi. The default routes ensure
+// that there always is one.
+func (l *Listener) match(chi *tls.ClientHelloInfo) *route {
+	if claimed := l.claim(chi); claimed != nil {
+		return claimed
+	}
 
-		if len(state.PeerCertificates) < 1 {
-			panic("no client auth")
+	for _, route := range l.routes {
+		if route.matches(chi) {
+			return route
 		}
+	}
+
+	return l.routes[len(l.routes)-1]
+}
 
-		return l.wallhackFrontend.conns
-	case l.hasPlugin:
-		return l.pluginFrontend.conns
+// check returns a reason if conn may not be handed to the backend of route.
+func check(route *route, state tls.ConnectionState) Reason {
+	if route.sink == nil || route.Backend != ActionWallhack {
+		return ""
+	}
+
+	switch {
+	case !proto.IsWallhack(state.NegotiatedProtocol):
+		return ReasonNoProtocol
+	case state.Version != tls.VersionTLS13:
+		return ReasonVersion
+	case len(state.PeerCertificates) < 1:
+		return ReasonNoClientCert
 	default:
-		panic("non wallhack protocol and no plugin")
+		return ""
 	}
 }
 
+// acceptBackend accepts connections from backend and hands each of them to its own handshake goroutine. Accepting
+// pauses while the maximum number of concurrent handshakes is reached.
 func (l *Listener) acceptBackend(ctx context.Context, backend net.Listener, log logr.Logger) error {
-	for {
-		conn, err := backend.Accept()
+	group := rungroup.New(ctx)
 
-		switch {
-		case err == nil:
-		case errors.Is(err, net.ErrClosed):
-			return nil
-		default:
-			return fmt.Errorf("accept backend: %w", err)
-		}
+	group.Go(func(ctx context.Context) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case l.handshakeSlots <- struct{}{}:
+			}
 
-		tlsConn := conn.(*tls.Conn)
-		if err := tlsConn.HandshakeContext(ctx); err != nil {
-			log.Error(err, "tls handshake")
+			conn, err := backend.Accept()
 
-			continue
-		}
+			switch {
+			case err == nil:
+			case errors.Is(err, net.ErrClosed):
+				<-l.handshakeSlots
 
-		sink := l.pickSink(tlsConn.ConnectionState())
+				return nil
+			default:
+				<-l.handshakeSlots
 
-		select {
-		case <-ctx.Done():
-			if err := conn.Close(); err != nil {
 				return fmt.Errorf("accept backend: %w", err)
 			}
 
+			group.Go(func(ctx context.Context) error {
+				return l.handshake(ctx, conn, log)
+			}, rungroup.NoCancelOnSuccess)
+		}
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("accept backend: %w", err)
+	}
+
+	return nil
+}
+
+// handshake sniffs the protocol of raw and performs the TLS handshake within the handshake timeout if it is TLS.
+// The connection is then handed to the backend of the route matching the client hello or, if a non-TLS protocol was
+// sniffed, spliced to the upstream of the protocol. Frees a handshake slot once the handshake is done.
+func (l *Listener) handshake(ctx context.Context, raw net.Conn, log logr.Logger) error {
+	l.begin()
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, l.handshakeTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	unproxied, err := l.unproxy(handshakeCtx, raw)
+	log = log.WithValues("raddr", unproxied.RemoteAddr().String())
+
+	if err != nil {
+		return l.handleEarly(log, unproxied, err, l.finish(handshakeCtx, err, start))
+	}
+
+	if l.gate != nil {
+		if err := l.gate.Allow(remoteIP(unproxied)); err != nil {
+			l.settle(OutcomeRefused, start)
+			l.reject(ReasonRefused)
+			log.V(1).Info("refusing connection", "reason", err.Error())
+
+			_ = unproxied.Close()
+
 			return nil
-		case sink <- conn:
 		}
 	}
+
+	sniffed, protocol, err := l.sniff(handshakeCtx, unproxied)
+	if err != nil || protocol != nil {
+		return l.handleSniffed(ctx, log, sniffed, protocol, err, l.finish(handshakeCtx, err, start))
+	}
+
+	return l.handshakeTLS(ctx, handshakeCtx, log, sniffed, start)
+}
+
+// handshakeTLS performs the TLS handshake of raw within handshakeCtx and hands it to the backend of the route
+// matching the client hello.
+func (l *Listener) handshakeTLS(
+	ctx, handshakeCtx context.Context, log logr.Logger, raw net.Conn, start time.Time,
+) error {
+	var matched *route
+
+	conn := tls.Server(raw, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			matched = l.match(chi)
+			if matched.cfg == nil {
+				return nil, errClosed
+			}
+
+			return matched.cfg, nil
+		},
+	})
+
+	err := conn.HandshakeContext(handshakeCtx)
+	result := l.finish(handshakeCtx, err, start)
+
+	switch {
+	case matched != nil && matched.cfg == nil:
+		return l.rejectConn(log, conn, matched.reason)
+	case err != nil:
+		if result != OutcomeCanceled {
+			log.Error(err, "tls handshake", "outcome", result, "duration", time.Since(start))
+			l.fail(log, conn)
+		}
+
+		_ = conn.Close()
+
+		return nil
+	}
+
+	log.V(1).Info("tls handshake", "outcome", result, "duration", time.Since(start))
+
+	if reason := check(matched, conn.ConnectionState()); reason != "" {
+		l.fail(log, conn)
+
+		return l.rejectConn(log, conn, reason)
+	}
+
+	if err := l.vet(conn); err != nil {
+		log.V(1).Info("plugin vetoed connection", "err", err.Error())
+
+		return l.rejectConn(log, conn, ReasonVetoed)
+	}
+
+	if matched.sink == nil {
+		return l.splice(ctx, log, conn, matched.upstream)
+	}
+
+	select {
+	case <-ctx.Done():
+		if err := conn.Close(); err != nil {
+			return fmt.Errorf("handshake: %w", err)
+		}
+
+		return nil
+	case matched.sink.conns <- conn:
+		return nil
+	}
+}
+
+// finish records the outcome of a handshake that started at start and ended with err. Frees the handshake slot.
+func (l *Listener) finish(ctx context.Context, err error, start time.Time) Outcome {
+	result := outcome(ctx, err)
+
+	l.settle(result, start)
+
+	return result
+}
+
+// settle records result for a handshake that started at start and frees the handshake slot.
+func (l *Listener) settle(result Outcome, start time.Time) {
+	l.record(result, time.Since(start))
+	<-l.handshakeSlots
+}
+
+// fail reports a client that failed its handshake to the gate.
+func (l *Listener) fail(log logr.Logger, conn net.Conn) {
+	if l.gate != nil && l.gate.Fail(remoteIP(conn)) {
+		log.Info("banning client")
+	}
+}
+
+// remoteIP returns the IP address of the remote end of conn. The result is invalid if conn is no IP connection.
+func remoteIP(conn net.Conn) netip.Addr {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.AddrPort().Addr().Unmap()
+	}
+
+	return netip.Addr{}
+}
+
+// handleEarly rejects conn after reading its PROXY protocol header or sniffing its protocol failed with err.
+func (l *Listener) handleEarly(log logr.Logger, conn net.Conn, err error, result Outcome) error {
+	var reason Reason
+
+	switch {
+	case errors.Is(err, errUnknownProtocol):
+		reason = ReasonUnknownProtocol
+	case errors.Is(err, proxyproto.ErrHeader):
+		reason = ReasonProxyHeader
+	}
+
+	switch {
+	case reason != "":
+		l.reject(reason)
+		log.Info("rejecting connection", "reason", reason)
+		l.fail(log, conn)
+	case result != OutcomeCanceled:
+		log.Error(err, "early handshake", "outcome", result)
+		l.fail(log, conn)
+	}
+
+	_ = conn.Close()
+
+	return nil
+}
+
+// handleSniffed splices conn to the upstream of the sniffed protocol or rejects it if sniffing failed.
+func (l *Listener) handleSniffed(
+	ctx context.Context, log logr.Logger, conn net.Conn, protocol *protocol, err error, result Outcome,
+) error {
+	if err != nil {
+		return l.handleEarly(log, conn, err, result)
+	}
+
+	log.V(1).Info("sniffed protocol", "protocol", protocol.name)
+
+	return l.splice(ctx, log.WithValues("protocol", protocol.name), conn, protocol.upstream)
+}
+
+// rejectConn counts, logs and closes a connection that is rejected for reason.
+func (l *Listener) rejectConn(log logr.Logger, conn *tls.Conn, reason Reason) error {
+	state := conn.ConnectionState()
+
+	l.reject(reason)
+	log.Info("rejecting connection", "reason", reason, "alpn", state.NegotiatedProtocol, "sni", state.ServerName)
+
+	_ = conn.Close()
+
+	return nil
+}
+
+// splice connects conn to target.
+func (l *Listener) splice(ctx context.Context, log logr.Logger, conn net.Conn, target upstream.Upstream) error {
+	log = log.WithValues("upstream", target.String())
+
+	upstreamConn, err := target.Dial(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+
+		log.Error(err, "splice to upstream")
+
+		return nil
+	}
+
+	if err := upstream.Splice(ctx, conn, upstreamConn); err != nil {
+		log.V(1).Info("splice to upstream ended", "err", err.Error())
+	}
+
+	return nil
 }
 
 func (l *Listener) acceptBackends(ctx context.Context, log logr.Logger) error {
@@ -103,21 +339,19 @@ func (l *Listener) acceptBackends(ctx context.Context, log logr.Logger) error {
 }
 
 // Listen returns a rungroup compatible method that listens on the
-// configured backends an shoves connections into wallhack and plugin.
+// configured backends an shoves connections into wallhack, plugin, fallback and upstreams.
 func (l *Listener) Listen(ctx context.Context, log logr.Logger) error {
-	rootGroup := rungroup.New(ctx)
-	rootGroup.Go(func(ctx context.Context) error {
-		<-ctx.Done()
-
+	// Frontends are closed only after all handshakes are done, so nobody sends to a closed frontend.
+	defer func() {
 		close(l.wallhackFrontend.conns)
-		close(l.pluginFrontend.conns)
+		close(l.fallbackFrontend.conns)
 
-		return nil
-	})
-
-	rootGroup.Go(func(ctx context.Context) error { return l.acceptBackends(ctx, log) })
+		for _, attached := range l.plugins {
+			close(attached.frontend.conns)
+		}
+	}()
 
-	if err := rootGroup.Wait(); err != nil {
+	if err := l.acceptBackends(ctx, log); err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
 
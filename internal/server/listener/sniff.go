@@ -0,0 +1,164 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package listener
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"eqrx.net/wallhack/internal/server/upstream"
+)
+
+// tlsHandshakeRecord is the first byte of a TLS connection, the content type of the record carrying the client hello.
+const tlsHandshakeRecord = 0x16
+
+var (
+	// ErrProtocol indicates that a sniffed protocol is misconfigured.
+	ErrProtocol = errors.New("invalid sniffed protocol")
+	// errUnknownProtocol indicates that a connection is neither TLS nor one of the sniffed protocols.
+	errUnknownProtocol = errors.New("unknown protocol")
+)
+
+// builtinPrefixes contains the prefixes of protocols that can be sniffed by name only.
+var builtinPrefixes = map[string][]string{ //nolint:gochecknoglobals
+	"ssh":  {"SSH-"},
+	"http": {"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT "},
+}
+
+// Protocol is a non-TLS protocol that is recognized by the first bytes the client sends.
+type Protocol struct {
+	// Name of the protocol. The prefixes of the builtin protocols ssh and http do not need to be configured.
+	Name string `yaml:"name"`
+	// Prefixes contains the byte sequences a connection of the protocol starts with.
+	Prefixes []string `yaml:"prefixes"`
+	// Upstream is the address connections of the protocol are spliced to, like tcp:127.0.0.1:22.
+	Upstream string `yaml:"upstream"`
+	// ProxyProtocol is the version of the PROXY protocol header sent to the upstream. 0 sends none.
+	ProxyProtocol int `yaml:"proxyProtocol"`
+}
+
+// protocol is the runtime state of a [Protocol].
+type protocol struct {
+	name     string
+	prefixes [][]byte
+	upstream upstream.Upstream
+}
+
+func newProtocol(cfg Protocol) (*protocol, error) {
+	prefixes := cfg.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = builtinPrefixes[cfg.Name]
+	}
+
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("%w: %s has no prefixes", ErrProtocol, cfg.Name)
+	}
+
+	upstream, err := upstream.Parse(cfg.Upstream)
+	if err == nil {
+		upstream, err = upstream.WithProxyProtocol(cfg.ProxyProtocol)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrProtocol, cfg.Name, err.Error())
+	}
+
+	resolved := &protocol{name: cfg.Name, upstream: upstream}
+
+	for _, prefix := range prefixes {
+		if prefix == "" || prefix[0] == tlsHandshakeRecord {
+			return nil, fmt.Errorf("%w: %s: prefix %q collides with TLS", ErrProtocol, cfg.Name, prefix)
+		}
+
+		resolved.prefixes = append(resolved.prefixes, []byte(prefix))
+	}
+
+	return resolved, nil
+}
+
+// sniff reads the start of raw until it is recognized as TLS or one of the sniffed protocols. A nil protocol means
+// TLS. The returned conn still yields all bytes the client sent. If the client sends nothing for the silent timeout,
+// the silent protocol is returned if configured.
+func (l *Listener) sniff(ctx context.Context, raw net.Conn) (net.Conn, *protocol, error) {
+	if len(l.protocols) == 0 {
+		return raw, nil, nil
+	}
+
+	conn := peek(raw)
+	deadline, _ := ctx.Deadline()
+
+	defer watch(ctx, raw)()
+
+	if l.silent != nil && time.Until(deadline) > l.silentTimeout {
+		_ = raw.SetReadDeadline(time.Now().Add(l.silentTimeout))
+	} else {
+		_ = raw.SetReadDeadline(deadline)
+	}
+
+	for length := 1; ; length++ {
+		data, err := conn.reader.Peek(length)
+
+		var netErr net.Error
+
+		switch {
+		case err == nil:
+		case length == 1 && l.silent != nil && ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout():
+			return conn, l.silent, nil
+		case ctx.Err() != nil:
+			return conn, nil, fmt.Errorf("sniff: %w", ctx.Err())
+		default:
+			return conn, nil, fmt.Errorf("sniff: %w", err)
+		}
+
+		if length == 1 {
+			_ = raw.SetReadDeadline(deadline)
+		}
+
+		if data[0] == tlsHandshakeRecord {
+			return conn, nil, nil
+		}
+
+		protocol, candidates := l.recognize(data)
+
+		switch {
+		case protocol != nil:
+			return conn, protocol, nil
+		case candidates == 0:
+			return conn, nil, errUnknownProtocol
+		}
+	}
+}
+
+// recognize returns the protocol data starts with. If there is none, it returns the number of prefixes data could
+// still grow into.
+func (l *Listener) recognize(data []byte) (*protocol, int) {
+	candidates := 0
+
+	for _, protocol := range l.protocols {
+		for _, prefix := range protocol.prefixes {
+			switch {
+			case bytes.HasPrefix(data, prefix):
+				return protocol, 0
+			case bytes.HasPrefix(prefix, data):
+				candidates++
+			}
+		}
+	}
+
+	return nil, candidates
+}
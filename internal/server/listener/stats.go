@@ -0,0 +1,145 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package listener
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Outcome is the result of a TLS handshake.
+type Outcome string
+
+const (
+	// OutcomeSucceeded means the handshake completed.
+	OutcomeSucceeded Outcome = "succeeded"
+	// OutcomeFailed means the handshake failed, for example because the client sent garbage or an invalid certificate.
+	OutcomeFailed Outcome = "failed"
+	// OutcomeTimedOut means the client did not complete the handshake in time.
+	OutcomeTimedOut Outcome = "timed out"
+	// OutcomeRefused means the handshake was not even attempted because the gate refused the client.
+	OutcomeRefused Outcome = "refused"
+	// OutcomeCanceled means the handshake was interrupted because the listener shut down.
+	OutcomeCanceled Outcome = "canceled"
+)
+
+// Reason explains why a connection was rejected after its handshake.
+type Reason string
+
+const (
+	// ReasonVersion means a wallhack protocol was negotiated with a TLS version older than 1.3.
+	ReasonVersion Reason = "tls version too old"
+	// ReasonNoClientCert means a wallhack protocol was negotiated without a client certificate.
+	ReasonNoClientCert Reason = "no client certificate"
+	// ReasonNoProtocol means a connection was routed to wallhack without negotiating a wallhack protocol.
+	ReasonNoProtocol Reason = "no wallhack protocol"
+	// ReasonRefused means the gate refused the client, for example because it is banned or rate limited.
+	ReasonRefused Reason = "refused"
+	// ReasonProxyHeader means a connection from a trusted proxy did not start with a valid PROXY protocol header.
+	ReasonProxyHeader Reason = "invalid proxy header"
+	// ReasonUnknownProtocol means the connection is neither TLS nor one of the sniffed protocols.
+	ReasonUnknownProtocol Reason = "unknown protocol"
+	// ReasonVetoed means a plugin rejected the connection.
+	ReasonVetoed Reason = "vetoed by plugin"
+	// ReasonClosed means the connection matched a route with [ActionClose].
+	ReasonClosed Reason = "closed by route"
+)
+
+// HandshakeStats summarizes the TLS handshakes of a listener.
+type HandshakeStats struct {
+	// Outcomes counts handshakes by outcome.
+	Outcomes map[Outcome]uint64
+	// Duration is the summed up duration of all handshakes.
+	Duration time.Duration
+	// Max is the duration of the longest handshake.
+	Max time.Duration
+	// Rejections counts connections that were closed after their handshake by reason.
+	Rejections map[Reason]uint64
+	// InFlight is the number of handshakes currently running.
+	InFlight int
+}
+
+// outcome classifies err as returned by a handshake that was run with ctx.
+func outcome(ctx context.Context, err error) Outcome {
+	switch {
+	case err == nil:
+		return OutcomeSucceeded
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return OutcomeTimedOut
+	case ctx.Err() != nil:
+		return OutcomeCanceled
+	default:
+		return OutcomeFailed
+	}
+}
+
+// begin counts a handshake as in flight.
+func (l *Listener) begin() {
+	l.statsMtx.Lock()
+	defer l.statsMtx.Unlock()
+
+	l.stats.InFlight++
+}
+
+// record adds a handshake that ended with outcome after duration to the stats.
+func (l *Listener) record(outcome Outcome, duration time.Duration) {
+	l.statsMtx.Lock()
+	defer l.statsMtx.Unlock()
+
+	if l.stats.Outcomes == nil {
+		l.stats.Outcomes = map[Outcome]uint64{}
+	}
+
+	l.stats.Outcomes[outcome]++
+	l.stats.InFlight--
+	l.stats.Duration += duration
+
+	if duration > l.stats.Max {
+		l.stats.Max = duration
+	}
+}
+
+// reject counts a connection that was rejected for reason.
+func (l *Listener) reject(reason Reason) {
+	l.statsMtx.Lock()
+	defer l.statsMtx.Unlock()
+
+	if l.stats.Rejections == nil {
+		l.stats.Rejections = map[Reason]uint64{}
+	}
+
+	l.stats.Rejections[reason]++
+}
+
+// HandshakeStats returns a snapshot of the handshake statistics.
+func (l *Listener) HandshakeStats() HandshakeStats {
+	l.statsMtx.Lock()
+	defer l.statsMtx.Unlock()
+
+	stats := l.stats
+	stats.Outcomes = make(map[Outcome]uint64, len(l.stats.Outcomes))
+
+	for outcome, count := range l.stats.Outcomes {
+		stats.Outcomes[outcome] = count
+	}
+
+	stats.Rejections = make(map[Reason]uint64, len(l.stats.Rejections))
+
+	for reason, count := range l.stats.Rejections {
+		stats.Rejections[reason] = count
+	}
+
+	return stats
+}
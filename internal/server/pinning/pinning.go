@@ -0,0 +1,333 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package pinning authenticates clients by the SHA-256 fingerprint of the public key (SPKI) of their certificate
+// instead of a CA. Unknown keys may optionally be enrolled on first use and wait for approval by an admin.
+package pinning
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPending is the number of enrollments that may wait for approval at the same time.
+	maxPending = 64
+	// enrolledIDLen is the number of hex digits of the fingerprint that make up the identity of enrolled keys.
+	enrolledIDLen = 16
+)
+
+var (
+	// ErrUnknownKey indicates that the public key of a client is not allowed.
+	ErrUnknownKey = errors.New("unknown client key")
+	// ErrPending indicates that the public key of a client waits for approval.
+	ErrPending = errors.New("client key waits for approval")
+	// ErrFingerprint indicates that a configured fingerprint is malformed.
+	ErrFingerprint = errors.New("invalid fingerprint")
+	// ErrConfig indicates that pinning is misconfigured.
+	ErrConfig = errors.New("invalid pinning config")
+	// ErrIdentityInUse indicates that a pending key can not be approved because its identity already belongs to
+	// another key.
+	ErrIdentityInUse = errors.New("identity already in use")
+)
+
+// Config contains the allowed client keys.
+type Config struct {
+	// Allow maps hex encoded SHA-256 fingerprints of the SPKI of client certificates to client identities. Colons
+	// and case are ignored.
+	Allow map[string]string `yaml:"allow"`
+	// Enroll records unknown keys as pending until they are approved through the admin interface.
+	Enroll bool `yaml:"enroll"`
+	// EnrollWindow limits enrollment to the given time after startup. Unset means no limit.
+	EnrollWindow time.Duration `yaml:"enrollWindow"`
+	// State is the path of the file approved and pending keys are kept in. Required for Enroll.
+	State string `yaml:"state"`
+}
+
+// Enabled returns true if any key is allowed or enrollment is enabled.
+func (c Config) Enabled() bool { return len(c.Allow) != 0 || c.Enroll }
+
+// Pending is a key that waits for approval.
+type Pending struct {
+	// Fingerprint is the fingerprint of the key.
+	Fingerprint string `json:"fingerprint"`
+	// Identity is the identity the client gets once approved. It is derived from the fingerprint so enrollees can not
+	// pick the identity of somebody else.
+	Identity string `json:"identity"`
+	// Name is the common name of the certificate. It is chosen by the enrollee and only helps to recognize the key.
+	Name string `json:"name"`
+	// Seen is the time the key was first presented.
+	Seen time.Time `json:"seen"`
+}
+
+// state is what is persisted in the state file.
+type state struct {
+	Approved map[string]string `json:"approved"`
+	Pending  []Pending         `json:"pending"`
+}
+
+// Pins holds the allowed and pending keys.
+type Pins struct {
+	allow       map[string]string
+	enrollUntil time.Time
+	enroll      bool
+	path        string
+	mtx         sync.Mutex
+	state       state
+}
+
+// New creates [Pins] from cfg and loads the state file if there is one.
+func New(cfg Config) (*Pins, error) {
+	if cfg.Enroll && cfg.State == "" {
+		return nil, fmt.Errorf("new pins: %w: enrollment needs a state file", ErrConfig)
+	}
+
+	pins := &Pins{
+		allow:  make(map[string]string, len(cfg.Allow)),
+		enroll: cfg.Enroll,
+		path:   cfg.State,
+		state:  state{Approved: map[string]string{}},
+	}
+
+	if cfg.EnrollWindow > 0 {
+		pins.enrollUntil = time.Now().Add(cfg.EnrollWindow)
+	}
+
+	for fingerprint, id := range cfg.Allow {
+		normalized, err := Normalize(fingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("new pins: %w", err)
+		}
+
+		pins.allow[normalized] = id
+	}
+
+	if err := pins.load(); err != nil {
+		return nil, fmt.Errorf("new pins: %w", err)
+	}
+
+	return pins, nil
+}
+
+// Fingerprint returns the hex encoded SHA-256 fingerprint of the SPKI of cert.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Normalize brings a fingerprint into the form returned by [Fingerprint].
+func Normalize(fingerprint string) (string, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+
+	if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("%w: %q", ErrFingerprint, fingerprint)
+	}
+
+	return normalized, nil
+}
+
+// EnrolledID returns the identity an enrolled key with fingerprint gets.
+func EnrolledID(fingerprint string) string { return fingerprint[:enrolledIDLen] }
+
+// Lookup returns the identity of the client with cert if its key is allowed.
+func (p *Pins) Lookup(cert *x509.Certificate) (string, bool) {
+	fingerprint := Fingerprint(cert)
+
+	if id, ok := p.allow[fingerprint]; ok {
+		return id, true
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	id, ok := p.state.Approved[fingerprint]
+
+	return id, ok
+}
+
+// Enroll records the key of cert as pending if enrollment is open. Returns [ErrPending] if the key waits for
+// approval and [ErrUnknownKey] if enrollment is closed.
+func (p *Pins) Enroll(cert *x509.Certificate) error {
+	fingerprint := Fingerprint(cert)
+
+	if !p.enroll || (!p.enrollUntil.IsZero() && time.Now().After(p.enrollUntil)) {
+		return fmt.Errorf("enroll: %w: %s", ErrUnknownKey, fingerprint)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, pending := range p.state.Pending {
+		if pending.Fingerprint == fingerprint {
+			return fmt.Errorf("enroll: %w: %s", ErrPending, fingerprint)
+		}
+	}
+
+	if len(p.state.Pending) >= maxPending {
+		return fmt.Errorf("enroll: %w: too many pending keys", ErrUnknownKey)
+	}
+
+	// The common name is chosen by the enrollee, so it must not become the identity.
+	pending := Pending{fingerprint, EnrolledID(fingerprint), cert.Subject.CommonName, time.Now()}
+	p.state.Pending = append(p.state.Pending, pending)
+
+	if err := p.save(); err != nil {
+		return fmt.Errorf("enroll: %w", err)
+	}
+
+	return fmt.Errorf("enroll: %w: %s", ErrPending, fingerprint)
+}
+
+// Pending returns the keys that wait for approval.
+func (p *Pins) Pending() []Pending {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return append([]Pending{}, p.state.Pending...)
+}
+
+// Approve allows the pending key with fingerprint. Returns false if there is no such pending key.
+func (p *Pins) Approve(fingerprint string) (bool, error) {
+	return p.resolve(fingerprint, true)
+}
+
+// Deny drops the pending key with fingerprint. The client may enroll again while enrollment is open. Returns false
+// if there is no such pending key.
+func (p *Pins) Deny(fingerprint string) (bool, error) {
+	return p.resolve(fingerprint, false)
+}
+
+func (p *Pins) resolve(fingerprint string, approve bool) (bool, error) {
+	normalized, err := Normalize(fingerprint)
+	if err != nil {
+		return false, err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for i, pending := range p.state.Pending {
+		if pending.Fingerprint != normalized {
+			continue
+		}
+
+		if approve && p.inUse(pending.Identity) {
+			return false, fmt.Errorf("resolve: %w: %s", ErrIdentityInUse, pending.Identity)
+		}
+
+		p.state.Pending = append(p.state.Pending[:i:i], p.state.Pending[i+1:]...)
+
+		if approve {
+			p.state.Approved[normalized] = pending.Identity
+		}
+
+		if err := p.save(); err != nil {
+			return false, fmt.Errorf("resolve: %w", err)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// inUse returns true if id is the identity of an allowed or approved key. Must be called with the lock held.
+func (p *Pins) inUse(id string) bool {
+	for _, allowed := range p.allow {
+		if allowed == id {
+			return true
+		}
+	}
+
+	for _, approved := range p.state.Approved {
+		if approved == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load reads the state file. A missing file means an empty state.
+func (p *Pins) load() error {
+	if p.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.path)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("load: %w", err)
+	}
+
+	loaded := state{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+
+	if loaded.Approved == nil {
+		loaded.Approved = map[string]string{}
+	}
+
+	p.state = loaded
+
+	return nil
+}
+
+// save writes the state file atomically. Must be called with the lock held.
+func (p *Pins) save() error {
+	sort.Slice(p.state.Pending, func(i, j int) bool { return p.state.Pending[i].Seen.Before(p.state.Pending[j].Seen) })
+
+	data, err := json.MarshalIndent(p.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".*")
+	if err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+
+		return fmt.Errorf("save: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+
+	return nil
+}
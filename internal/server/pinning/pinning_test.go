@@ -0,0 +1,162 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package pinning_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"eqrx.net/wallhack/internal/server/pinning"
+	"eqrx.net/wallhack/internal/testpki"
+)
+
+func TestAllow(t *testing.T) {
+	t.Parallel()
+
+	laptop := testpki.Issue(t, "whatever", nil).Cert
+	fingerprint := strings.ToUpper(pinning.Fingerprint(laptop))
+
+	pins, err := pinning.New(pinning.Config{Allow: map[string]string{fingerprint: "laptop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, ok := pins.Lookup(laptop); !ok || id != "laptop" {
+		t.Fatalf("laptop not allowed: %q", id)
+	}
+
+	if _, ok := pins.Lookup(testpki.Issue(t, "laptop", nil).Cert); ok {
+		t.Fatal("unknown key allowed")
+	}
+
+	if err := pins.Enroll(laptop); !errors.Is(err, pinning.ErrUnknownKey) {
+		t.Fatal(err)
+	}
+
+	_, err = pinning.New(pinning.Config{Allow: map[string]string{"chicken": "laptop"}})
+	if !errors.Is(err, pinning.ErrFingerprint) {
+		t.Fatal(err)
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	t.Parallel()
+
+	cfg := pinning.Config{Enroll: true, State: path.Join(t.TempDir(), "pins.json")}
+	phone, tablet := testpki.Issue(t, "phone", nil).Cert, testpki.Issue(t, "tablet", nil).Cert
+
+	pins, err := pinning.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cert := range []*x509.Certificate{phone, phone, tablet} {
+		if err := pins.Enroll(cert); !errors.Is(err, pinning.ErrPending) {
+			t.Fatal(err)
+		}
+	}
+
+	pending := pins.Pending()
+	if len(pending) != 2 || pending[0].Identity != pinning.EnrolledID(pinning.Fingerprint(phone)) {
+		t.Fatalf("unexpected pending keys %+v", pending)
+	}
+
+	if pending[0].Name != "phone" {
+		t.Fatalf("common name not kept: %+v", pending[0])
+	}
+
+	if found, err := pins.Approve(pinning.Fingerprint(phone)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+
+	if found, err := pins.Deny(pinning.Fingerprint(tablet)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+
+	reloaded, err := pinning.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, ok := reloaded.Lookup(phone); !ok || id != pinning.EnrolledID(pinning.Fingerprint(phone)) {
+		t.Fatal("approval not persisted")
+	}
+
+	if _, ok := reloaded.Lookup(tablet); ok || len(reloaded.Pending()) != 0 {
+		t.Fatal("denied key kept")
+	}
+}
+
+func TestEnrollIdentityInUse(t *testing.T) {
+	t.Parallel()
+
+	alice, impostor := testpki.Issue(t, "alice", nil).Cert, testpki.Issue(t, "alice", nil).Cert
+	bob := testpki.Issue(t, "bob", nil).Cert
+
+	pins, err := pinning.New(pinning.Config{
+		Allow: map[string]string{
+			pinning.Fingerprint(alice): "alice",
+			// An admin happened to pick the identity bob gets by enrolling.
+			pinning.Fingerprint(testpki.Issue(t, "carol", nil).Cert): pinning.EnrolledID(pinning.Fingerprint(bob)),
+		},
+		Enroll: true,
+		State:  path.Join(t.TempDir(), "pins.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cert := range []*x509.Certificate{impostor, bob} {
+		if err := pins.Enroll(cert); !errors.Is(err, pinning.ErrPending) {
+			t.Fatal(err)
+		}
+	}
+
+	if found, err := pins.Approve(pinning.Fingerprint(impostor)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+
+	if id, ok := pins.Lookup(impostor); !ok || id == "alice" {
+		t.Fatalf("impostor got identity %q", id)
+	}
+
+	if _, err := pins.Approve(pinning.Fingerprint(bob)); !errors.Is(err, pinning.ErrIdentityInUse) {
+		t.Fatal(err)
+	}
+
+	if _, ok := pins.Lookup(bob); ok || len(pins.Pending()) != 1 {
+		t.Fatal("refused key approved")
+	}
+}
+
+func TestEnrollWindow(t *testing.T) {
+	t.Parallel()
+
+	pins, err := pinning.New(pinning.Config{
+		Enroll: true, EnrollWindow: time.Nanosecond, State: path.Join(t.TempDir(), "pins.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	if err := pins.Enroll(testpki.Issue(t, "phone", nil).Cert); !errors.Is(err, pinning.ErrUnknownKey) {
+		t.Fatal(err)
+	}
+}
@@ -16,43 +16,159 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"plugin"
+	"path/filepath"
+	goplugin "plugin"
+	"strings"
+
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/server/listener"
+	"eqrx.net/wallhack/plugin"
 )
 
-// Plugin defines what methods a wallhack plugin needs to implement.
-type Plugin interface {
+// PluginV1 defines what methods a version 1 wallhack plugin needs to implement. New plugins should implement
+// [plugin.Plugin] instead.
+type PluginV1 interface {
 	TLSConfig() *tls.Config
 	Listen(context.Context, net.Listener) error
 }
 
 const (
-	// PluginPathEnvName is the environment name that contains the path to a go plugin that is loaded by wallhack
-	// for serving extra stuff.
+	// PluginPathEnvName is the environment name that contains the paths to go plugins that are loaded by wallhack
+	// for serving extra stuff. Multiple paths are separated like in PATH.
 	PluginPathEnvName = "WALLHACK_PLUGIN_PATH"
 
-	// PluginNewSymbolName is the name of the symbol within the plugin that is responsible for
-	// returning the Plugin interface.
+	// PluginNewSymbolName is the name of the symbol within a version 1 plugin that is responsible for
+	// returning the [PluginV1] interface.
 	PluginNewSymbolName = "New"
 )
 
-func loadPlugin() (Plugin, error) { //nolint:ireturn
-	path, pluginSet := os.LookupEnv(PluginPathEnvName)
-	if !pluginSet {
-		return nil, nil //nolint:nilnil
+// ErrPluginSymbol indicates that a plugin exports a symbol of the wrong type.
+var ErrPluginSymbol = errors.New("invalid plugin symbol")
+
+// legacyPlugin adapts a version 1 plugin to the current plugin API. It only gets connections routed to it.
+type legacyPlugin struct {
+	name string
+	PluginV1
+}
+
+func (p *legacyPlugin) Name() string { return p.name }
+
+// TLSConfig returns the TLS configuration of the plugin without its certificates, version 1 plugins always used the
+// server certificate.
+func (p *legacyPlugin) TLSConfig() *tls.Config {
+	cfg := p.PluginV1.TLSConfig()
+	if cfg == nil {
+		return nil
+	}
+
+	cfg = cfg.Clone()
+	cfg.Certificates = nil
+	cfg.GetCertificate = nil
+
+	return cfg
+}
+
+func (p *legacyPlugin) Route(plugin.Hello) plugin.Verdict { return plugin.VerdictPass }
+
+func (p *legacyPlugin) Check(plugin.Meta) error { return nil }
+
+func (p *legacyPlugin) Serve(ctx context.Context, listener plugin.Listener) error {
+	if err := p.Listen(ctx, legacyListener{listener}); err != nil {
+		return fmt.Errorf("plugin %s: %w", p.name, err)
 	}
 
-	plugin, err := plugin.Open(path)
+	return nil
+}
+
+// legacyListener hands out the plain TLS connections version 1 plugins expect.
+type legacyListener struct{ plugin.Listener }
+
+func (l legacyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
 	if err != nil {
-		return nil, fmt.Errorf("load server plugin: %w", err)
+		return nil, err //nolint:wrapcheck
 	}
 
-	newPluginSymbol, err := plugin.Lookup(PluginNewSymbolName)
+	return conn.Conn, nil
+}
+
+// loadPlugins loads all plugins listed in [PluginPathEnvName] in order.
+func loadPlugins() ([]plugin.Plugin, error) {
+	paths := os.Getenv(PluginPathEnvName)
+	if paths == "" {
+		return nil, nil
+	}
+
+	var plugins []plugin.Plugin
+
+	for _, path := range filepath.SplitList(paths) {
+		loaded, err := loadPlugin(path)
+		if err != nil {
+			return nil, fmt.Errorf("load server plugins: %w", err)
+		}
+
+		plugins = append(plugins, loaded)
+	}
+
+	return plugins, nil
+}
+
+// loadPlugin loads the plugin at path. Version 1 plugins are named after their file.
+func loadPlugin(path string) (plugin.Plugin, error) { //nolint:ireturn
+	opened, err := goplugin.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("load server plugin: %w", err)
+		return nil, fmt.Errorf("load plugin %s: %w", path, err)
+	}
+
+	if symbol, err := opened.Lookup(plugin.NewSymbolName); err == nil {
+		newPlugin, ok := symbol.(func() plugin.Plugin)
+		if !ok {
+			return nil, fmt.Errorf("load plugin %s: %w: %s is %T", path, ErrPluginSymbol, plugin.NewSymbolName, symbol)
+		}
+
+		return newPlugin(), nil
+	}
+
+	symbol, err := opened.Lookup(PluginNewSymbolName)
+	if err != nil {
+		return nil, fmt.Errorf("load plugin %s: %w", path, err)
+	}
+
+	newPlugin, ok := symbol.(func() interface{})
+	if !ok {
+		return nil, fmt.Errorf("load plugin %s: %w: %s is %T", path, ErrPluginSymbol, PluginNewSymbolName, symbol)
+	}
+
+	legacy, ok := newPlugin().(PluginV1)
+	if !ok {
+		return nil, fmt.Errorf("load plugin %s: %w: %s returns no plugin", path, ErrPluginSymbol, PluginNewSymbolName)
+	}
+
+	return &legacyPlugin{strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), legacy}, nil
+}
+
+// attachPlugins prepares plugins for the listener. Plugins that bring no certificate get the one of store.
+func attachPlugins(plugins []plugin.Plugin, store *certs.Store) []listener.Plugin {
+	attached := make([]listener.Plugin, 0, len(plugins))
+
+	for _, p := range plugins {
+		cfg := p.TLSConfig()
+		if cfg == nil {
+			cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+
+		cfg = cfg.Clone()
+
+		if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil {
+			cfg.GetCertificate = store.GetCertificate
+		}
+
+		attached = append(attached, listener.Plugin{Plugin: p, TLS: cfg})
 	}
 
-	return newPluginSymbol.(func() interface{})().(Plugin), nil
+	return attached
 }
@@ -0,0 +1,387 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package policy decides what clients may do based on the attributes of their certificates. Rules match on subject
+// organization and organizational unit, SANs, certificate policies and custom extensions and decide whether a client
+// may connect, at what times, which tun it gets and how its duplicate sessions are handled.
+package policy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"eqrx.net/wallhack/internal/server/identity"
+	"eqrx.net/wallhack/internal/server/session"
+	"eqrx.net/wallhack/internal/tun"
+)
+
+// clockLayout is the layout of the start and end of time windows.
+const clockLayout = "15:04"
+
+var (
+	// ErrDenied indicates that a rule or the default denies the client.
+	ErrDenied = errors.New("denied by policy")
+	// ErrOutsideWindow indicates that the client is not allowed to connect at this time.
+	ErrOutsideWindow = errors.New("outside of allowed times")
+	// ErrConfig indicates that the policy configuration is invalid.
+	ErrConfig = errors.New("invalid policy config")
+)
+
+// weekdays maps the names of days used in windows to their value.
+var weekdays = map[string]time.Weekday{ //nolint:gochecknoglobals
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Match selects certificates. All set fields have to match, a list matches if any of its entries does. Patterns may
+// contain * which matches any number of characters.
+type Match struct {
+	// Organizations contains patterns for the subject organization.
+	Organizations []string `yaml:"organizations"`
+	// OrganizationalUnits contains patterns for the subject organizational unit.
+	OrganizationalUnits []string `yaml:"organizationalUnits"`
+	// DNS contains patterns for DNS SANs.
+	DNS []string `yaml:"dns"`
+	// URIs contains patterns for URI SANs.
+	URIs []string `yaml:"uris"`
+	// Emails contains patterns for email SANs.
+	Emails []string `yaml:"emails"`
+	// Policies contains certificate policy OIDs in dotted form.
+	Policies []string `yaml:"policies"`
+	// Extensions maps OIDs of extensions the certificate has to carry to their hex encoded DER value. An empty value
+	// only requires the extension to be present.
+	Extensions map[string]string `yaml:"extensions"`
+}
+
+// Window is a time span on certain days in which clients may connect.
+type Window struct {
+	// Days contains the days the window applies to: mon, tue, wed, thu, fri, sat or sun. Empty means every day.
+	Days []string `yaml:"days"`
+	// From is the start of the window, for example 08:00.
+	From string `yaml:"from"`
+	// To is the end of the window, for example 18:00. Windows that end before they start span midnight.
+	To string `yaml:"to"`
+}
+
+// Rule decides about clients whose certificate matches.
+type Rule struct {
+	// Name identifies the rule in logs.
+	Name string `yaml:"name"`
+	// Match selects the certificates the rule applies to.
+	Match Match `yaml:"match"`
+	// Deny rejects matching clients.
+	Deny bool `yaml:"deny"`
+	// Times restricts matching clients to the given windows. Sessions are ended when their window closes. Unset
+	// means at any time.
+	Times []Window `yaml:"times"`
+	// Tun is a text/template that renders the tun name of matching clients instead of the identity mapping. It gets
+	// passed the identity as dot.
+	Tun string `yaml:"tun"`
+	// Sessions overrides the duplicate session handling of matching clients.
+	Sessions *session.Rule `yaml:"sessions"`
+}
+
+// Config contains the policy rules.
+type Config struct {
+	// Rules are checked in order, the first matching rule decides.
+	Rules []Rule `yaml:"rules"`
+	// DefaultDeny rejects clients that match no rule. They are allowed otherwise.
+	DefaultDeny bool `yaml:"defaultDeny"`
+	// Timezone is the IANA name of the timezone windows are in. Defaults to the local timezone.
+	Timezone string `yaml:"timezone"`
+}
+
+// Decision is the outcome of the policy for a client.
+type Decision struct {
+	// Rule is the name of the rule that decided. Empty if no rule matched.
+	Rule string
+	// Tun is the tun name of the client. Empty if the identity mapping applies.
+	Tun string
+	// Sessions is the duplicate session handling of the client. Nil if the session config applies.
+	Sessions *session.Rule
+	// Until is the time the session of the client has to end. Zero if there is no limit.
+	Until time.Time
+}
+
+// window is a parsed [Window].
+type window struct {
+	days     map[time.Weekday]bool
+	from, to time.Duration
+}
+
+// rule is a parsed [Rule].
+type rule struct {
+	Rule
+	patterns   [][]*regexp.Regexp
+	extensions map[string][]byte
+	windows    []window
+	tun        *template.Template
+}
+
+// Policy decides about clients.
+type Policy struct {
+	rules       []*rule
+	defaultDeny bool
+	location    *time.Location
+}
+
+// New creates a new [Policy] from cfg.
+func New(cfg Config) (*Policy, error) {
+	policy := &Policy{defaultDeny: cfg.DefaultDeny, location: time.Local}
+
+	if cfg.Timezone != "" {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("new policy: %w", err)
+		}
+
+		policy.location = location
+	}
+
+	for i, r := range cfg.Rules {
+		parsed, err := newRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("new policy: rule %d: %w", i, err)
+		}
+
+		policy.rules = append(policy.rules, parsed)
+	}
+
+	return policy, nil
+}
+
+func newRule(r Rule) (*rule, error) {
+	parsed := &rule{Rule: r, extensions: map[string][]byte{}}
+
+	for _, patterns := range [][]string{
+		r.Match.Organizations, r.Match.OrganizationalUnits, r.Match.DNS, r.Match.URIs, r.Match.Emails,
+	} {
+		compiled := make([]*regexp.Regexp, 0, len(patterns))
+
+		for _, pattern := range patterns {
+			quoted := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+			compiled = append(compiled, regexp.MustCompile("^"+quoted+"$"))
+		}
+
+		parsed.patterns = append(parsed.patterns, compiled)
+	}
+
+	for oid, value := range r.Match.Extensions {
+		decoded, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: extension %s: %s", ErrConfig, oid, err.Error())
+		}
+
+		parsed.extensions[oid] = decoded
+	}
+
+	for _, w := range r.Times {
+		parsedWindow, err := newWindow(w)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed.windows = append(parsed.windows, parsedWindow)
+	}
+
+	if r.Tun != "" {
+		tmpl, err := template.New("tun").Option("missingkey=error").Parse(r.Tun)
+		if err != nil {
+			return nil, fmt.Errorf("%w: tun: %s", ErrConfig, err.Error())
+		}
+
+		parsed.tun = tmpl
+	}
+
+	if r.Sessions != nil {
+		if err := r.Sessions.Validate(); err != nil {
+			return nil, fmt.Errorf("sessions: %w", err)
+		}
+	}
+
+	return parsed, nil
+}
+
+func newWindow(w Window) (window, error) {
+	parsed := window{days: map[time.Weekday]bool{}}
+
+	for _, day := range w.Days {
+		weekday, ok := weekdays[day]
+		if !ok {
+			return window{}, fmt.Errorf("%w: unknown day %q", ErrConfig, day)
+		}
+
+		parsed.days[weekday] = true
+	}
+
+	for _, bound := range []struct {
+		value  string
+		target *time.Duration
+	}{{w.From, &parsed.from}, {w.To, &parsed.to}} {
+		clock, err := time.Parse(clockLayout, bound.value)
+		if err != nil {
+			return window{}, fmt.Errorf("%w: time %q: %s", ErrConfig, bound.value, err.Error())
+		}
+
+		*bound.target = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+	}
+
+	return parsed, nil
+}
+
+// Decide applies the policy to the client with the given certificate and identity at time now. Returns
+// [ErrDenied] or [ErrOutsideWindow] if the client may not connect.
+func (p *Policy) Decide(cert *x509.Certificate, id string, now time.Time) (Decision, error) {
+	for _, r := range p.rules {
+		if !r.matches(cert) {
+			continue
+		}
+
+		if r.Deny {
+			return Decision{}, fmt.Errorf("decide: %w: rule %s", ErrDenied, r.Name)
+		}
+
+		decision := Decision{Rule: r.Name, Sessions: r.Sessions}
+
+		if len(r.windows) != 0 {
+			until, ok := r.until(now.In(p.location))
+			if !ok {
+				return Decision{}, fmt.Errorf("decide: %w: rule %s", ErrOutsideWindow, r.Name)
+			}
+
+			decision.Until = until
+		}
+
+		if r.tun != nil {
+			rendered := &strings.Builder{}
+			if err := r.tun.Execute(rendered, id); err != nil {
+				return Decision{}, fmt.Errorf("decide: rule %s: %w", r.Name, err)
+			}
+
+			decision.Tun = rendered.String()
+			if tun.ValidName(decision.Tun) != nil {
+				decision.Tun = identity.Hashed(id)
+			}
+		}
+
+		return decision, nil
+	}
+
+	if p.defaultDeny {
+		return Decision{}, fmt.Errorf("decide: %w: no rule matched", ErrDenied)
+	}
+
+	return Decision{}, nil
+}
+
+// matches returns true if cert matches all conditions of the rule.
+func (r *rule) matches(cert *x509.Certificate) bool {
+	for i, values := range [][]string{
+		cert.Subject.Organization, cert.Subject.OrganizationalUnit, cert.DNSNames, uris(cert), cert.EmailAddresses,
+	} {
+		if len(r.patterns[i]) != 0 && !matchAny(r.patterns[i], values) {
+			return false
+		}
+	}
+
+	if len(r.Match.Policies) != 0 && !hasPolicy(cert, r.Match.Policies) {
+		return false
+	}
+
+	for oid, value := range r.extensions {
+		if !hasExtension(cert, oid, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// until returns the end of the latest window that contains now or false if now is in no window.
+func (r *rule) until(now time.Time) (time.Time, bool) {
+	var until time.Time
+
+	year, month, day := now.Date()
+
+	// Windows that span midnight may have started the day before.
+	for offset := -1; offset <= 0; offset++ {
+		midnight := time.Date(year, month, day+offset, 0, 0, 0, 0, now.Location())
+
+		for _, w := range r.windows {
+			if len(w.days) != 0 && !w.days[midnight.Weekday()] {
+				continue
+			}
+
+			start, end := midnight.Add(w.from), midnight.Add(w.to)
+			if w.to <= w.from {
+				end = end.AddDate(0, 0, 1)
+			}
+
+			if !now.Before(start) && now.Before(end) && end.After(until) {
+				until = end
+			}
+		}
+	}
+
+	return until, !until.IsZero()
+}
+
+func uris(cert *x509.Certificate) []string {
+	values := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		values = append(values, uri.String())
+	}
+
+	return values
+}
+
+func matchAny(patterns []*regexp.Regexp, values []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func hasPolicy(cert *x509.Certificate, oids []string) bool {
+	for _, policy := range cert.PolicyIdentifiers {
+		for _, oid := range oids {
+			if policy.String() == oid {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func hasExtension(cert *x509.Certificate, oid string, value []byte) bool {
+	for _, extension := range cert.Extensions {
+		if extension.Id.String() == oid && (len(value) == 0 || bytes.Equal(extension.Value, value)) {
+			return true
+		}
+	}
+
+	return false
+}
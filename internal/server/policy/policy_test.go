@@ -0,0 +1,136 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package policy_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"eqrx.net/wallhack/internal/server/policy"
+	"eqrx.net/wallhack/internal/server/session"
+)
+
+func cert(t *testing.T, unit string) *x509.Certificate {
+	t.Helper()
+
+	uri, err := url.Parse("spiffe://example.org/" + unit + "/laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "chicken", Organization: []string{"Example"}, OrganizationalUnit: []string{unit},
+		},
+		URIs:              []*url.URL{uri},
+		PolicyIdentifiers: []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 99999, 1}},
+		Extensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}, Value: []byte{0x05, 0x00}},
+		},
+	}
+}
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	p, err := policy.New(policy.Config{
+		Rules: []policy.Rule{
+			{Name: "blocked", Match: policy.Match{Extensions: map[string]string{"1.3.6.1.4.1.99999.2": "0101"}}, Deny: true},
+			{Name: "contractors", Match: policy.Match{
+				Organizations: []string{"Example"},
+				URIs:          []string{"spiffe://example.org/contractors/*"},
+				Policies:      []string{"1.3.6.1.4.1.99999.1"},
+				Extensions:    map[string]string{"1.3.6.1.4.1.99999.2": ""},
+			}, Tun: "c-{{.}}", Sessions: &session.Rule{Policy: session.PolicyReject}},
+		},
+		DefaultDeny: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decision, err := p.Decide(cert(t, "contractors"), "chicken", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decision.Rule != "contractors" || decision.Tun != "c-chicken" || decision.Sessions.Policy != session.PolicyReject {
+		t.Fatalf("unexpected decision %+v", decision)
+	}
+
+	if _, err := p.Decide(cert(t, "staff"), "chicken", time.Now()); !errors.Is(err, policy.ErrDenied) {
+		t.Fatal(err)
+	}
+
+	blocked := cert(t, "contractors")
+	blocked.Extensions[0].Value = []byte{0x01, 0x01}
+
+	if _, err := p.Decide(blocked, "chicken", time.Now()); !errors.Is(err, policy.ErrDenied) {
+		t.Fatal(err)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	t.Parallel()
+
+	p, err := policy.New(policy.Config{
+		Rules: []policy.Rule{{Times: []policy.Window{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "08:00", To: "18:00"},
+			{Days: []string{"sat"}, From: "22:00", To: "02:00"},
+		}}},
+		Timezone: "UTC",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for now, until := range map[time.Time]time.Time{
+		// Monday morning.
+		time.Date(2022, 9, 5, 9, 0, 0, 0, time.UTC): time.Date(2022, 9, 5, 18, 0, 0, 0, time.UTC),
+		// Saturday night, after midnight.
+		time.Date(2022, 9, 11, 1, 0, 0, 0, time.UTC): time.Date(2022, 9, 11, 2, 0, 0, 0, time.UTC),
+		// Monday evening.
+		time.Date(2022, 9, 5, 19, 0, 0, 0, time.UTC): {},
+		// Sunday night.
+		time.Date(2022, 9, 11, 23, 0, 0, 0, time.UTC): {},
+	} {
+		decision, err := p.Decide(cert(t, "staff"), "chicken", now)
+
+		switch {
+		case until.IsZero() && !errors.Is(err, policy.ErrOutsideWindow):
+			t.Fatalf("%s: %v", now, err)
+		case !until.IsZero() && (err != nil || !decision.Until.Equal(until)):
+			t.Fatalf("%s: want %s, have %s, %v", now, until, decision.Until, err)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	for _, rule := range []policy.Rule{
+		{Times: []policy.Window{{Days: []string{"caturday"}, From: "08:00", To: "18:00"}}},
+		{Times: []policy.Window{{From: "8 am", To: "18:00"}}},
+		{Match: policy.Match{Extensions: map[string]string{"1.2.3": "goose"}}},
+	} {
+		if _, err := policy.New(policy.Config{Rules: []policy.Rule{rule}}); !errors.Is(err, policy.ErrConfig) {
+			t.Fatal(err)
+		}
+	}
+}
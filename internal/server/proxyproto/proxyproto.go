@@ -0,0 +1,216 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package proxyproto reads and writes headers of the PROXY protocol version 1 and 2 as used by HAProxy to pass the
+// address of the original client to the server behind it.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// v1MaxLen is the maximum length of a version 1 header including CRLF.
+	v1MaxLen = 107
+	// v2HeaderLen is the length of the fixed part of a version 2 header.
+	v2HeaderLen = 16
+	// v2Version is the version nibble of version 2 headers.
+	v2Version = 0x20
+	// v2CmdLocal marks connections made by the proxy itself, for example health checks.
+	v2CmdLocal = 0x0
+	// v2CmdProxy marks proxied connections.
+	v2CmdProxy = 0x1
+	// v2TCP4 and v2TCP6 are the address family and protocol bytes of TCP over IPv4 and IPv6.
+	v2TCP4 = 0x11
+	v2TCP6 = 0x21
+	// v2TCP4Len and v2TCP6Len are the lengths of the address blocks of TCP over IPv4 and IPv6.
+	v2TCP4Len = 12
+	v2TCP6Len = 36
+)
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n") //nolint:gochecknoglobals
+
+var (
+	// ErrHeader indicates that a connection did not start with a valid PROXY protocol header.
+	ErrHeader = errors.New("invalid proxy protocol header")
+	// ErrVersion indicates that an unsupported PROXY protocol version was requested.
+	ErrVersion = errors.New("unsupported proxy protocol version")
+)
+
+// Read reads a version 1 or 2 header from r and returns the addresses of the client and the server it connected to.
+// Invalid addresses are returned if the header carries none, for example for health checks of the proxy.
+func Read(r *bufio.Reader) (netip.AddrPort, netip.AddrPort, error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("read: %w", err)
+	}
+
+	if bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+
+	return readV1(r)
+}
+
+func readV1(r *bufio.Reader) (netip.AddrPort, netip.AddrPort, error) {
+	line := make([]byte, 0, v1MaxLen)
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLen {
+			return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: line too long", ErrHeader)
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("read v1: %w", err)
+		}
+
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	switch {
+	case len(fields) >= 2 && fields[0] == "PROXY" && fields[1] == "UNKNOWN":
+		return netip.AddrPort{}, netip.AddrPort{}, nil
+	case len(fields) != 6 || fields[0] != "PROXY" || (fields[1] != "TCP4" && fields[1] != "TCP6"):
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: %q", ErrHeader, line)
+	}
+
+	src, err := parseV1(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, err
+	}
+
+	dst, err := parseV1(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, err
+	}
+
+	return src, dst, nil
+}
+
+func parseV1(addrStr, portStr string, is4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil || addr.Is4() != is4 {
+		return netip.AddrPort{}, fmt.Errorf("%w: address %q", ErrHeader, addrStr)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: port %q", ErrHeader, portStr)
+	}
+
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+func readV2(r *bufio.Reader) (netip.AddrPort, netip.AddrPort, error) {
+	header := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("read v2: %w", err)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("read v2: %w", err)
+	}
+
+	if header[12]&0xf0 != v2Version {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: version %#x", ErrHeader, header[12]>>4)
+	}
+
+	switch header[12] & 0x0f {
+	case v2CmdLocal:
+		return netip.AddrPort{}, netip.AddrPort{}, nil
+	case v2CmdProxy:
+	default:
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: command %#x", ErrHeader, header[12]&0x0f)
+	}
+
+	var addrLen int
+
+	switch header[13] {
+	case v2TCP4:
+		addrLen = 4
+	case v2TCP6:
+		addrLen = 16
+	default:
+		// Other families carry nothing we could use as remote address.
+		return netip.AddrPort{}, netip.AddrPort{}, nil
+	}
+
+	if len(body) < 2*addrLen+4 {
+		return netip.AddrPort{}, netip.AddrPort{}, fmt.Errorf("%w: address block too short", ErrHeader)
+	}
+
+	srcAddr, _ := netip.AddrFromSlice(body[:addrLen])
+	dstAddr, _ := netip.AddrFromSlice(body[addrLen : 2*addrLen])
+	ports := body[2*addrLen:]
+
+	return netip.AddrPortFrom(srcAddr, binary.BigEndian.Uint16(ports)),
+		netip.AddrPortFrom(dstAddr, binary.BigEndian.Uint16(ports[2:])), nil
+}
+
+// Header returns a header of the given version that describes a connection from src to dst. If src and dst are not
+// both valid and of the same IP version, the header marks the connection as unknown or local.
+func Header(version int, src, dst netip.AddrPort) ([]byte, error) {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	known := src.IsValid() && dst.IsValid() && src.Addr().Is4() == dst.Addr().Is4()
+
+	switch version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+
+		family := "TCP6"
+		if src.Addr().Is4() {
+			family = "TCP4"
+		}
+
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			family, src.Addr(), dst.Addr(), src.Port(), dst.Port())), nil
+	case 2: //nolint:gomnd
+		header := append([]byte{}, v2Signature...)
+
+		if !known {
+			return append(header, v2Version|v2CmdLocal, 0, 0, 0), nil
+		}
+
+		family, addrLen := byte(v2TCP6), v2TCP6Len
+		if src.Addr().Is4() {
+			family, addrLen = v2TCP4, v2TCP4Len
+		}
+
+		header = append(header, v2Version|v2CmdProxy, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(addrLen))
+		header = append(header, src.Addr().AsSlice()...)
+		header = append(header, dst.Addr().AsSlice()...)
+		header = binary.BigEndian.AppendUint16(header, src.Port())
+		header = binary.BigEndian.AppendUint16(header, dst.Port())
+
+		return header, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrVersion, version)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"eqrx.net/wallhack/internal/server/proxyproto"
+)
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	pairs := [][2]netip.AddrPort{
+		{netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:443")},
+		{netip.MustParseAddrPort("[2001:db8::1]:56324"), netip.MustParseAddrPort("[2001:db8::2]:443")},
+	}
+
+	for _, version := range []int{1, 2} {
+		for _, pair := range pairs {
+			header, err := proxyproto.Header(version, pair[0], pair[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := bufio.NewReader(bytes.NewReader(append(header, "chicken"...)))
+
+			src, dst, err := proxyproto.Read(reader)
+			if err != nil {
+				t.Fatal(version, err)
+			}
+
+			if src != pair[0] || dst != pair[1] {
+				t.Fatal(version, src, dst)
+			}
+
+			if rest, _ := reader.ReadString(0); rest != "chicken" {
+				t.Fatal(version, rest)
+			}
+		}
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []int{1, 2} {
+		header, err := proxyproto.Header(version, netip.AddrPort{}, netip.MustParseAddrPort("192.0.2.1:443"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		src, _, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(header)))
+		if err != nil || src.IsValid() {
+			t.Fatal(version, src, err)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 65536\r\n",
+		"GET / HTTP/1.1\r\n",
+		"PROXY " + strings.Repeat("A", 120) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00",
+	} {
+		_, _, err := proxyproto.Read(bufio.NewReader(strings.NewReader(header)))
+		if !errors.Is(err, proxyproto.ErrHeader) {
+			t.Fatalf("%q: %v", header, err)
+		}
+	}
+
+	if _, err := proxyproto.Header(3, netip.AddrPort{}, netip.AddrPort{}); !errors.Is(err, proxyproto.ErrVersion) {
+		t.Fatal(err)
+	}
+}
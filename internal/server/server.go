@@ -19,77 +19,298 @@ package server
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 
 	"eqrx.net/rungroup"
 	"eqrx.net/service"
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/packet"
+	"eqrx.net/wallhack/internal/proto"
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/addressing"
+	"eqrx.net/wallhack/internal/server/admin"
+	"eqrx.net/wallhack/internal/server/fallback"
+	"eqrx.net/wallhack/internal/server/hub"
 	"eqrx.net/wallhack/internal/server/listener"
+	"eqrx.net/wallhack/internal/server/session"
+	"eqrx.net/wallhack/internal/server/tenant"
+	"eqrx.net/wallhack/internal/server/tuns"
+	"eqrx.net/wallhack/internal/tun"
 	"github.com/go-logr/logr"
 )
 
-var errCaMissing = errors.New("no CA configured")
+var (
+	// errHubTap indicates that the hub tun is configured as tap. The hub routes IP packets, so it only works with
+	// tuns.
+	errHubTap = errors.New("hub does not work with taps")
+	// errHubQueues indicates that more than one queue is configured in hub mode. The hub reads its tun from a single
+	// goroutine, so additional queues would never be read.
+	errHubQueues = errors.New("hub does not work with multiple queues")
+	// errHubOffload indicates that offloads are configured in hub mode. The hub routes single IP packets, not
+	// super-packets.
+	errHubOffload = errors.New("hub does not work with offloads")
+)
+
+func tlsConf(store *certs.Store, tenants tenant.Set) (*tls.Config, error) {
+	if !tenants.Enabled() {
+		return nil, fmt.Errorf("tls conf: %w", certs.ErrNoCA)
+	}
+
+	config := &tls.Config{
+		GetCertificate:           store.GetCertificate,
+		VerifyPeerCertificate:    tenants.VerifyPeerCertificate,
+		PreferServerCipherSuites: true,
+		MinVersion:               tls.VersionTLS13,
+		NextProtos:               proto.NextProtos(),
+		ClientAuth:               tls.RequireAnyClientCert,
+	}
 
-func tlsConf(service *service.Service) (*tls.Config, error) {
-	certData, err := service.LoadCred("cert")
+	return config, nil
+}
+
+// openHub attaches the shared hub tun, configures the pool responsible for it and creates the hub. The returned
+// function undoes the tun configuration.
+func (b *bridger) openHub(log logr.Logger, cfg hub.Config) (func(), error) {
+	t, created, err := b.tuns.Open(cfg.Tun)
 	if err != nil {
-		return nil, fmt.Errorf("tls conf: %w", err)
+		return nil, fmt.Errorf("open hub: %w", err)
+	}
+
+	// Checked on the tun itself since a tun helper decides about its properties.
+	switch {
+	case t.Mode() == tun.ModeTap:
+		err = errHubTap
+	case len(t.Queues()) != 1:
+		err = errHubQueues
+	case t.Offload():
+		err = errHubOffload
 	}
 
-	keyData, err := service.LoadCred("key")
 	if err != nil {
-		return nil, fmt.Errorf("tls conf: %w", err)
+		_ = t.Close()
+
+		return nil, fmt.Errorf("open hub: %w", err)
 	}
 
-	caData, err := service.LoadCred("ca")
+	shared, _ := b.addresses.Shared(cfg.Tun)
+
+	revert, err := b.tuns.Configure(cfg.Tun, created, shared)
 	if err != nil {
-		return nil, fmt.Errorf("tls conf: %w", err)
+		_ = t.Close()
+
+		return nil, fmt.Errorf("open hub: %w", err)
+	}
+
+	b.hub = hub.New(cfg, packet.NewReadWriteCloser(t, packet.NewMTUReader(t)))
+
+	return func() {
+		if err := revert(); err != nil {
+			log.Error(err, "unconfigure hub tun")
+		}
+	}, nil
+}
+
+// routeStores loads the certificates of listener routes that have their own and hooks them into the routes.
+// CA, intermediates, CRL and verification settings are shared with the server certificate.
+func routeStores(service *service.Service, cfg *config) ([]*certs.Store, error) {
+	var stores []*certs.Store
+
+	for i := range cfg.Listener.Routes {
+		route := &cfg.Listener.Routes[i]
+		if route.Cert == "" {
+			continue
+		}
+
+		store, err := certs.New(certs.Config{
+			Cert:             route.Cert,
+			Key:              route.Key,
+			CA:               cfg.TLS.CA,
+			CRL:              cfg.TLS.CRL,
+			Intermediates:    cfg.TLS.Intermediates,
+			MaxIntermediates: cfg.TLS.MaxIntermediates,
+			KeyUsages:        cfg.TLS.KeyUsages,
+			WatchInterval:    cfg.TLS.WatchInterval,
+		}, service.CredPath)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+
+		route.GetCertificate = store.GetCertificate
+		stores = append(stores, store)
+	}
+
+	return stores, nil
+}
+
+// routeTenants lets unknown keys arriving on listener routes with a tenant enroll with that tenant.
+func routeTenants(cfg *config, tenants tenant.Set) error {
+	for i := range cfg.Listener.Routes {
+		route := &cfg.Listener.Routes[i]
+		if route.Tenant == "" {
+			continue
+		}
+
+		if tenants.Lookup(route.Tenant) == nil {
+			return fmt.Errorf("route %d: %w: no tenant %s", i, tenant.ErrConfig, route.Tenant)
+		}
+
+		route.VerifyPeerCertificate = tenants.VerifyPeerCertificateFor(route.Tenant)
+	}
+
+	return nil
+}
+
+// checkAddressTenants makes sure that all tenants with an address pool exist.
+func checkAddressTenants(cfg *config, tenants tenant.Set) error {
+	for name := range cfg.Addressing.Tenants {
+		if tenants.Lookup(name) == nil {
+			return fmt.Errorf("addressing: %w: no tenant %s", tenant.ErrConfig, name)
+		}
+	}
+
+	return nil
+}
+
+// loadTenants creates the default tenant from the top level configuration and all configured tenants.
+func loadTenants(service *service.Service, cfg *config, store *certs.Store) (tenant.Set, error) {
+	tunPrefix := ""
+
+	switch {
+	case cfg.TunPrefix != nil:
+		tunPrefix = *cfg.TunPrefix
+	case len(cfg.Tenants) != 0:
+		tunPrefix = tenant.DefaultTunPrefix
 	}
 
-	cert, err := tls.X509KeyPair(certData, keyData)
+	defaultTenant, err := tenant.NewDefault(store, cfg.Pins, cfg.Identity, cfg.Policy, cfg.Sessions, tunPrefix)
 	if err != nil {
-		return nil, fmt.Errorf("tls conf: load certs: %w", err)
+		return nil, fmt.Errorf("load tenants: %w", err)
 	}
 
-	clientCAs := x509.NewCertPool()
-	if !clientCAs.AppendCertsFromPEM(caData) {
-		return nil, errCaMissing
+	tenants := tenant.Set{defaultTenant}
+	names := map[string]bool{}
+
+	for _, tenantCfg := range cfg.Tenants {
+		if names[tenantCfg.Name] {
+			return nil, fmt.Errorf("load tenants: %w: %s configured twice", tenant.ErrConfig, tenantCfg.Name)
+		}
+
+		names[tenantCfg.Name] = true
+
+		loaded, err := tenant.New(tenantCfg, cfg.TLS, service.CredPath)
+		if err != nil {
+			return nil, fmt.Errorf("load tenants: %w", err)
+		}
+
+		tenants = append(tenants, loaded)
 	}
 
-	config := &tls.Config{
-		Certificates:             []tls.Certificate{cert},
-		ClientCAs:                clientCAs,
-		PreferServerCipherSuites: true,
-		MinVersion:               tls.VersionTLS13,
-		NextProtos:               []string{"wallhack"},
-		ClientAuth:               tls.RequireAndVerifyClientCert,
+	if err := tenants.Validate(); err != nil {
+		return nil, fmt.Errorf("load tenants: %w", err)
 	}
 
-	return config, nil
+	return tenants, nil
 }
 
 // Run wallhack in server mode.
 func Run(ctx context.Context, log logr.Logger, service *service.Service) error {
-	tlsConfig, err := tlsConf(service)
+	cfg, err := loadConfig(service)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	store, err := certs.New(cfg.TLS, service.CredPath)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	tenants, err := loadTenants(service, cfg, store)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	sessions, err := session.New(cfg.Sessions)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	if err := checkAddressTenants(cfg, tenants); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	addresses, err := addressing.New(cfg.Addressing)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	opener, err := tuns.New(cfg.Tuns)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	guard := abuse.New(cfg.Abuse)
+
+	bridger := &bridger{
+		tenants: tenants, sessions: sessions, addresses: addresses, hubCfg: cfg.Hub, guard: guard, tuns: opener,
+	}
+
+	if cfg.Hub.Enabled() {
+		revert, err := bridger.openHub(log, cfg.Hub)
+		if err != nil {
+			return fmt.Errorf("server: %w", err)
+		}
+
+		defer revert()
+	}
+
+	tlsConfig, err := tlsConf(store, tenants)
 	if err != nil {
 		return fmt.Errorf("server: %w", err)
 	}
 
 	listeners := service.Listeners()
 
-	plugin, err := loadPlugin()
+	plugins, err := loadPlugins()
 	if err != nil {
-		return err
+		return fmt.Errorf("server: %w", err)
 	}
 
-	var pluginTLSConfig *tls.Config
-	if plugin != nil {
-		pluginTLSConfig = plugin.TLSConfig()
-		pluginTLSConfig.Certificates = []tls.Certificate{tlsConfig.Certificates[0]}
+	var (
+		fallbackServer    *fallback.Fallback
+		fallbackTLSConfig *tls.Config
+	)
+
+	if cfg.Fallback.Enabled() {
+		fallbackServer, err = fallback.New(cfg.Fallback)
+		if err != nil {
+			return fmt.Errorf("server: %w", err)
+		}
+
+		fallbackTLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: store.GetCertificate,
+			NextProtos:     fallback.NextProtos,
+		}
 	}
 
-	comboListener := listener.New(listeners, tlsConfig, pluginTLSConfig)
+	stores, err := routeStores(service, cfg)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	if err := routeTenants(cfg, tenants); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	comboListener, err := listener.New(
+		cfg.Listener, listeners, tlsConfig, attachPlugins(plugins, store), fallbackTLSConfig,
+	)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	comboListener.SetGate(guard)
 
 	group := rungroup.New(ctx)
 	group.Go(func(ctx context.Context) error {
@@ -99,18 +320,49 @@ func Run(ctx context.Context, log logr.Logger, service *service.Service) error {
 
 		return nil
 	})
-	group.Go(func(ctx context.Context) error { return accept(ctx, log, service, comboListener.WallhackListener()) })
+	group.Go(func(ctx context.Context) error {
+		return bridger.accept(ctx, log, service, comboListener.WallhackListener())
+	})
 
-	if plugin != nil {
+	for _, p := range plugins {
+		p := p
 		group.Go(func(ctx context.Context) error {
-			if err := plugin.Listen(ctx, comboListener.PluginListener()); err != nil {
-				return fmt.Errorf("plugin listen: %w", err)
+			if err := p.Serve(ctx, comboListener.PluginListener(p.Name())); err != nil {
+				return fmt.Errorf("plugin %s: %w", p.Name(), err)
 			}
 
 			return nil
 		})
 	}
 
+	if fallbackServer != nil {
+		group.Go(func(ctx context.Context) error {
+			return fallbackServer.Serve(ctx, log, comboListener.FallbackListener())
+		})
+	}
+
+	if bridger.hub != nil {
+		group.Go(bridger.hub.Run)
+	}
+
+	group.Go(guard.Run)
+
+	if cfg.Admin.Enabled() {
+		adminServer := admin.New(cfg.Admin, guard, comboListener, tenants)
+		group.Go(func(ctx context.Context) error { return adminServer.Serve(ctx, log) })
+	}
+
+	for _, extra := range tenants[1:] {
+		if extra.Store != nil {
+			stores = append(stores, extra.Store)
+		}
+	}
+
+	for _, store := range append(stores, store) {
+		store := store
+		group.Go(func(ctx context.Context) error { return store.Run(ctx, log) })
+	}
+
 	group.Go(service.RunNotify)
 
 	if err := group.Wait(); err != nil {
@@ -0,0 +1,239 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package session keeps track of the running client sessions of the server and decides what happens when a client
+// connects while it still has sessions running.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Policy names what happens when a client connects while it already has a running session.
+type Policy string
+
+const (
+	// PolicyReplace ends the running session in favor of the new one. This is the default.
+	PolicyReplace Policy = "replace"
+	// PolicyReject keeps the running session and rejects the new one.
+	PolicyReject Policy = "reject"
+	// PolicyParallel allows up to Max sessions at the same time. When all slots are taken the oldest
+	// session is replaced.
+	PolicyParallel Policy = "parallel"
+)
+
+var (
+	// ErrRejected indicates that a session was rejected because the client already has one running.
+	ErrRejected = errors.New("client already has a running session")
+	// ErrPolicy indicates that a configured policy is not supported.
+	ErrPolicy = errors.New("unsupported session policy")
+)
+
+// Rule specifies how duplicate sessions are handled.
+type Rule struct {
+	// Policy to apply. Defaults to [PolicyReplace].
+	Policy Policy `yaml:"policy"`
+	// Max is the number of parallel sessions allowed with [PolicyParallel]. Defaults to 1.
+	Max int `yaml:"max"`
+}
+
+// Config specifies the duplicate session handling for all clients.
+type Config struct {
+	// Rule is applied to all clients that have no rule of their own.
+	Rule `yaml:",inline"`
+	// Clients contains rules for specific clients, keyed by their identity.
+	Clients map[string]Rule `yaml:"clients"`
+}
+
+// Session is a running client session.
+type Session struct {
+	// Key identifies the client the session belongs to.
+	Key string
+	// Slot is the index of the session among the parallel sessions of its client, starting at zero.
+	Slot int
+	// RemoteAddr is the address of the client.
+	RemoteAddr string
+
+	ctx         context.Context //nolint:containedctx // The session context is handed out on purpose.
+	cancel      context.CancelFunc
+	done        chan struct{}
+	predecessor *Session
+	registry    *Registry
+}
+
+// Context returns the context of the session. It is canceled when the session gets replaced.
+func (s *Session) Context() context.Context { return s.ctx }
+
+// WaitPredecessor blocks until the session that was replaced by this one has ended or ctx is done.
+func (s *Session) WaitPredecessor(ctx context.Context) error {
+	if s.predecessor == nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("wait predecessor: %w", ctx.Err())
+	case <-s.predecessor.done:
+		return nil
+	}
+}
+
+// End removes the session from its registry and marks it as ended. Must be called exactly once.
+func (s *Session) End() {
+	s.cancel()
+
+	s.registry.mtx.Lock()
+	defer s.registry.mtx.Unlock()
+
+	sessions := s.registry.sessions[s.Key]
+	for i, other := range sessions {
+		if other == s {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+
+			break
+		}
+	}
+
+	if len(sessions) == 0 {
+		delete(s.registry.sessions, s.Key)
+	} else {
+		s.registry.sessions[s.Key] = sessions
+	}
+
+	close(s.done)
+}
+
+// Registry keeps track of running sessions.
+type Registry struct {
+	cfg      Config
+	mtx      sync.Mutex
+	sessions map[string][]*Session
+}
+
+// New creates a new [Registry] that handles duplicate sessions according to cfg.
+func New(cfg Config) (*Registry, error) {
+	if err := cfg.Rule.Validate(); err != nil {
+		return nil, fmt.Errorf("new session registry: %w", err)
+	}
+
+	for key, rule := range cfg.Clients {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("new session registry: client %q: %w", key, err)
+		}
+	}
+
+	return &Registry{cfg: cfg, sessions: map[string][]*Session{}}, nil
+}
+
+// Start registers a new session for the client identified by key. It returns the new session and, if one had to
+// make room for it, the session that got replaced. The replaced session is canceled; callers should
+// use [Session.WaitPredecessor] before using resources of the slot. Returns [ErrRejected] if the policy forbids a new
+// session.
+func (r *Registry) Start(ctx context.Context, key, remoteAddr string) (started, replaced *Session, err error) {
+	return r.StartRule(ctx, key, remoteAddr, r.rule(key))
+}
+
+// StartRule works like [Registry.Start] but applies rule instead of the configured rule of the client.
+func (r *Registry) StartRule(
+	ctx context.Context, key, remoteAddr string, rule Rule,
+) (started, replaced *Session, err error) {
+	rule = rule.normalize()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	running := r.sessions[key]
+
+	if len(running) != 0 && rule.Policy == PolicyReject {
+		return nil, nil, fmt.Errorf("start session: %w: %s", ErrRejected, running[0].RemoteAddr)
+	}
+
+	slot := freeSlot(running, rule.Max)
+
+	if slot < 0 {
+		replaced = running[0]
+		running = running[1:]
+		slot = replaced.Slot
+
+		replaced.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	started = &Session{key, slot, remoteAddr, ctx, cancel, make(chan struct{}), replaced, r}
+	r.sessions[key] = append(running[:len(running):len(running)], started)
+
+	return started, replaced, nil
+}
+
+// Count returns the number of running sessions of the client identified by key.
+func (r *Registry) Count(key string) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return len(r.sessions[key])
+}
+
+// rule returns the configured rule for the client identified by key.
+func (r *Registry) rule(key string) Rule { return r.cfg.For(key) }
+
+// For returns the rule that applies to the client identified by key.
+func (c Config) For(key string) Rule {
+	rule, ok := c.Clients[key]
+	if !ok {
+		rule = c.Rule
+	}
+
+	return rule
+}
+
+// normalize fills in the defaults of the rule.
+func (r Rule) normalize() Rule {
+	if r.Policy == "" {
+		r.Policy = PolicyReplace
+	}
+
+	if r.Policy != PolicyParallel || r.Max < 1 {
+		r.Max = 1
+	}
+
+	return r
+}
+
+// Validate returns [ErrPolicy] if the policy of the rule is not supported.
+func (r Rule) Validate() error {
+	switch r.Policy {
+	case "", PolicyReplace, PolicyReject, PolicyParallel:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrPolicy, r.Policy)
+	}
+}
+
+// freeSlot returns the lowest slot index below max that is not used by running or -1 if all are taken.
+func freeSlot(running []*Session, max int) int {
+	used := make(map[int]bool, len(running))
+	for _, session := range running {
+		used[session.Slot] = true
+	}
+
+	for slot := 0; slot < max; slot++ {
+		if !used[slot] {
+			return slot
+		}
+	}
+
+	return -1
+}
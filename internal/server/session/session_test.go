@@ -0,0 +1,142 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package session_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"eqrx.net/wallhack/internal/server/session"
+)
+
+func registry(t *testing.T, cfg session.Config) *session.Registry {
+	t.Helper()
+
+	registry, err := session.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return registry
+}
+
+func TestReplace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	registry := registry(t, session.Config{})
+
+	first, replaced, err := registry.Start(ctx, "chicken", "a")
+	if err != nil || replaced != nil {
+		t.Fatal(err, replaced)
+	}
+
+	second, replaced, err := registry.Start(ctx, "chicken", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced != first {
+		t.Fatal("first session not replaced")
+	}
+
+	if first.Context().Err() == nil {
+		t.Fatal("replaced session not canceled")
+	}
+
+	if second.Slot != first.Slot {
+		t.Fatalf("slot changed: %d -> %d", first.Slot, second.Slot)
+	}
+
+	first.End()
+
+	if err := second.WaitPredecessor(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := registry.Count("chicken"); count != 1 {
+		t.Fatal(count)
+	}
+
+	second.End()
+
+	if count := registry.Count("chicken"); count != 0 {
+		t.Fatal(count)
+	}
+}
+
+func TestReject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	registry := registry(t, session.Config{Clients: map[string]session.Rule{"chicken": {Policy: session.PolicyReject}}})
+
+	first, _, err := registry.Start(ctx, "chicken", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := registry.Start(ctx, "chicken", "b"); !errors.Is(err, session.ErrRejected) {
+		t.Fatal(err)
+	}
+
+	if _, _, err := registry.Start(ctx, "goose", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	first.End()
+
+	if _, _, err := registry.Start(ctx, "chicken", "b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	registry := registry(t, session.Config{Rule: session.Rule{Policy: session.PolicyParallel, Max: 2}})
+
+	first, _, err := registry.Start(ctx, "chicken", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, replaced, err := registry.Start(ctx, "chicken", "b")
+	if err != nil || replaced != nil {
+		t.Fatal(err, replaced)
+	}
+
+	if first.Slot != 0 || second.Slot != 1 {
+		t.Fatal(first.Slot, second.Slot)
+	}
+
+	third, replaced, err := registry.Start(ctx, "chicken", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced != first || third.Slot != 0 {
+		t.Fatal("oldest session not replaced")
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	t.Parallel()
+
+	if _, err := session.New(session.Config{Rule: session.Rule{Policy: "random"}}); !errors.Is(err, session.ErrPolicy) {
+		t.Fatal(err)
+	}
+}
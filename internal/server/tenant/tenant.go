@@ -0,0 +1,463 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package tenant lets several client CAs share one server. Each tenant has its own CA and pinned keys and its own
+// namespace of identities, tun names, policies and limits, so clients of different tenants may use the same identity.
+package tenant
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/identity"
+	"eqrx.net/wallhack/internal/server/pinning"
+	"eqrx.net/wallhack/internal/server/policy"
+	"eqrx.net/wallhack/internal/server/session"
+	"eqrx.net/wallhack/internal/tun"
+)
+
+const (
+	// keySeparator separates the tenant name from the identity in client keys.
+	keySeparator = "/"
+	// DefaultTunPrefix is the tun prefix of the default tenant if there are other tenants and none is configured.
+	DefaultTunPrefix = "default-"
+)
+
+var (
+	// ErrNoTenant indicates that the client certificate is not issued by the CA of any tenant.
+	ErrNoTenant = errors.New("certificate issued by no tenant")
+	// ErrConfig indicates that a tenant is misconfigured.
+	ErrConfig = errors.New("invalid tenant config")
+)
+
+// Config describes a tenant besides the default one.
+type Config struct {
+	// Name identifies the tenant. Identities of its clients are qualified as <name>/<identity> wherever all tenants
+	// share a namespace, for example in static addresses and hub prefixes.
+	Name string `yaml:"name"`
+	// CA is the path to the PEM encoded CA certificates the clients of the tenant are verified against. Optional if
+	// Pins are configured.
+	CA string `yaml:"ca"`
+	// CRL is the path to the revocation lists of the CA.
+	CRL string `yaml:"crl"`
+	// Intermediates is the path to intermediate CA certificates of the tenant.
+	Intermediates string `yaml:"intermediates"`
+	// Pins authenticates clients of the tenant by their public key instead of the CA.
+	Pins pinning.Config `yaml:"pins"`
+	// TunPrefix is put in front of the tun names of the clients. Defaults to the name followed by a dash.
+	TunPrefix *string `yaml:"tunPrefix"`
+	// Identity specifies how clients of the tenant are identified and mapped to tuns.
+	Identity identity.Config `yaml:"identity"`
+	// Policy decides what clients of the tenant may do.
+	Policy policy.Config `yaml:"policy"`
+	// Sessions specifies how clients of the tenant with more than one connection are handled.
+	Sessions session.Config `yaml:"sessions"`
+	// MaxSessions is the number of sessions the tenant may have in total. 0 means no limit.
+	MaxSessions int `yaml:"maxSessions"`
+	// MaxSessionsPerClient is the number of sessions allowed per client of the tenant. 0 means no limit.
+	MaxSessionsPerClient int `yaml:"maxSessionsPerClient"`
+}
+
+// Tenant is a CA with its clients.
+type Tenant struct {
+	// Name identifies the tenant, empty for the default tenant.
+	Name string
+	// Store holds the TLS material of the tenant. Nil if the tenant only has pinned keys.
+	Store *certs.Store
+	// Pins holds the pinned keys of the tenant. Nil if the tenant has none.
+	Pins *pinning.Pins
+
+	resolver  *identity.Resolver
+	policy    *policy.Policy
+	sessions  session.Config
+	guard     *abuse.Guard
+	tunPrefix string
+}
+
+// NewDefault creates the default tenant from the top level configuration of the server. It has no name and no limits
+// of its own. tunPrefix is put in front of the tun names of its clients.
+func NewDefault(
+	store *certs.Store, pinsCfg pinning.Config, idCfg identity.Config, policyCfg policy.Config, sessions session.Config,
+	tunPrefix string,
+) (*Tenant, error) {
+	tenant := &Tenant{Store: store, sessions: sessions, tunPrefix: tunPrefix}
+
+	if err := tenant.init(pinsCfg, idCfg, policyCfg); err != nil {
+		return nil, fmt.Errorf("new default tenant: %w", err)
+	}
+
+	return tenant, nil
+}
+
+// New creates a tenant from cfg. tlsCfg is the TLS configuration of the server, its certificate and verification
+// settings are shared with the tenant.
+func New(cfg Config, tlsCfg certs.Config, credPath func(name string) string) (*Tenant, error) {
+	if cfg.Name == "" || strings.Contains(cfg.Name, keySeparator) || (cfg.CA == "" && !cfg.Pins.Enabled()) {
+		return nil, fmt.Errorf(
+			"new tenant %q: %w: name without %s and ca or pins required", cfg.Name, ErrConfig, keySeparator,
+		)
+	}
+
+	if _, err := session.New(cfg.Sessions); err != nil {
+		return nil, fmt.Errorf("new tenant %s: %w", cfg.Name, err)
+	}
+
+	tenant := &Tenant{
+		Name:      cfg.Name,
+		sessions:  cfg.Sessions,
+		tunPrefix: cfg.Name + "-",
+		guard:     abuse.New(abuse.Config{MaxSessions: cfg.MaxSessions, MaxSessionsPerClient: cfg.MaxSessionsPerClient}),
+	}
+
+	if cfg.TunPrefix != nil {
+		tenant.tunPrefix = *cfg.TunPrefix
+	}
+
+	if cfg.CA != "" {
+		tlsCfg.CA, tlsCfg.CRL, tlsCfg.Intermediates = cfg.CA, cfg.CRL, cfg.Intermediates
+
+		store, err := certs.New(tlsCfg, credPath)
+		if err != nil {
+			return nil, fmt.Errorf("new tenant %s: %w", cfg.Name, err)
+		}
+
+		tenant.Store = store
+	}
+
+	if err := tenant.init(cfg.Pins, cfg.Identity, cfg.Policy); err != nil {
+		return nil, fmt.Errorf("new tenant %s: %w", cfg.Name, err)
+	}
+
+	return tenant, nil
+}
+
+func (t *Tenant) init(pinsCfg pinning.Config, idCfg identity.Config, policyCfg policy.Config) error {
+	if pinsCfg.Enabled() {
+		pins, err := pinning.New(pinsCfg)
+		if err != nil {
+			return fmt.Errorf("init: %w", err)
+		}
+
+		t.Pins = pins
+	}
+
+	resolver, err := identity.New(idCfg)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	policy, err := policy.New(policyCfg)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	t.resolver, t.policy = resolver, policy
+
+	return nil
+}
+
+// hasCA returns true if the tenant verifies clients against a CA.
+func (t *Tenant) hasCA() bool { return t.Store != nil && t.Store.HasCA() }
+
+// verify checks whether the tenant accepts peerCerts (leaf first). Returns the identity of the client if it is
+// accepted by its pinned key instead of the CA.
+func (t *Tenant) verify(peerCerts []*x509.Certificate) (pinnedID string, err error) {
+	if t.Pins != nil {
+		if id, ok := t.Pins.Lookup(peerCerts[0]); ok {
+			return id, nil
+		}
+	}
+
+	if !t.hasCA() {
+		return "", pinning.ErrUnknownKey
+	}
+
+	if _, err := t.Store.Verify(peerCerts); err != nil {
+		return "", fmt.Errorf("verify: %w", err)
+	}
+
+	return "", nil
+}
+
+// key qualifies id with the name of the tenant.
+func (t *Tenant) key(id string) string {
+	if t.Name == "" {
+		return id
+	}
+
+	return t.Name + keySeparator + id
+}
+
+// tunName prefixes name with the tun prefix of the tenant. Names that get too long are hashed.
+func (t *Tenant) tunName(name, id string) string {
+	prefixed := t.tunPrefix + name
+	if tun.ValidName(prefixed) != nil {
+		return identity.Hashed(t.key(id))
+	}
+
+	return prefixed
+}
+
+// Client is a client of a tenant.
+type Client struct {
+	// Tenant is the tenant that issued the client certificate.
+	Tenant *Tenant
+	// ID is the identity of the client within its tenant.
+	ID string
+	// Key identifies the client among the clients of all tenants.
+	Key string
+	// Tun is the name of the tun of the client.
+	Tun string
+	// Netns is the network namespace the tun of the client lives in. Empty means the namespace of wallhack.
+	Netns string
+	// Rule is the name of the policy rule that admitted the client. Empty if no rule matched.
+	Rule string
+	// Sessions is the duplicate session handling of the client.
+	Sessions session.Rule
+	// Until is the time the session of the client has to end. Zero if there is no limit.
+	Until time.Time
+
+	cert *x509.Certificate
+}
+
+// Authorize applies the policy of the tenant to the client at time now. Returns [policy.ErrDenied] or
+// [policy.ErrOutsideWindow] if the client may not connect.
+func (c *Client) Authorize(now time.Time) error {
+	decision, err := c.Tenant.policy.Decide(c.cert, c.ID, now)
+	if err != nil {
+		return fmt.Errorf("authorize: %w", err)
+	}
+
+	c.Rule, c.Until = decision.Rule, decision.Until
+
+	if decision.Tun != "" {
+		c.Tun = c.Tenant.tunName(decision.Tun, c.ID)
+	}
+
+	if decision.Sessions != nil {
+		c.Sessions = *decision.Sessions
+	}
+
+	return nil
+}
+
+// StartSession counts a new session of the client against the limits of its tenant, see [abuse.Guard.StartSession]
+// for replacing. The returned function ends it.
+func (c *Client) StartSession(replacing bool) (func(), error) {
+	if c.Tenant.guard == nil {
+		return func() {}, nil
+	}
+
+	release, err := c.Tenant.guard.StartSession(c.ID, replacing)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", c.Tenant.Name, err)
+	}
+
+	return release, nil
+}
+
+// Set contains the default tenant followed by all other tenants.
+type Set []*Tenant
+
+// Enabled returns true if any tenant is able to accept clients.
+func (s Set) Enabled() bool {
+	for _, tenant := range s {
+		if tenant.hasCA() || tenant.Pins != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate makes sure that the tun names of clients of different tenants can not collide. This is the case if no tun
+// prefix of a tenant that accepts clients starts with the one of another tenant or the prefix of hashed names.
+func (s Set) Validate() error {
+	var enabled []*Tenant
+
+	for _, tenant := range s {
+		if tenant.hasCA() || tenant.Pins != nil {
+			enabled = append(enabled, tenant)
+		}
+	}
+
+	// Without other tenants there is nobody to collide with.
+	if len(enabled) < 2 {
+		return nil
+	}
+
+	for i, tenant := range enabled {
+		if overlaps(tenant.tunPrefix, identity.HashPrefix) {
+			return fmt.Errorf(
+				"validate tenants: %w: tun prefix %q of tenant %q overlaps hashed names", ErrConfig, tenant.tunPrefix,
+				tenant.Name,
+			)
+		}
+
+		for _, other := range enabled[i+1:] {
+			if overlaps(tenant.tunPrefix, other.tunPrefix) {
+				return fmt.Errorf(
+					"validate tenants: %w: tun prefixes %q of tenant %q and %q of tenant %q overlap", ErrConfig,
+					tenant.tunPrefix, tenant.Name, other.tunPrefix, other.Name,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// overlaps returns true if one of a and b starts with the other.
+func overlaps(a, b string) bool { return strings.HasPrefix(a, b) || strings.HasPrefix(b, a) }
+
+// VerifyPeerCertificate accepts peers whose certificates are verified by any tenant. Unknown keys are offered for
+// enrollment to the default tenant if it pins keys. It is meant to be used as [tls.Config.VerifyPeerCertificate] in
+// combination with [tls.RequireAnyClientCert].
+func (s Set) VerifyPeerCertificate(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+	return s.VerifyPeerCertificateFor("")(rawCerts, chains)
+}
+
+// VerifyPeerCertificateFor works like [Set.VerifyPeerCertificate] but offers unknown keys for enrollment to the
+// tenant called name, which is the one the connection was routed to.
+func (s Set) VerifyPeerCertificateFor(name string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("verify peer: %w", certs.ErrNoPeerCert)
+		}
+
+		peerCerts := make([]*x509.Certificate, 0, len(rawCerts))
+
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("verify peer: %w", err)
+			}
+
+			peerCerts = append(peerCerts, cert)
+		}
+
+		err := error(ErrNoTenant)
+
+		for _, tenant := range s {
+			if _, err = tenant.verify(peerCerts); err == nil {
+				return nil
+			}
+		}
+
+		if tenant := s.Lookup(name); tenant != nil && tenant.Pins != nil {
+			err = tenant.Pins.Enroll(peerCerts[0])
+		}
+
+		return fmt.Errorf("verify peer: %w", err)
+	}
+}
+
+// Lookup returns the tenant called name or nil if there is none. The default tenant is called "".
+func (s Set) Lookup(name string) *Tenant {
+	for _, tenant := range s {
+		if tenant.Name == name {
+			return tenant
+		}
+	}
+
+	return nil
+}
+
+// Resolve finds the tenant that accepts the peer certificates (leaf first) and resolves the identity and tun of the
+// client within it.
+func (s Set) Resolve(peerCerts []*x509.Certificate) (*Client, error) {
+	for _, tenant := range s {
+		pinnedID, err := tenant.verify(peerCerts)
+		if err != nil {
+			continue
+		}
+
+		var id, tunName string
+
+		if pinnedID != "" {
+			id = pinnedID
+			tunName, err = tenant.resolver.TunName(id)
+		} else {
+			id, tunName, err = tenant.resolver.Resolve(peerCerts[0])
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("resolve: tenant %s: %w", tenant.Name, err)
+		}
+
+		return &Client{
+			Tenant:   tenant,
+			ID:       id,
+			Key:      tenant.key(id),
+			Tun:      tenant.tunName(tunName, id),
+			Netns:    tenant.resolver.Namespace(id),
+			Sessions: tenant.sessions.For(id),
+			cert:     peerCerts[0],
+		}, nil
+	}
+
+	return nil, fmt.Errorf("resolve: %w", ErrNoTenant)
+}
+
+// Pending is a key that waits for approval by an admin.
+type Pending struct {
+	pinning.Pending
+	// Tenant is the name of the tenant the key enrolled with.
+	Tenant string `json:"tenant"`
+}
+
+// Pending returns the keys of all tenants that wait for approval.
+func (s Set) Pending() []Pending {
+	var all []Pending
+
+	for _, tenant := range s {
+		if tenant.Pins == nil {
+			continue
+		}
+
+		for _, pending := range tenant.Pins.Pending() {
+			all = append(all, Pending{pending, tenant.Name})
+		}
+	}
+
+	return all
+}
+
+// Approve allows the pending key with fingerprint in the tenant called name. Returns false if there is no such
+// pending key.
+func (s Set) Approve(name, fingerprint string) (bool, error) {
+	for _, tenant := range s {
+		if tenant.Name == name && tenant.Pins != nil {
+			return tenant.Pins.Approve(fingerprint) //nolint:wrapcheck
+		}
+	}
+
+	return false, nil
+}
+
+// Deny drops the pending key with fingerprint in the tenant called name. Returns false if there is no such pending
+// key.
+func (s Set) Deny(name, fingerprint string) (bool, error) {
+	for _, tenant := range s {
+		if tenant.Name == name && tenant.Pins != nil {
+			return tenant.Pins.Deny(fingerprint) //nolint:wrapcheck
+		}
+	}
+
+	return false, nil
+}
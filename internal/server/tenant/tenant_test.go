@@ -0,0 +1,265 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tenant_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"path"
+	"testing"
+	"time"
+
+	"eqrx.net/wallhack/internal/certs"
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/identity"
+	"eqrx.net/wallhack/internal/server/pinning"
+	"eqrx.net/wallhack/internal/server/policy"
+	"eqrx.net/wallhack/internal/server/session"
+	"eqrx.net/wallhack/internal/server/tenant"
+	"eqrx.net/wallhack/internal/testpki"
+)
+
+// tenants creates the default tenant for defaultCA and a tenant called acme for acmeCA and validates them.
+func tenants(t *testing.T, defaultCA, acmeCA *testpki.Issued, acme tenant.Config) tenant.Set {
+	t.Helper()
+
+	set := unvalidated(t, tenant.DefaultTunPrefix, defaultCA, acmeCA, acme)
+	if err := set.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return set
+}
+
+// unvalidated creates the default tenant with defaultPrefix for defaultCA and a tenant called acme for acmeCA.
+func unvalidated(t *testing.T, defaultPrefix string, defaultCA, acmeCA *testpki.Issued, acme tenant.Config) tenant.Set {
+	t.Helper()
+
+	dir := t.TempDir()
+	credPath := func(name string) string { return path.Join(dir, name) }
+	server := testpki.Issue(t, "server", defaultCA)
+
+	keyDER, err := x509.MarshalECPrivateKey(server.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testpki.WritePEM(t, credPath(certs.CertCredName), "CERTIFICATE", server.Cert.Raw)
+	testpki.WritePEM(t, credPath(certs.KeyCredName), "EC PRIVATE KEY", keyDER)
+	testpki.WritePEM(t, credPath(certs.CACredName), "CERTIFICATE", defaultCA.Cert.Raw)
+	testpki.WritePEM(t, credPath("acme.pem"), "CERTIFICATE", acmeCA.Cert.Raw)
+
+	store, err := certs.New(certs.Config{}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultTenant, err := tenant.NewDefault(
+		store, pinning.Config{}, identity.Config{}, policy.Config{}, session.Config{}, defaultPrefix,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acme.Name, acme.CA = "acme", credPath("acme.pem")
+
+	acmeTenant, err := tenant.New(acme, certs.Config{}, credPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tenant.Set{defaultTenant, acmeTenant}
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	defaultCA, acmeCA := testpki.Issue(t, "default ca", nil), testpki.Issue(t, "acme ca", nil)
+	set := tenants(t, defaultCA, acmeCA, tenant.Config{})
+
+	own, err := set.Resolve([]*x509.Certificate{testpki.Issue(t, "chicken", defaultCA).Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foreign, err := set.Resolve([]*x509.Certificate{testpki.Issue(t, "chicken", acmeCA).Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if own.Key != "chicken" || own.Tun != "default-chicken" {
+		t.Fatalf("unexpected client %+v", own)
+	}
+
+	if foreign.Key != "acme/chicken" || foreign.Tun != "acme-chicken" {
+		t.Fatalf("unexpected client %+v", foreign)
+	}
+
+	stranger := testpki.Issue(t, "chicken", testpki.Issue(t, "other ca", nil)).Cert
+
+	if _, err := set.Resolve([]*x509.Certificate{stranger}); !errors.Is(err, tenant.ErrNoTenant) {
+		t.Fatal(err)
+	}
+}
+
+func TestTunCollision(t *testing.T) {
+	t.Parallel()
+
+	defaultCA, acmeCA := testpki.Issue(t, "default ca", nil), testpki.Issue(t, "acme ca", nil)
+
+	// Without a prefix the default client acme-chicken and chicken of acme would share a tun.
+	if err := unvalidated(t, "", defaultCA, acmeCA, tenant.Config{}).Validate(); !errors.Is(err, tenant.ErrConfig) {
+		t.Fatalf("expected config error, got %v", err)
+	}
+
+	overlapping := "default-a"
+	set := unvalidated(t, tenant.DefaultTunPrefix, defaultCA, acmeCA, tenant.Config{TunPrefix: &overlapping})
+
+	if err := set.Validate(); !errors.Is(err, tenant.ErrConfig) {
+		t.Fatalf("expected config error, got %v", err)
+	}
+
+	hashed := "w"
+	set = unvalidated(t, tenant.DefaultTunPrefix, defaultCA, acmeCA, tenant.Config{TunPrefix: &hashed})
+
+	if err := set.Validate(); !errors.Is(err, tenant.ErrConfig) {
+		t.Fatalf("expected config error, got %v", err)
+	}
+
+	set = tenants(t, defaultCA, acmeCA, tenant.Config{})
+
+	own, err := set.Resolve([]*x509.Certificate{testpki.Issue(t, "acme-chicken", defaultCA).Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foreign, err := set.Resolve([]*x509.Certificate{testpki.Issue(t, "chicken", acmeCA).Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if own.Tun == foreign.Tun {
+		t.Fatalf("clients of different tenants share tun %s", own.Tun)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Parallel()
+
+	defaultCA, acmeCA := testpki.Issue(t, "default ca", nil), testpki.Issue(t, "acme ca", nil)
+	prefix := "a-"
+	set := tenants(t, defaultCA, acmeCA, tenant.Config{
+		TunPrefix:   &prefix,
+		MaxSessions: 1,
+		Policy:      policy.Config{DefaultDeny: true, Rules: []policy.Rule{{Match: policy.Match{DNS: []string{"*"}}}}},
+	})
+
+	goose := testpki.Issue(t, "goose", acmeCA).Cert
+	goose.DNSNames = []string{"goose.acme.example"}
+
+	client, err := set.Resolve([]*x509.Certificate{goose})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.Tun != "a-goose" {
+		t.Fatalf("unexpected tun %s", client.Tun)
+	}
+
+	if err := client.Authorize(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := client.StartSession(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.StartSession(false); !errors.Is(err, abuse.ErrSessionLimit) {
+		t.Fatal(err)
+	}
+
+	release()
+
+	chicken, err := set.Resolve([]*x509.Certificate{testpki.Issue(t, "chicken", acmeCA).Cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chicken.Authorize(time.Now()); !errors.Is(err, policy.ErrDenied) {
+		t.Fatal(err)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	t.Parallel()
+
+	defaultCA, acmeCA := testpki.Issue(t, "default ca", nil), testpki.Issue(t, "acme ca", nil)
+	set := tenants(t, defaultCA, acmeCA, tenant.Config{
+		Pins: pinning.Config{Enroll: true, State: path.Join(t.TempDir(), "pins.json")},
+	})
+
+	// The enrollee claims the name of a client of the acme CA.
+	phone := testpki.Issue(t, "chicken", nil).Cert
+	chicken := testpki.Issue(t, "chicken", acmeCA).Cert
+
+	// Connections that were not routed to acme do not enroll with it.
+	if err := set.VerifyPeerCertificate([][]byte{phone.Raw}, nil); err == nil || errors.Is(err, pinning.ErrPending) {
+		t.Fatal(err)
+	}
+
+	if pending := set.Pending(); len(pending) != 0 {
+		t.Fatalf("unrouted key enrolled %+v", pending)
+	}
+
+	acme := set.VerifyPeerCertificateFor("acme")
+
+	if err := acme([][]byte{phone.Raw}, nil); !errors.Is(err, pinning.ErrPending) {
+		t.Fatal(err)
+	}
+
+	if err := set.VerifyPeerCertificate([][]byte{chicken.Raw}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := set.Pending(); len(pending) != 1 || pending[0].Tenant != "acme" {
+		t.Fatalf("unexpected pending keys %+v", pending)
+	}
+
+	if found, err := set.Approve("acme", pinning.Fingerprint(phone)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+
+	if err := set.VerifyPeerCertificate([][]byte{phone.Raw}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := set.Resolve([]*x509.Certificate{phone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.Key != "acme/"+pinning.EnrolledID(pinning.Fingerprint(phone)) {
+		t.Fatalf("unexpected client %+v", client)
+	}
+
+	issued, err := set.Resolve([]*x509.Certificate{chicken})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.Key == issued.Key || client.Tun == issued.Tun {
+		t.Fatalf("enrolled key took over %+v", issued)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package tuns opens the tuns of clients on the server, optionally creates them if they do not exist yet and configures
+// them.
+package tuns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/user"
+	"strconv"
+
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/tun"
+	"eqrx.net/wallhack/internal/tunhelper"
+)
+
+// ErrConfig indicates that the tun configuration is invalid.
+var ErrConfig = errors.New("invalid tuns config")
+
+// Config specifies how server tuns are opened.
+type Config struct {
+	// Create creates tuns that do not exist yet instead of rejecting the client.
+	Create bool `yaml:"create"`
+	// Persist keeps created tuns after the session ended. Otherwise the kernel removes them when they are closed.
+	Persist bool `yaml:"persist"`
+	// Owner is the user (name or uid) allowed to attach to created tuns.
+	Owner string `yaml:"owner"`
+	// Group is the group (name or gid) allowed to attach to created tuns.
+	Group string `yaml:"group"`
+	// MTU is set on created tuns. Zero keeps the default of the kernel.
+	MTU int `yaml:"mtu"`
+	// Queues is the number of queues attached to each tun so several cores can handle its packets. More than one
+	// requires multi-queue tuns. Zero means one.
+	Queues int `yaml:"queues"`
+	// Offload lets the kernel pass TCP super-packets to wallhack which carries them over the tunnel in one piece.
+	// Received TCP segments are merged into super-packets before they are written to the tun. Clients without offloads
+	// get the super-packets too if they can segment them.
+	Offload bool `yaml:"offload"`
+	// Taps are the names of devices that are taps carrying ethernet frames instead of tuns carrying IP packets.
+	Taps []string `yaml:"taps"`
+	// Settings are applied to the tun of the given name while it is bridged and removed afterwards. The tun is
+	// set down again after the bridge stopped.
+	Settings map[string]netlink.Settings `yaml:"settings"`
+	// Helper is the path of the socket of a privileged tun helper. If set tuns are requested from it instead of
+	// being attached by wallhack, the helper decides about creation, mode, queues and offloads.
+	Helper string `yaml:"helper"`
+}
+
+// Opener opens server tuns.
+type Opener struct {
+	create   bool
+	opts     tun.CreateOptions
+	mtu      int
+	settings map[string]netlink.Settings
+	taps     map[string]bool
+	offload  bool
+	helper   string
+}
+
+// New creates a new [Opener] from cfg.
+func New(cfg Config) (*Opener, error) {
+	if cfg.MTU < 0 {
+		return nil, fmt.Errorf("new tun opener: %w: negative mtu", ErrConfig)
+	}
+
+	if cfg.Queues < 0 || cfg.Queues > tun.MaxQueues {
+		return nil, fmt.Errorf("new tun opener: %w: %v", ErrConfig, tun.ErrQueues)
+	}
+
+	for name, settings := range cfg.Settings {
+		if err := validate(name, settings); err != nil {
+			return nil, fmt.Errorf("new tun opener: %w", err)
+		}
+	}
+
+	owner, err := lookup(cfg.Owner, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", fmt.Errorf("owner: %w", err)
+		}
+
+		return u.Uid, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new tun opener: %w", err)
+	}
+
+	group, err := lookup(cfg.Group, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", fmt.Errorf("group: %w", err)
+		}
+
+		return g.Gid, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new tun opener: %w", err)
+	}
+
+	taps := make(map[string]bool, len(cfg.Taps))
+
+	for _, name := range cfg.Taps {
+		if err := tun.ValidName(name); err != nil {
+			return nil, fmt.Errorf("new tun opener: taps: %w", err)
+		}
+
+		taps[name] = true
+	}
+
+	opts := tun.CreateOptions{
+		Options: tun.Options{Queues: cfg.Queues},
+		Persist: cfg.Persist, Owner: owner, Group: group,
+	}
+
+	return &Opener{cfg.Create, opts, cfg.MTU, cfg.Settings, taps, cfg.Offload, cfg.Helper}, nil
+}
+
+// validate checks the settings of the tun called name.
+func validate(name string, settings netlink.Settings) error {
+	if err := tun.ValidName(name); err != nil {
+		return fmt.Errorf("settings: %w", err)
+	}
+
+	if settings.MTU < 0 {
+		return fmt.Errorf("settings for %s: %w: negative mtu", name, ErrConfig)
+	}
+
+	for _, prefix := range append(append([]netip.Prefix{}, settings.Addresses...), settings.Routes...) {
+		if !prefix.IsValid() {
+			return fmt.Errorf("settings for %s: %w: invalid prefix", name, ErrConfig)
+		}
+	}
+
+	return nil
+}
+
+// lookup returns the numeric id for name which is either a number itself or resolved with resolve. Empty names
+// result in -1.
+func lookup(name string, resolve func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	resolved, err := resolve(name)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.Atoi(resolved)
+	if err != nil {
+		return 0, fmt.Errorf("%w: id of %s is %q", ErrConfig, name, resolved)
+	}
+
+	return id, nil
+}
+
+// Mode returns the kind of the device called name.
+func (o *Opener) Mode(name string) tun.Mode {
+	if o.taps[name] {
+		return tun.ModeTap
+	}
+
+	return tun.ModeTun
+}
+
+// Helper returns true if tuns are requested from a privileged helper.
+func (o *Opener) Helper() bool { return o.helper != "" }
+
+// Open attaches the tun (or tap) called name. If creation is enabled and the tun does not exist yet it is created.
+// created reports if that happened, such tuns are unconfigured and down until [Opener.Configure] is called. With a
+// helper the tun is requested from it, it is never reported as created then.
+func (o *Opener) Open(name string) (t *tun.Tun, created bool, err error) {
+	if o.helper != "" {
+		t, err := tunhelper.Open(o.helper, name)
+		if err != nil {
+			return nil, false, fmt.Errorf("open tun: %w", err)
+		}
+
+		return t, false, nil
+	}
+
+	opts := o.opts
+	opts.Mode = o.Mode(name)
+	// Offloads are only negotiated for IP packets.
+	opts.Offload = o.offload && opts.Mode == tun.ModeTun
+
+	if !o.create {
+		t, err := tun.OpenWith(name, opts.Options)
+		if err != nil {
+			return nil, false, fmt.Errorf("open tun: %w", err)
+		}
+
+		return t, false, nil
+	}
+
+	t, created, err = tun.Create(name, opts)
+	if err != nil {
+		return nil, false, fmt.Errorf("open tun: %w", err)
+	}
+
+	return t, created, nil
+}
+
+// Configure applies the settings of the tun called name together with extra, for example settings from the address
+// pool. created tells if it was just created by [Opener.Open]. Created tuns and tuns with configured settings are owned
+// by wallhack, they are set up even without anything to configure and set down again by the returned
+// [netlink.Revert]. Other tuns are only touched if there is something to configure.
+func (o *Opener) Configure(name string, created bool, extra netlink.Settings) (netlink.Revert, error) {
+	settings, owned := o.settings[name]
+
+	if created {
+		owned = true
+
+		if settings.MTU == 0 {
+			settings.MTU = o.mtu
+		}
+	}
+
+	settings = extra.Merge(settings)
+
+	var (
+		revert netlink.Revert
+		err    error
+	)
+
+	switch {
+	case owned:
+		revert, err = netlink.Configure(name, settings)
+	case !settings.IsZero():
+		revert, err = netlink.Apply(name, settings)
+	default:
+		return func() error { return nil }, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("configure tun: %w", err)
+	}
+
+	return revert, nil
+}
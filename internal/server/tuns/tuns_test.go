@@ -0,0 +1,85 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tuns_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/server/tuns"
+	"eqrx.net/wallhack/internal/tun"
+)
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+
+	if _, err := tuns.New(tuns.Config{Create: true, Owner: "1000", Group: "1000", MTU: 1420}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tuns.New(tuns.Config{MTU: -1}); !errors.Is(err, tuns.ErrConfig) {
+		t.Fatal(err)
+	}
+
+	if _, err := tuns.New(tuns.Config{Queues: tun.MaxQueues + 1}); !errors.Is(err, tuns.ErrConfig) {
+		t.Fatal(err)
+	}
+
+	if _, err := tuns.New(tuns.Config{Owner: "no-such-user-for-wallhack"}); err == nil {
+		t.Fatal("expected unknown owner to be rejected")
+	}
+}
+
+func TestSettings(t *testing.T) {
+	t.Parallel()
+
+	valid := netlink.Settings{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("fd0d:5619:c605::1/64")},
+		Routes:    []netip.Prefix{netip.MustParsePrefix("fd0d:5619:c606::/48")},
+		MTU:       1420,
+	}
+
+	if _, err := tuns.New(tuns.Config{Settings: map[string]netlink.Settings{"chicken": valid}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, settings := range map[string]netlink.Settings{
+		"chicken":                {MTU: -1},
+		"goose":                  {Routes: []netip.Prefix{{}}},
+		"way-too-long-for-a-tun": valid,
+	} {
+		if _, err := tuns.New(tuns.Config{Settings: map[string]netlink.Settings{name: settings}}); err == nil {
+			t.Errorf("%s: expected settings to be rejected", name)
+		}
+	}
+}
+
+func TestTaps(t *testing.T) {
+	t.Parallel()
+
+	opener, err := tuns.New(tuns.Config{Taps: []string{"chicken"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opener.Mode("chicken") != tun.ModeTap || opener.Mode("goose") != tun.ModeTun {
+		t.Fatal("wrong device modes")
+	}
+
+	if _, err := tuns.New(tuns.Config{Taps: []string{"way-too-long-for-a-tap"}}); !errors.Is(err, tun.ErrName) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package upstream connects to local services connections are handed over to and splices connections together.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+
+	"eqrx.net/wallhack/internal/server/proxyproto"
+)
+
+// ErrAddress indicates that an upstream address could not be parsed.
+var ErrAddress = errors.New("invalid upstream address")
+
+// Upstream is a service connections can be handed over to.
+type Upstream struct {
+	network       string
+	address       string
+	proxyProtocol int
+}
+
+// Parse parses an upstream address in the form network:address, for example tcp:127.0.0.1:8080 or
+// unix:/run/web.sock. Supported networks are tcp, tcp4, tcp6 and unix.
+func Parse(str string) (Upstream, error) {
+	network, address, ok := strings.Cut(str, ":")
+	if !ok || address == "" {
+		return Upstream{}, fmt.Errorf("%w: %q", ErrAddress, str)
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return Upstream{}, fmt.Errorf("%w: unsupported network %q", ErrAddress, network)
+	}
+
+	return Upstream{network, address, 0}, nil
+}
+
+// WithProxyProtocol returns a copy of u that sends a PROXY protocol header of the given version to the upstream
+// before any other data. Version 0 sends no header.
+func (u Upstream) WithProxyProtocol(version int) (Upstream, error) {
+	if version != 0 {
+		if _, err := proxyproto.Header(version, netip.AddrPort{}, netip.AddrPort{}); err != nil {
+			return Upstream{}, fmt.Errorf("upstream %s: %w", u, err)
+		}
+	}
+
+	u.proxyProtocol = version
+
+	return u, nil
+}
+
+// String returns the address of the upstream in the same form [Parse] takes it.
+func (u Upstream) String() string { return u.network + ":" + u.address }
+
+// Dial connects to the upstream on behalf of client. If enabled, a PROXY protocol header describing client is sent.
+func (u Upstream) Dial(ctx context.Context, client net.Conn) (net.Conn, error) {
+	dialer := net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, u.network, u.address)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream: %w", err)
+	}
+
+	if u.proxyProtocol == 0 {
+		return conn, nil
+	}
+
+	header, err := proxyproto.Header(u.proxyProtocol, addrPort(client.RemoteAddr()), addrPort(client.LocalAddr()))
+	if err == nil {
+		_, err = conn.Write(header)
+	}
+
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("dial upstream: send proxy header: %w", err)
+	}
+
+	return conn, nil
+}
+
+// addrPort converts addr to a [netip.AddrPort]. The result is invalid if addr is no IP address.
+func addrPort(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort()
+	}
+
+	parsed, _ := netip.ParseAddrPort(addr.String())
+
+	return parsed
+}
+
+// closeWriter is implemented by connections that support half closing.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Splice copies data between first and second in both directions until both directions are done or ctx is done.
+// Both connections are closed on return.
+func Splice(ctx context.Context, first, second net.Conn) error {
+	defer func() { _ = first.Close() }()
+	defer func() { _ = second.Close() }()
+
+	errs := make(chan error, 2)
+
+	go func() { errs <- pipe(second, first) }()
+	go func() { errs <- pipe(first, second) }()
+
+	var err error
+
+	for remaining := 2; remaining > 0; remaining-- {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pipeErr := <-errs:
+			if err == nil {
+				err = pipeErr
+			}
+		}
+	}
+
+	return err
+}
+
+// pipe copies src to dst and half closes dst afterwards. The connections are closed instead if dst does not support
+// half closing or copying failed.
+func pipe(dst, src net.Conn) error {
+	_, err := io.Copy(dst, src)
+
+	closer, ok := dst.(closeWriter)
+
+	switch {
+	case err != nil:
+		_ = dst.Close()
+		_ = src.Close()
+
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		}
+
+		return fmt.Errorf("splice: %w", err)
+	case ok:
+		_ = closer.CloseWrite()
+	default:
+		_ = dst.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package upstream_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"eqrx.net/wallhack/internal/server/upstream"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, str := range []string{"tcp:127.0.0.1:8080", "tcp6:[::1]:443", "unix:/run/web.sock"} {
+		parsed, err := upstream.Parse(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.String() != str {
+			t.Fatal(parsed)
+		}
+	}
+
+	for _, str := range []string{"", "tcp", "tcp:", "udp:127.0.0.1:53", "/run/web.sock"} {
+		if _, err := upstream.Parse(str); !errors.Is(err, upstream.ErrAddress) {
+			t.Fatalf("%q: %v", str, err)
+		}
+	}
+}
+
+func TestSplice(t *testing.T) {
+	t.Parallel()
+
+	client, first := net.Pipe()
+	second, server := net.Pipe()
+	done := make(chan error)
+
+	go func() { done <- upstream.Splice(context.Background(), first, second) }()
+
+	go func() {
+		_, _ = client.Write([]byte("chicken"))
+		_ = client.Close()
+	}()
+
+	received, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(received) != "chicken" {
+		t.Fatal(string(received))
+	}
+
+	_ = server.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
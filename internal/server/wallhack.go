@@ -19,20 +19,61 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"sync"
+	"net/netip"
+	"time"
 
 	"eqrx.net/rungroup"
 	"eqrx.net/service"
 	"eqrx.net/wallhack/internal/bridge"
-	"eqrx.net/wallhack/internal/packet"
+	"eqrx.net/wallhack/internal/netlink"
+	"eqrx.net/wallhack/internal/netns"
+	"eqrx.net/wallhack/internal/proto"
+	"eqrx.net/wallhack/internal/server/abuse"
+	"eqrx.net/wallhack/internal/server/addressing"
+	"eqrx.net/wallhack/internal/server/hub"
+	"eqrx.net/wallhack/internal/server/identity"
+	"eqrx.net/wallhack/internal/server/session"
+	"eqrx.net/wallhack/internal/server/tenant"
+	"eqrx.net/wallhack/internal/server/tuns"
 	"eqrx.net/wallhack/internal/tun"
 	"github.com/go-logr/logr"
 )
 
-func accept(ctx context.Context, log logr.Logger, service *service.Service, listener net.Listener) error {
-	locker := sync.Mutex{}
-	bridges := map[string]context.CancelFunc{}
+// setupTimeout is the time clients have to complete the session setup.
+const setupTimeout = 10 * time.Second
 
+// offloadSupport tells what a tun can do with super-packets.
+type offloadSupport int
+
+const (
+	// offloadNone means that packets for the tun must not carry virtio-net headers.
+	offloadNone offloadSupport = iota
+	// offloadSegment means that the tun has no offloads but wallhack segments super-packets for it.
+	offloadSegment
+	// offloadTun means that the tun has offloads.
+	offloadTun
+)
+
+var (
+	// errHubNamespace indicates that a client with its own network namespace connected to a server in hub mode.
+	errHubNamespace = errors.New("network namespaces are not supported in hub mode")
+	// errHelperNamespace indicates that a client with its own network namespace connected to a server that gets
+	// its tuns from a helper. The helper attaches tuns in its own namespace.
+	errHelperNamespace = errors.New("network namespaces are not supported with a tun helper")
+)
+
+// bridger accepts wallhack connections and bridges them to the tuns of their clients.
+type bridger struct {
+	tenants   tenant.Set
+	sessions  *session.Registry
+	addresses *addressing.Allocator
+	hub       *hub.Hub
+	hubCfg    hub.Config
+	guard     *abuse.Guard
+	tuns      *tuns.Opener
+}
+
+func (b *bridger) accept(ctx context.Context, log logr.Logger, service *service.Service, listener net.Listener) error {
 	group := rungroup.New(ctx)
 
 	group.Go(func(ctx context.Context) error {
@@ -51,7 +92,7 @@ func accept(ctx context.Context, log logr.Logger, service *service.Service, list
 			switch {
 			case err == nil:
 				group.Go(func(ctx context.Context) error {
-					return newConn(ctx, log, conn.(*tls.Conn), &locker, bridges)
+					return b.newConn(ctx, log, conn.(*tls.Conn))
 				}, rungroup.NoCancelOnSuccess)
 			case errors.Is(err, net.ErrClosed):
 				return nil
@@ -68,8 +109,12 @@ func accept(ctx context.Context, log logr.Logger, service *service.Service, list
 	return nil
 }
 
-func newConn(ctx context.Context, log logr.Logger, conn *tls.Conn, locker sync.Locker, bridges map[string]context.CancelFunc) error {
-	log = log.WithValues("raddr", conn.RemoteAddr().String())
+func (b *bridger) newConn(ctx context.Context, log logr.Logger, conn *tls.Conn) error {
+	defer func() { _ = conn.Close() }()
+
+	raddr := conn.RemoteAddr().String()
+	log = log.WithValues("raddr", raddr)
+
 	if err := conn.HandshakeContext(ctx); err != nil {
 		log.Error(err, "tls handshake")
 
@@ -77,43 +122,368 @@ func newConn(ctx context.Context, log logr.Logger, conn *tls.Conn, locker sync.L
 	}
 
 	tlsState := conn.ConnectionState()
-	if len(tlsState.PeerCertificates) != 1 {
-		log.Info("client did not send exactly one cert")
+	if len(tlsState.PeerCertificates) == 0 {
+		log.Info("client did not send a cert")
 
 		return nil
 	}
 
-	commonName := tlsState.PeerCertificates[0].Subject.CommonName
-	log = log.WithValues("cn", commonName)
+	// Identity comes from the leaf, further certificates are intermediates that were verified during the handshake.
+	client, err := b.tenants.Resolve(tlsState.PeerCertificates)
+	if err != nil {
+		log.Error(err, "rejecting client")
 
-	tun, err := tun.New(commonName)
+		if b.guard.Fail(abuse.Addr(conn.RemoteAddr())) {
+			log.Info("banning client")
+		}
+
+		return nil
+	}
+
+	log = log.WithValues("id", client.Key)
+
+	if err := client.Authorize(time.Now()); err != nil {
+		log.Error(err, "rejecting client")
+
+		return nil
+	}
+
+	if client.Rule != "" {
+		log = log.WithValues("policy", client.Rule)
+	}
+
+	if !client.Until.IsZero() {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithDeadline(ctx, client.Until)
+		defer cancel()
+	}
+
+	sess, replaced, err := b.sessions.StartRule(ctx, client.Key, raddr, client.Sessions)
 	if err != nil {
-		return fmt.Errorf("new bridge: %w", err)
+		log.Error(err, "rejecting client")
+
+		return nil
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
+	defer sess.End()
 
-	locker.Lock()
+	// Limits are checked after the duplicate session policy had its say, a session that replaces another one does not
+	// add to the running sessions.
+	release, err := b.startSession(client, replaced != nil)
+	if err != nil {
+		log.Error(err, "rejecting client")
 
-	oldCancel, ok := bridges[commonName]
-	if ok {
-		oldCancel()
+		return nil
 	}
 
-	bridges[commonName] = cancel
+	defer release()
 
-	locker.Unlock()
+	if replaced != nil {
+		log.Info("replacing session, certificate may be shared", "oldRaddr", replaced.RemoteAddr, "slot", replaced.Slot)
+	}
 
-	log.Info("start bridging")
+	if err := sess.WaitPredecessor(ctx); err != nil {
+		return nil
+	}
 
-	c := packet.NewReadWriteCloser(conn, packet.NewStreamReader(conn))
-	t := packet.NewReadWriteCloser(tun, packet.NewMTUReader(tun))
+	tunName := identity.Slot(client.Tun, sess.Slot)
+	log = log.WithValues("tun", tunName)
 
-	if err := bridge.Bridge(ctx, c, t); err != nil {
+	if client.Netns != "" {
+		log = log.WithValues("netns", client.Netns)
+	}
+
+	if err := b.serve(sess, client, log, conn, tunName); err != nil {
 		log.Error(err, "serving conn")
 	}
 
+	return nil
+}
+
+// startSession counts a new session of client against the global limits and the limits of its tenant. replacing
+// tells that it replaces a running session of the client. The returned function ends it.
+func (b *bridger) startSession(client *tenant.Client, replacing bool) (func(), error) {
+	release, err := b.guard.StartSession(client.Key, replacing)
+	if err != nil {
+		return nil, fmt.Errorf("start session: %w", err)
+	}
+
+	releaseTenant, err := client.StartSession(replacing)
+	if err != nil {
+		release()
+
+		return nil, fmt.Errorf("start session: %w", err)
+	}
+
+	return func() {
+		releaseTenant()
+		release()
+	}, nil
+}
+
+// inNamespace runs fn inside the network namespace called name, or right away if name is empty.
+func inNamespace(name string, fn func() error) error {
+	if name == "" {
+		return fn()
+	}
+
+	return netns.Do(name, fn)
+}
+
+// serve attaches the tun named tunName of the session of client inside the network namespace of the client,
+// configures it and bridges it with conn until the session ends.
+func (b *bridger) serve(
+	sess *session.Session, client *tenant.Client, log logr.Logger, conn *tls.Conn, tunName string,
+) error {
+	namespace := client.Netns
+
+	if b.hub != nil {
+		if namespace != "" {
+			return fmt.Errorf("serve: %w", errHubNamespace)
+		}
+
+		return b.serveHub(sess, client, log, conn)
+	}
+
+	if namespace != "" && b.tuns.Helper() {
+		return fmt.Errorf("serve: %w", errHelperNamespace)
+	}
+
+	var (
+		dev     *tun.Tun
+		created bool
+	)
+
+	err := inNamespace(namespace, func() (err error) {
+		dev, created, err = b.tuns.Open(tunName)
+
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("serve: attach tun: %w", err)
+	}
+
+	if created {
+		log.Info("created tun")
+	}
+
+	lease, err := b.addresses.Lease(leaseKey(sess), client.Tenant.Name, tunName)
+	if err != nil {
+		_ = dev.Close()
+
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	hello := proto.ServerHello{}
+	leased := netlink.Settings{}
+
+	if lease != nil {
+		defer lease.Release()
+
+		hello.Network = lease.Client
+		log = log.WithValues("addr", lease.Client.Addresses[0].Addr().String())
+		leased = lease.Server
+	}
+
+	var revert netlink.Revert
+
+	err = inNamespace(namespace, func() (err error) {
+		revert, err = b.tuns.Configure(tunName, created, leased)
+
+		return err
+	})
+	if err != nil {
+		_ = dev.Close()
+
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	defer func() {
+		if err := inNamespace(namespace, revert); err != nil {
+			log.Error(err, "unconfigure tun")
+		}
+	}()
+
+	layer := proto.LayerIP
+	if dev.Mode() == tun.ModeTap {
+		layer = proto.LayerEthernet
+	}
+
+	support := offloadSegment
+	if dev.Offload() {
+		support = offloadTun
+	}
+
+	offload, err := b.setup(conn, hello, layer, support)
+	if err != nil {
+		_ = dev.Close()
+
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	// Tuns keep their offloads across sessions, so they are switched off for clients that do not support them.
+	if dev.Offload() {
+		if err := dev.SetOffload(offload); err != nil {
+			_ = dev.Close()
+
+			return fmt.Errorf("serve: %w", err)
+		}
+	}
+
+	var watcher *tun.Watcher
+
+	err = inNamespace(namespace, func() (err error) {
+		watcher, err = dev.Watch()
+
+		return err
+	})
+	if err != nil {
+		_ = dev.Close()
+
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	log.Info("start bridging")
+
+	err = bridgeTun(sess.Context(), proto.Stream(conn, layer, offload, offload && dev.Offload()), dev, watcher)
+
 	log.Info("stop bridging")
 
+	switch {
+	case errors.Is(err, tun.ErrGone), errors.Is(err, tun.ErrDown):
+		// The client reconnects and finds the tun again once it is back.
+		log.Info("ending session", "reason", err.Error())
+
+		return nil
+	case err != nil:
+		return fmt.Errorf("serve: %w", err)
+	default:
+		return nil
+	}
+}
+
+// bridgeTun bridges conn with all queues of dev until ctx is done, one of them fails or watcher sees dev disappear.
+func bridgeTun(ctx context.Context, conn bridge.ReadWriteCloser, dev *tun.Tun, watcher *tun.Watcher) error {
+	queues := []bridge.ReadWriteCloser{}
+
+	for _, queue := range dev.Queues() {
+		queues = append(queues, queue.Packets())
+	}
+
+	group := rungroup.New(ctx)
+	group.Go(func(ctx context.Context) error { return bridge.Queues(ctx, conn, queues) })
+	group.Go(watcher.Run)
+
+	return group.Wait() //nolint:wrapcheck
+}
+
+// serveHub attaches the session to the shared hub tun and routes its assigned address and allowed prefixes
+// to it until the session ends.
+func (b *bridger) serveHub(sess *session.Session, client *tenant.Client, log logr.Logger, conn *tls.Conn) error {
+	lease, err := b.addresses.Lease(leaseKey(sess), client.Tenant.Name, b.hubCfg.Tun)
+	if err != nil {
+		return fmt.Errorf("serve hub: %w", err)
+	}
+
+	allowed := b.hubCfg.Allowed[sess.Key]
+	prefixes := append([]netip.Prefix{}, allowed...)
+	hello := proto.ServerHello{}
+
+	if lease != nil {
+		defer lease.Release()
+
+		hello.Network = lease.Client
+		addr := lease.Client.Addresses[0].Addr()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		log = log.WithValues("addr", addr.String())
+	}
+
+	if len(allowed) != 0 {
+		revert, err := netlink.Apply(b.hubCfg.Tun, netlink.Settings{Routes: allowed})
+		if err != nil {
+			return fmt.Errorf("serve hub: route allowed prefixes: %w", err)
+		}
+
+		defer func() {
+			if err := revert(); err != nil {
+				log.Error(err, "unroute allowed prefixes")
+			}
+		}()
+	}
+
+	if _, err := b.setup(conn, hello, proto.LayerIP, offloadNone); err != nil {
+		return fmt.Errorf("serve hub: %w", err)
+	}
+
+	log.Info("start bridging")
+
+	err = b.hub.Serve(sess.Context(), proto.Stream(conn, proto.LayerIP, false, false), prefixes)
+
+	log.Info("stop bridging")
+
+	if err != nil {
+		return fmt.Errorf("serve hub: %w", err)
+	}
+
 	return nil
 }
+
+// leaseKey returns the key the address of sess is leased for. Parallel sessions of the same client get
+// different keys and therefore different addresses.
+func leaseKey(sess *session.Session) string {
+	if sess.Slot == 0 {
+		return sess.Key
+	}
+
+	return fmt.Sprintf("%s#%d", sess.Key, sess.Slot)
+}
+
+// setup performs the session setup if the client negotiated a protocol that has one. The client has to agree on
+// carrying layer. Clients without session setup only carry IP. Offloads are used if at least one of the tuns has them
+// and the other side can segment super-packets, the returned bool tells if that is the case.
+func (b *bridger) setup(
+	conn *tls.Conn, hello proto.ServerHello, layer proto.Layer, support offloadSupport,
+) (bool, error) {
+	if conn.ConnectionState().NegotiatedProtocol != proto.ALPN {
+		if layer != proto.LayerIP {
+			return false, fmt.Errorf("setup: %w: client without session setup can not carry %s", proto.ErrLayer, layer)
+		}
+
+		return false, nil
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(setupTimeout)); err != nil {
+		return false, fmt.Errorf("setup: %w", err)
+	}
+
+	clientHello := proto.ClientHello{}
+
+	if err := proto.ReadMessage(conn, &clientHello); err != nil {
+		return false, fmt.Errorf("setup: %w", err)
+	}
+
+	if clientHello.Layer != layer {
+		return false, fmt.Errorf(
+			"setup: %w: client wants %s, tun carries %s", proto.ErrLayer, clientHello.Layer, layer,
+		)
+	}
+
+	switch {
+	case layer != proto.LayerIP:
+	case support == offloadTun:
+		hello.Offload = clientHello.Offload || clientHello.Segment
+	case support == offloadSegment:
+		hello.Offload = clientHello.Offload
+	}
+
+	if err := proto.WriteMessage(conn, hello); err != nil {
+		return false, fmt.Errorf("setup: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return false, fmt.Errorf("setup: %w", err)
+	}
+
+	return hello.Offload, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package testpki issues certificates and keys for tests.
+package testpki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serial is the serial number of the last issued certificate.
+var serial atomic.Int64 //nolint:gochecknoglobals
+
+// Issued is a certificate and its private key.
+type Issued struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// Issue creates a client certificate called name that is signed by parent. If parent is nil a self-signed CA is
+// created instead.
+func Issue(t testing.TB, name string, parent *Issued) *Issued {
+	t.Helper()
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	return Sign(t, template, parent)
+}
+
+// Intermediate creates an intermediate CA called name that is signed by parent.
+func Intermediate(t testing.TB, name string, parent *Issued) *Issued {
+	t.Helper()
+
+	return Sign(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, parent)
+}
+
+// Sign creates a certificate from template with a new key that is signed by parent or by itself if parent is nil.
+// Templates without serial number get a unique one.
+func Sign(t testing.TB, template *x509.Certificate, parent *Issued) *Issued {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(serial.Add(1))
+	}
+
+	signerCert, signerKey := template, key
+
+	if parent != nil {
+		signerCert, signerKey = parent.Cert, parent.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Issued{cert, key}
+}
+
+// WritePEM writes der as PEM block of blockType to file.
+func WritePEM(t testing.TB, file, blockType string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -22,8 +22,11 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync/atomic"
+	"unicode"
 	"unsafe"
 
+	"eqrx.net/wallhack/internal/packet"
 	"golang.org/x/sys/unix"
 )
 
@@ -37,20 +40,92 @@ const (
 	requestLen = IfaceNameMaxLen + 2
 	// tunFlag indicates to the kernel that we want a tun device (not tap).
 	tunFlag requestFlag = 0x0001
+	// tapFlag indicates to the kernel that we want a tap device that carries ethernet frames.
+	tapFlag requestFlag = 0x0002
+	// vnetHdrFlag tells the kernel to prepend a virtio-net header to every packet, which carries offload information.
+	vnetHdrFlag requestFlag = 0x4000
+	// multiQueueFlag tells the kernel that we attach one of several queues of the device.
+	multiQueueFlag requestFlag = 0x0100
 	// noPiFlag tells the kernel that we do not want to have packet info prepended to every message coming out of the dev.
 	noPiFlag requestFlag = 0x1000
 	// ioctlNumber is the number of the ioctl we are doing to get a run.
 	ioctlNumber uintptr = 0x400454ca
+	// persistIoctlNumber is the number of the ioctl that makes a tun outlive its file descriptor.
+	persistIoctlNumber uintptr = 0x400454cb
+	// ownerIoctlNumber is the number of the ioctl that sets the user allowed to attach to a persistent tun.
+	ownerIoctlNumber uintptr = 0x400454cc
+	// groupIoctlNumber is the number of the ioctl that sets the group allowed to attach to a persistent tun.
+	groupIoctlNumber uintptr = 0x400454ce
+	// offloadIoctlNumber is the number of the ioctl that sets the offloads the kernel may use for packets it passes.
+	offloadIoctlNumber uintptr = 0x400454d0
+	// csumOffload lets the kernel pass packets with partial checksums.
+	csumOffload = 0x01
+	// tso6Offload lets the kernel pass TCP over IPv6 super-packets that still have to be segmented.
+	tso6Offload = 0x04
 	// tunPath is the file we do the ioctl on.
 	tunPath = "/dev/net/tun"
+	// MaxQueues is the maximum number of queues the kernel allows per device.
+	MaxQueues = 256
 )
 
 var (
 	// ErrMTU indicates that a packet is too large for the tun MTU.
-	ErrMTU  = errors.New("packet too large for MTU")
+	ErrMTU = errors.New("packet too large for MTU")
+	// ErrName indicates that a name can not be used as interface name.
+	ErrName = errors.New("invalid interface name")
 	errName = fmt.Errorf("tun name longer than %d bytes", IfaceNameMaxLen)
+	// ErrQueues indicates that an unsupported number of queues was requested.
+	ErrQueues = fmt.Errorf("number of queues must be between 1 and %d", MaxQueues)
 )
 
+// ValidName checks if name may be used as linux interface name. The rules are the same the kernel applies: The name
+// must not be empty, must leave room for the terminating NUL byte, must not be "." or ".." and must not contain
+// slashes, colons or whitespace.
+func ValidName(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("%w: %q", ErrName, name)
+	case len(name) >= IfaceNameMaxLen:
+		return fmt.Errorf("%w: %q is longer than %d bytes", ErrName, name, IfaceNameMaxLen-1)
+	}
+
+	for _, r := range name {
+		if r == '/' || r == ':' || unicode.IsSpace(r) {
+			return fmt.Errorf("%w: %q contains %q", ErrName, name, r)
+		}
+	}
+
+	return nil
+}
+
+// Mode is the kind of device.
+type Mode int
+
+const (
+	// ModeTun is a tun device that carries IP packets.
+	ModeTun Mode = iota
+	// ModeTap is a tap device that carries ethernet frames.
+	ModeTap
+)
+
+// flag returns the request flag for the mode.
+func (m Mode) flag() requestFlag {
+	if m == ModeTap {
+		return tapFlag
+	}
+
+	return tunFlag
+}
+
+// String returns the name of the mode.
+func (m Mode) String() string {
+	if m == ModeTap {
+		return "tap"
+	}
+
+	return "tun"
+}
+
 // request is the ioctl request payload.
 type request struct {
 	// Name of the tun to attach to.
@@ -85,22 +160,272 @@ func newTunRequest(name string, flags requestFlag) ([]byte, error) {
 	return data, nil
 }
 
-// Tun is a handle for a linux Tun device that allows reading an writing frames.
+// Tun is a handle for a linux Tun device that allows reading an writing frames. It may also be a tap device.
+// Reading and writing uses the first queue of the device, see [Tun.Queues] for the others.
 type Tun struct {
 	io.ReadWriteCloser
-	iface string
+	iface  string
+	index  int
+	mtu    atomic.Int64
+	opts   Options
+	queues []*os.File
+}
+
+// Queue is one queue of a multi-queue tun. The kernel distributes packets from the tun by flow over its queues.
+type Queue struct {
+	io.ReadWriteCloser
+	tun *Tun
+}
+
+// MTU returns the current MTU size of the interface of the queue in bytes.
+func (q *Queue) MTU() int { return q.tun.MTU() }
+
+// Packets returns the packet stream of the queue, reading ethernet frames for taps and packets with virtio-net
+// headers for tuns with offloads.
+func (q *Queue) Packets() *packet.ReadWriteCloser {
+	switch {
+	case q.tun.opts.Mode == ModeTap:
+		return packet.NewReadWriteCloser(q, packet.NewTapReader(q))
+	case q.tun.opts.Offload:
+		return packet.NewOffloadReadWriteCloser(q, packet.NewOffloadReader(q))
+	default:
+		return packet.NewReadWriteCloser(q, packet.NewMTUReader(q))
+	}
+}
+
+// New creates a new handle for the device named by ifaceName from the file descriptors of its queues that were
+// attached as specified by opts by someone else, for example a privileged helper. The handle takes ownership of fds.
+func New(ifaceName string, opts Options, fds []int) (*Tun, error) {
+	if len(fds) == 0 || len(fds) > MaxQueues {
+		CloseFDs(fds)
+
+		return nil, fmt.Errorf("new %s: %w: %d", opts.Mode, ErrQueues, len(fds))
+	}
+
+	// Passed descriptors may have been switched to blocking mode by the sender.
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			CloseFDs(fds)
+
+			return nil, fmt.Errorf("new %s: %w", opts.Mode, err)
+		}
+	}
+
+	opts.Queues = len(fds)
+
+	t, err := newTun(ifaceName, opts, fds)
+	if err != nil {
+		return nil, fmt.Errorf("new %s: %w", opts.Mode, err)
+	}
+
+	return t, nil
+}
+
+// Open creates a new handle for the device named by ifaceName that is of the given mode.
+func Open(ifaceName string, mode Mode) (*Tun, error) { return OpenWith(ifaceName, Options{Mode: mode}) }
+
+// Options specifies how a device is attached.
+type Options struct {
+	// Mode is the kind of device.
+	Mode Mode
+	// Queues is the number of queues to attach. Zero means one. More than one requires a multi-queue device.
+	Queues int
+	// Offload prepends a virtio-net header to all packets read from and written to the device. See
+	// [Tun.SetOffload].
+	Offload bool
+}
+
+// flags returns the request flags for attaching a queue.
+func (o Options) flags() requestFlag {
+	flags := o.Mode.flag() | noPiFlag
+
+	if o.Queues > 1 {
+		flags |= multiQueueFlag
+	}
+
+	if o.Offload {
+		flags |= vnetHdrFlag
+	}
+
+	return flags
+}
+
+// OpenWith creates a new handle for the device named by ifaceName as specified by opts.
+func OpenWith(ifaceName string, opts Options) (*Tun, error) {
+	fds, err := attachQueues(ifaceName, opts)
+	if err != nil {
+		return nil, fmt.Errorf("new %s: %w", opts.Mode, err)
+	}
+
+	t, err := newTun(ifaceName, opts, fds)
+	if err != nil {
+		return nil, fmt.Errorf("new %s: %w", opts.Mode, err)
+	}
+
+	return t, nil
+}
+
+// newTun creates a new handle from the file descriptors of the queues of a device. The index and MTU of the interface
+// are looked up now because the device may live in another network namespace than the one of later callers.
+func newTun(ifaceName string, opts Options, fds []int) (*Tun, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		CloseFDs(fds)
+
+		return nil, fmt.Errorf("lookup interface: %w", err)
+	}
+
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		files[i] = os.NewFile(uintptr(fd), tunPath)
+	}
+
+	t := &Tun{ReadWriteCloser: files[0], iface: ifaceName, index: iface.Index, opts: opts, queues: files}
+	t.mtu.Store(int64(iface.MTU))
+
+	return t, nil
+}
+
+// Queues returns all queues of the tun. The first one is the one the tun itself reads from and writes to.
+func (t *Tun) Queues() []*Queue {
+	queues := make([]*Queue, len(t.queues))
+	for i, file := range t.queues {
+		queues[i] = &Queue{file, t}
+	}
+
+	return queues
+}
+
+// Files returns the files of all queues, for example to pass them to another process. Calling Fd on them switches
+// them to blocking mode.
+func (t *Tun) Files() []*os.File { return append([]*os.File{}, t.queues...) }
+
+// Close closes all queues of the tun.
+func (t *Tun) Close() error {
+	var firstErr error
+
+	for _, file := range t.queues {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("close tun: %w", firstErr)
+	}
+
+	return nil
+}
+
+// CreateOptions specifies the properties of tuns created by [Create].
+type CreateOptions struct {
+	Options
+
+	// Persist keeps the tun around after it is closed. Tuns that do not persist are removed by the kernel on close.
+	Persist bool
+	// Owner is the uid of the user that may attach to the tun. Negative values leave it unset.
+	Owner int
+	// Group is the gid of the group that may attach to the tun. Negative values leave it unset.
+	Group int
+}
+
+// Create creates a new tun handle for the tun named by ifaceName like [OpenWith] does. If the tun does not exist it is
+// created with the given options first. created reports if that happened. Created tuns with more than one queue are
+// multi-queue tuns.
+func Create(ifaceName string, opts CreateOptions) (t *Tun, created bool, err error) {
+	if _, err := net.InterfaceByName(ifaceName); err == nil {
+		t, err := OpenWith(ifaceName, opts.Options)
+		if err != nil {
+			return nil, false, fmt.Errorf("create tun: %w", err)
+		}
+
+		return t, false, nil
+	}
+
+	fds, err := attachQueues(ifaceName, opts.Options)
+	if err != nil {
+		return nil, false, fmt.Errorf("create tun: %w", err)
+	}
+
+	for _, setting := range []struct {
+		number uintptr
+		value  int
+		apply  bool
+	}{
+		{ownerIoctlNumber, opts.Owner, opts.Owner >= 0},
+		{groupIoctlNumber, opts.Group, opts.Group >= 0},
+		{persistIoctlNumber, 1, opts.Persist},
+	} {
+		if !setting.apply {
+			continue
+		}
+
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fds[0]), setting.number, uintptr(setting.value))
+		if errno != 0 {
+			CloseFDs(fds)
+
+			return nil, false, fmt.Errorf("create tun: %w", errno)
+		}
+	}
+
+	t, err = newTun(ifaceName, opts.Options, fds)
+	if err != nil {
+		return nil, false, fmt.Errorf("create tun: %w", err)
+	}
+
+	return t, true, nil
 }
 
-// New creates a new tun handle for the tun named by ifaceName.
-func New(ifaceName string) (*Tun, error) {
+// attachQueues attaches the queues of the device named by ifaceName as specified by opts and returns their file
+// descriptors.
+func attachQueues(ifaceName string, opts Options) ([]int, error) {
+	queues := opts.Queues
+	if queues == 0 {
+		queues = 1
+	}
+
+	if queues < 0 || queues > MaxQueues {
+		return nil, fmt.Errorf("attach: %w: %d", ErrQueues, queues)
+	}
+
+	flags := opts.flags()
+	fds := make([]int, 0, queues)
+
+	for i := 0; i < queues; i++ {
+		tunFD, err := attach(ifaceName, flags)
+		if err != nil {
+			CloseFDs(fds)
+
+			return nil, err
+		}
+
+		fds = append(fds, tunFD)
+	}
+
+	return fds, nil
+}
+
+// CloseFDs closes all fds and ignores errors. Used to clean up file descriptors that were never handed out.
+func CloseFDs(fds []int) {
+	for _, fd := range fds {
+		_ = unix.Close(fd)
+	}
+}
+
+// attach opens the tun device and attaches the returned file descriptor to the device named by ifaceName using
+// the given request flags. The kernel creates a device that does not persist if there is none with that name and the
+// caller has CAP_NET_ADMIN.
+func attach(ifaceName string, flags requestFlag) (int, error) {
 	tunFD, err := unix.Open(tunPath, unix.O_RDWR|unix.O_NONBLOCK, 0)
 	if err != nil {
-		return nil, fmt.Errorf("new tun: %w", err)
+		return 0, fmt.Errorf("attach: %w", err)
 	}
 
-	req, err := newTunRequest(ifaceName, tunFlag|noPiFlag)
+	req, err := newTunRequest(ifaceName, flags)
 	if err != nil {
-		return nil, fmt.Errorf("new tun: %w", err)
+		_ = unix.Close(tunFD)
+
+		return 0, fmt.Errorf("attach: %w", err)
 	}
 
 	// Unholy-ish magic to get a C pointer for ioctl call.
@@ -110,21 +435,52 @@ func New(ifaceName string) (*Tun, error) {
 
 	if errno != 0 {
 		if closeErr := unix.Close(tunFD); closeErr != nil {
-			return nil, fmt.Errorf("new tun: [%w; %v]", errno, closeErr)
+			return 0, fmt.Errorf("attach: [%w; %v]", errno, closeErr)
 		}
 
-		return nil, fmt.Errorf("new tun: %w", errno)
+		return 0, fmt.Errorf("attach: %w", errno)
 	}
 
-	return &Tun{os.NewFile(uintptr(tunFD), tunPath), ifaceName}, nil
+	return tunFD, nil
 }
 
-// MTU returns the current MTU size of the interface in bytes.
-func (t *Tun) MTU() int {
-	iface, err := net.InterfaceByName(t.iface)
+// Mode returns the kind of the device.
+func (t *Tun) Mode() Mode { return t.opts.Mode }
+
+// Offload returns true if packets of the device are prepended by a virtio-net header.
+func (t *Tun) Offload() bool { return t.opts.Offload }
+
+// SetOffload lets the kernel pass TCP over IPv6 super-packets with partial checksums that still have to be segmented
+// if enabled is true. The virtio-net header of such packets tells how to finish them. Otherwise the kernel passes only
+// complete packets and the header is all zeros. Only works if the device was opened with [Options.Offload].
+func (t *Tun) SetOffload(enabled bool) error {
+	offloads := 0
+	if enabled {
+		offloads = csumOffload | tso6Offload
+	}
+
+	conn, err := t.queues[0].SyscallConn()
 	if err != nil {
-		panic("tun dev is gone")
+		return fmt.Errorf("set offload: %w", err)
 	}
 
-	return iface.MTU
+	var errno unix.Errno
+
+	// Control leaves the file non-blocking, unlike Fd.
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, offloadIoctlNumber, uintptr(offloads))
+	})
+
+	switch {
+	case err != nil:
+		return fmt.Errorf("set offload: %w", err)
+	case errno != 0:
+		return fmt.Errorf("set offload: %w", errno)
+	default:
+		return nil
+	}
 }
+
+// MTU returns the MTU size of the interface in bytes. It is the one the interface had when it was attached unless a
+// [Watcher] saw it change.
+func (t *Tun) MTU() int { return int(t.mtu.Load()) }
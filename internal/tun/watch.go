@@ -0,0 +1,108 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"eqrx.net/rungroup"
+	"eqrx.net/wallhack/internal/netlink"
+)
+
+var (
+	// ErrGone indicates that the interface of a tun was deleted.
+	ErrGone = errors.New("tun is gone")
+	// ErrDown indicates that the interface of a tun was set down.
+	ErrDown = errors.New("tun is down")
+)
+
+// Watcher follows the link state of a tun.
+type Watcher struct {
+	tun   *Tun
+	links *netlink.LinkWatcher
+	up    bool
+}
+
+// Watch subscribes to the link events of the interface of t. It has to be called in the network namespace of the
+// interface.
+func (t *Tun) Watch() (*Watcher, error) {
+	links, err := netlink.WatchLinks()
+	if err != nil {
+		return nil, fmt.Errorf("watch tun: %w", err)
+	}
+
+	// Changes before subscribing are missed, so the current state is taken afterwards.
+	iface, err := net.InterfaceByIndex(t.index)
+	if err != nil {
+		_ = links.Close()
+
+		return nil, fmt.Errorf("watch tun: %w: %v", ErrGone, err)
+	}
+
+	t.mtu.Store(int64(iface.MTU))
+
+	return &Watcher{t, links, iface.Flags&net.FlagUp != 0}, nil
+}
+
+// Run updates the MTU of the tun when it changes until ctx is done or the interface is deleted or set down, which
+// is reported with [ErrGone] or [ErrDown]. The watcher is closed afterwards.
+func (w *Watcher) Run(ctx context.Context) error {
+	group := rungroup.New(ctx)
+
+	group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		if err := w.links.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+
+		return nil
+	})
+
+	group.Go(func(ctx context.Context) error {
+		for {
+			event, err := w.links.Next()
+
+			switch {
+			case errors.Is(err, os.ErrClosed):
+				return nil
+			case err != nil:
+				return err //nolint:wrapcheck
+			case event.Index != w.tun.index:
+				continue
+			case event.Deleted:
+				return ErrGone
+			// Down only counts if it was up before, tuns that are brought up by someone else may start down.
+			case !event.Up && w.up:
+				return ErrDown
+			}
+
+			w.up = event.Up
+
+			if event.MTU != 0 {
+				w.tun.mtu.Store(int64(event.MTU))
+			}
+		}
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("watch tun: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,353 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package tunhelper passes tun file descriptors from a privileged helper to wallhack. wallhack asks the helper for a
+// tun by name over a unix seqpacket socket, the helper attaches (and possibly creates and configures) it and answers
+// with the file descriptors of its queues attached via SCM_RIGHTS. This way wallhack itself needs no privileges for its
+// tuns.
+package tunhelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"eqrx.net/rungroup"
+	"eqrx.net/wallhack/internal/tun"
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Network is the socket type the helper listens on.
+	Network = "unixpacket"
+	// timeout is the time both sides get for a request.
+	timeout = 10 * time.Second
+	// maxMessageLen is the maximum size of requests and responses in bytes.
+	maxMessageLen = 4096
+)
+
+var (
+	// ErrHelper indicates that the helper could not provide the tun. The message of the helper is attached.
+	ErrHelper = errors.New("tun helper failed")
+	// errResponse indicates that the helper sent a malformed response.
+	errResponse = errors.New("malformed tun helper response")
+	// errPeer indicates that a request came from a process of another user than the expected one.
+	errPeer = errors.New("requester not allowed")
+	// errTunNotAllowed indicates that a requested tun is not on the allowlist.
+	errTunNotAllowed = errors.New("tun not allowed")
+)
+
+// Access limits who may request which tuns from the helper.
+type Access struct {
+	// UID is the user requests have to come from.
+	UID uint32
+	// Tuns are the names of the tuns that may be requested. Entries ending with * allow all names starting with the
+	// rest of the entry.
+	Tuns []string
+}
+
+// allows returns true if name is on the allowlist.
+func (a Access) allows(name string) bool {
+	for _, allowed := range a.Tuns {
+		if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// request asks the helper for a tun.
+type request struct {
+	// Name of the tun.
+	Name string `json:"name"`
+}
+
+// response answers a [request]. The file descriptors of the queues of the tun are attached if Error is empty.
+type response struct {
+	// Error tells why the tun could not be provided.
+	Error string `json:"error,omitempty"`
+	// Mode of the device.
+	Mode tun.Mode `json:"mode"`
+	// Offload tells that the device was attached with virtio-net headers.
+	Offload bool `json:"offload,omitempty"`
+}
+
+// Open asks the helper listening at path for the tun called name.
+func Open(path, name string) (*tun.Tun, error) {
+	conn, err := net.DialUnix(Network, nil, &net.UnixAddr{Name: path, Net: Network})
+	if err != nil {
+		return nil, fmt.Errorf("open tun from helper: %w", err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("open tun from helper: %w", err)
+	}
+
+	data, err := json.Marshal(request{name})
+	if err != nil {
+		return nil, fmt.Errorf("open tun from helper: %w", err)
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		return nil, fmt.Errorf("open tun from helper: %w", err)
+	}
+
+	resp, fds, err := receive(conn)
+	if err != nil {
+		return nil, fmt.Errorf("open tun from helper: %w", err)
+	}
+
+	dev, err := tun.New(name, tun.Options{Mode: resp.Mode, Offload: resp.Offload}, fds)
+	if err != nil {
+		return nil, fmt.Errorf("open tun from helper: %w", err)
+	}
+
+	return dev, nil
+}
+
+// receive reads the response of the helper from conn together with the attached file descriptors.
+func receive(conn *net.UnixConn) (*response, []int, error) {
+	buf := make([]byte, maxMessageLen)
+	oob := make([]byte, unix.CmsgSpace(tun.MaxQueues*4))
+
+	bytesRead, oobRead, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("receive: %w", err)
+	}
+
+	fds, err := rights(oob[:oobRead])
+	if err != nil {
+		return nil, nil, fmt.Errorf("receive: %w", err)
+	}
+
+	resp := &response{}
+
+	if err := json.Unmarshal(buf[:bytesRead], resp); err != nil {
+		tun.CloseFDs(fds)
+
+		return nil, nil, fmt.Errorf("receive: %w: %v", errResponse, err)
+	}
+
+	switch {
+	case resp.Error != "":
+		tun.CloseFDs(fds)
+
+		return nil, nil, fmt.Errorf("receive: %w: %s", ErrHelper, resp.Error)
+	case len(fds) == 0:
+		return nil, nil, fmt.Errorf("receive: %w: no file descriptors", errResponse)
+	}
+
+	return resp, fds, nil
+}
+
+// rights returns all file descriptors passed in the control messages oob.
+func rights(oob []byte) ([]int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errResponse, err)
+	}
+
+	var fds []int
+
+	for i := range msgs {
+		received, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+
+		fds = append(fds, received...)
+	}
+
+	return fds, nil
+}
+
+// OpenFunc attaches the tun called name. The caller closes the returned tun after passing it on.
+type OpenFunc func(name string) (*tun.Tun, error)
+
+// Serve answers requests for tuns arriving on listener with the tuns opened by open until ctx is done. Requests not
+// permitted by access are rejected without calling open.
+func Serve(ctx context.Context, log logr.Logger, listener *net.UnixListener, access Access, open OpenFunc) error {
+	group := rungroup.New(ctx)
+
+	group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		if err := listener.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+
+		return nil
+	})
+
+	group.Go(func(ctx context.Context) error {
+		for {
+			conn, err := listener.AcceptUnix()
+
+			switch {
+			case err == nil:
+				group.Go(func(ctx context.Context) error {
+					handle(log, conn, access, open)
+
+					return nil
+				}, rungroup.NoCancelOnSuccess)
+			case errors.Is(err, net.ErrClosed):
+				return nil
+			default:
+				return fmt.Errorf("accept: %w", err)
+			}
+		}
+	})
+
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("tun helper: %w", err)
+	}
+
+	return nil
+}
+
+// handle answers the request arriving on conn.
+func handle(log logr.Logger, conn *net.UnixConn, access Access, open OpenFunc) {
+	defer func() { _ = conn.Close() }()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		log.Error(err, "set deadline")
+
+		return
+	}
+
+	buf := make([]byte, maxMessageLen)
+
+	bytesRead, err := conn.Read(buf)
+	if err != nil {
+		log.Error(err, "read request")
+
+		return
+	}
+
+	req := request{}
+	if err := json.Unmarshal(buf[:bytesRead], &req); err != nil {
+		log.Error(err, "read request")
+
+		return
+	}
+
+	log = log.WithValues("tun", req.Name)
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		log.Error(err, "get requester")
+
+		return
+	}
+
+	if uid != access.UID {
+		reject(log, conn, fmt.Errorf("%w: uid %d", errPeer, uid))
+
+		return
+	}
+
+	if err := tun.ValidName(req.Name); err != nil {
+		reject(log, conn, err)
+
+		return
+	}
+
+	if !access.allows(req.Name) {
+		reject(log, conn, fmt.Errorf("%w: %s", errTunNotAllowed, req.Name))
+
+		return
+	}
+
+	dev, err := open(req.Name)
+	if err != nil {
+		reject(log, conn, err)
+
+		return
+	}
+
+	// The receiver has its own copies of the file descriptors, so these are not needed anymore.
+	defer func() { _ = dev.Close() }()
+
+	data, err := json.Marshal(response{Mode: dev.Mode(), Offload: dev.Offload()})
+	if err != nil {
+		log.Error(err, "write response")
+
+		return
+	}
+
+	fds := []int{}
+	for _, file := range dev.Files() {
+		fds = append(fds, int(file.Fd()))
+	}
+
+	if _, _, err := conn.WriteMsgUnix(data, unix.UnixRights(fds...), nil); err != nil {
+		log.Error(err, "write response")
+
+		return
+	}
+
+	log.Info("passed tun")
+}
+
+// peerUID returns the user of the process on the other end of conn.
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, fmt.Errorf("peer uid: %w", err)
+	}
+
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, fmt.Errorf("peer uid: %w", err)
+	}
+
+	if credErr != nil {
+		return 0, fmt.Errorf("peer uid: %w", credErr)
+	}
+
+	return cred.Uid, nil
+}
+
+// reject tells the requester on conn why its request failed.
+func reject(log logr.Logger, conn *net.UnixConn, cause error) {
+	log.Error(cause, "rejecting request")
+
+	data, err := json.Marshal(response{Error: cause.Error()})
+	if err != nil {
+		log.Error(err, "write response")
+
+		return
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		log.Error(err, "write response")
+	}
+}
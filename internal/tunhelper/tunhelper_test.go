@@ -0,0 +1,144 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+package tunhelper_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eqrx.net/wallhack/internal/tun"
+	"eqrx.net/wallhack/internal/tunhelper"
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+var errNoTun = errors.New("no such tun")
+
+// serve runs a helper restricted by access on a socket in a temporary directory that passes the read end of a pipe
+// as queue of the interface lo. It returns the socket path and the write end of the pipe.
+func serve(t *testing.T, access tunhelper.Access) (string, int) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "helper.sock")
+
+	listener, err := net.ListenUnix(tunhelper.Network, &net.UnixAddr{Name: path, Net: tunhelper.Network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := make([]int, 2)
+	if err := unix.Pipe2(pipe, unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = unix.Close(pipe[1]) })
+
+	open := func(name string) (*tun.Tun, error) {
+		if name != "lo" {
+			t.Errorf("helper opened %s", name)
+
+			return nil, errNoTun
+		}
+
+		fd, err := unix.Dup(pipe[0])
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		return tun.New(name, tun.Options{Mode: tun.ModeTap}, []int{fd})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() { done <- tunhelper.Serve(ctx, logr.Discard(), listener, access, open) }()
+
+	t.Cleanup(func() {
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+
+		_ = unix.Close(pipe[0])
+	})
+
+	return path, pipe[1]
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	path, writer := serve(t, tunhelper.Access{UID: uint32(os.Getuid()), Tuns: []string{"lo"}})
+
+	dev, err := tunhelper.Open(path, "lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = dev.Close() }()
+
+	if dev.Mode() != tun.ModeTap || dev.Offload() || len(dev.Queues()) != 1 {
+		t.Fatalf("unexpected device: %s offload %t queues %d", dev.Mode(), dev.Offload(), len(dev.Queues()))
+	}
+
+	if _, err := unix.Write(writer, []byte("quack")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+
+	bytesRead, err := dev.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:bytesRead]) != "quack" {
+		t.Fatalf("read %q through passed descriptor", buf[:bytesRead])
+	}
+}
+
+func TestOpenRejected(t *testing.T) {
+	t.Parallel()
+
+	path, _ := serve(t, tunhelper.Access{UID: uint32(os.Getuid()), Tuns: []string{"chicken", "l*"}})
+
+	// Names outside the allowlist are refused before the helper opens anything.
+	for _, name := range []string{"goose", "../chicken", "chicken2"} {
+		if _, err := tunhelper.Open(path, name); !errors.Is(err, tunhelper.ErrHelper) {
+			t.Fatalf("expected helper error for %s, got %v", name, err)
+		}
+	}
+
+	dev, err := tunhelper.Open(path, "lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = dev.Close()
+}
+
+func TestOpenOtherUser(t *testing.T) {
+	t.Parallel()
+
+	path, _ := serve(t, tunhelper.Access{UID: uint32(os.Getuid()) + 1, Tuns: []string{"lo"}})
+
+	if _, err := tunhelper.Open(path, "lo"); !errors.Is(err, tunhelper.ErrHelper) {
+		t.Fatalf("expected helper error, got %v", err)
+	}
+}
@@ -24,8 +24,11 @@ import (
 	"github.com/magefile/mage/sh"
 )
 
-func BuildWallhack() error {
-	cmd := "wallhack"
+func BuildWallhack() error { return build("wallhack") }
+
+func BuildTunHelper() error { return build("wallhack-tun-helper") }
+
+func build(cmd string) error {
 	env := map[string]string{"CGO_ENABLED": "1"}
 
 	cmdline := []string{
@@ -62,5 +65,5 @@ func TestUnit() error {
 
 func Test() { mg.Deps(TestUnit) }
 func Build() {
-	mg.Deps(BuildWallhack)
+	mg.Deps(BuildWallhack, BuildTunHelper)
 }
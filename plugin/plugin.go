@@ -0,0 +1,110 @@
+// Copyright (C) 2022 Alexander Sowitzki
+//
+// This program is free software: you can redistribute it and/or modify it under the terms of the
+// GNU Affero General Public License as published by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License along with this program.
+// If not, see <https://www.gnu.org/licenses/>.
+
+// Package plugin describes version 2 of the wallhack plugin API.
+//
+// A plugin is a Go plugin that exports a function named [NewSymbolName] of type func() [Plugin]. Plugins take part in
+// routing before the TLS handshake, can veto any connection after it and serve the connections they claimed.
+// Plugins that still export the version 1 symbol New are loaded as well, they only get connections routed to them.
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// NewSymbolName is the name of the symbol a plugin exports to create its [Plugin].
+const NewSymbolName = "NewV2"
+
+// Verdict is the decision of a plugin about a connection before its TLS handshake.
+type Verdict int
+
+const (
+	// VerdictPass leaves the connection to the next plugin and the routes of the server.
+	VerdictPass Verdict = iota
+	// VerdictClaim makes the plugin terminate TLS for the connection and serve it.
+	VerdictClaim
+	// VerdictReject closes the connection.
+	VerdictReject
+)
+
+// Hello contains what is known about a connection before its TLS handshake.
+type Hello struct {
+	// ServerName is the SNI the client asked for.
+	ServerName string
+	// ALPN contains the protocols offered by the client.
+	ALPN []string
+	// RemoteAddr is the address of the client. Addresses from PROXY protocol headers of trusted proxies are applied.
+	RemoteAddr net.Addr
+}
+
+// Meta contains what is known about a connection after its TLS handshake.
+type Meta struct {
+	// ServerName is the SNI the client asked for.
+	ServerName string
+	// ALPN is the negotiated protocol.
+	ALPN string
+	// PeerCertificates contains the certificates presented by the client, leaf first. They have been verified
+	// according to the TLS configuration of the backend the connection is routed to.
+	PeerCertificates []*x509.Certificate
+	// RemoteAddr is the address of the client. Addresses from PROXY protocol headers of trusted proxies are applied.
+	RemoteAddr net.Addr
+}
+
+// NewMeta collects the metadata of conn, which has completed its handshake.
+func NewMeta(conn *tls.Conn) Meta {
+	state := conn.ConnectionState()
+
+	return Meta{
+		ServerName:       state.ServerName,
+		ALPN:             state.NegotiatedProtocol,
+		PeerCertificates: state.PeerCertificates,
+		RemoteAddr:       conn.RemoteAddr(),
+	}
+}
+
+// Conn is a decrypted connection handed to a plugin.
+type Conn struct {
+	*tls.Conn
+	// Meta describes the connection.
+	Meta Meta
+}
+
+// Listener hands out the connections claimed by or routed to a plugin.
+type Listener interface {
+	// Accept waits for the next connection. Returns [net.ErrClosed] once the server shuts down.
+	Accept() (*Conn, error)
+	// Close does nothing, the server closes the listener when it shuts down.
+	Close() error
+	// Addr returns a descriptive address of the listener.
+	Addr() net.Addr
+}
+
+// Plugin is implemented by wallhack plugins.
+type Plugin interface {
+	// Name identifies the plugin. Routes refer to it as backend "plugin:<name>".
+	Name() string
+	// TLSConfig returns the TLS configuration for connections of the plugin. The server certificate is used if
+	// neither Certificates nor GetCertificate are set.
+	TLSConfig() *tls.Config
+	// Route is called before the TLS handshake of every connection. Plugins are asked in the order they are loaded,
+	// the first verdict other than [VerdictPass] decides.
+	Route(hello Hello) Verdict
+	// Check is called after the TLS handshake of every connection, no matter where it is routed to. Returning an
+	// error closes the connection.
+	Check(meta Meta) error
+	// Serve serves connections from listener until ctx is done.
+	Serve(ctx context.Context, listener Listener) error
+}